@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Approval authority. A step with `approval_mode: human_token` can't be
+// approved by the agent on its own: workflow_approve must be given either
+// the one-time code issued when the step started awaiting approval, or a
+// token signed with the config's approval_secret. The code is never put in
+// a tool response, the event journal or any other file; it only goes to
+// webhooks that subscribe to approval_code by name, where a human picks it
+// up.
+
+const (
+	approvalModeAgent      = "agent"
+	approvalModeHumanToken = "human_token"
+)
+
+// maxApprovalAttempts is how many wrong codes are accepted before the code
+// is replaced with a new one.
+const maxApprovalAttempts = 5
+
+// ApprovalRequest is the pending approval of a human_token step.
+type ApprovalRequest struct {
+	ID          string `json:"id"`        // nonce that approval tokens sign
+	CodeHash    string `json:"code_hash"` // sha256 of the one-time code
+	Attempts    int    `json:"attempts,omitempty"`
+	RequestedAt string `json:"requested_at"`
+}
+
+// approvalCodeAlphabet leaves out characters that are easy to confuse.
+const approvalCodeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// newApprovalRequest starts a human approval for step and returns the
+// one-time code, to be delivered with deliverApprovalCode.
+func newApprovalRequest(step *WorkflowStep) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate approval code: %w", err)
+	}
+	code := make([]byte, 8)
+	for i := range code {
+		code[i] = approvalCodeAlphabet[int(buf[i])%len(approvalCodeAlphabet)]
+	}
+	step.Approval = &ApprovalRequest{
+		ID:          hex.EncodeToString(buf[8:]),
+		CodeHash:    hashApprovalCode(string(code)),
+		RequestedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	return string(code[:4]) + "-" + string(code[4:]), nil
+}
+
+func hashApprovalCode(code string) string {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	sum := sha256.Sum256([]byte(normalized))
+	return hex.EncodeToString(sum[:])
+}
+
+// approvalToken is the signed alternative to a one-time code, for humans
+// who hold approval_secret (see `workflow-mcp approval-token`).
+func approvalToken(secret, workflowID, step, requestID string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s:%s:%s", workflowID, step, requestID)
+	return "v1." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func approvalSecret() string {
+	if config == nil {
+		return ""
+	}
+	return os.ExpandEnv(config.ApprovalSecret)
+}
+
+// approvalCodeAttempts and approvalCodeBackoff bound the in-memory retries
+// of an approval code delivery.
+const (
+	approvalCodeAttempts = 5
+	approvalCodeBackoff  = time.Second
+)
+
+// approvalDeliveries tracks approval codes still being sent, so a CLI
+// command can wait for them before it exits.
+var approvalDeliveries sync.WaitGroup
+
+// approvalCodeHooks returns the webhooks that receive approval codes: only
+// those listing approval_code in their events by name.
+func approvalCodeHooks(hooks []WebhookConfig) []WebhookConfig {
+	var out []WebhookConfig
+	for _, hook := range hooks {
+		if hook.URL != "" && containsString(hook.Events, "approval_code") {
+			out = append(out, hook)
+		}
+	}
+	return out
+}
+
+// deliverApprovalCode sends the code out of band, as an approval_code event,
+// to the webhooks returned by approvalCodeHooks. The code is never written
+// anywhere the agent could read it: not to the journal, the outbox or the
+// log. Deliveries are retried in memory and dropped if they keep failing.
+func deliverApprovalCode(st *WorkflowState, step *WorkflowStep, code string) {
+	var hooks []WebhookConfig
+	if config != nil {
+		hooks = approvalCodeHooks(config.Webhooks)
+	}
+	if len(hooks) == 0 || outbox == nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: no webhook receives approval_code events; approve %s step %s with a signed token (workflow-mcp approval-token)\n", st.ID, step.Name)
+		return
+	}
+	now := time.Now().UTC()
+	body, err := json.Marshal(WorkflowEvent{
+		Event:        "workflow",
+		Type:         "approval_code",
+		WorkflowID:   st.ID,
+		Step:         step.Name,
+		ApprovalCode: code,
+		Timestamp:    now.Format(time.RFC3339),
+	})
+	if err != nil {
+		return
+	}
+	for i, hook := range hooks {
+		item := outboxItem{
+			ID:        fmt.Sprintf("%d-%s-approval-%d", now.UnixNano(), st.ID, i),
+			URL:       hook.URL,
+			EventType: "approval_code",
+			Body:      string(body),
+		}
+		if secret := os.ExpandEnv(hook.Secret); secret != "" {
+			item.Signature = signPayload(secret, body)
+		}
+		approvalDeliveries.Add(1)
+		go func() {
+			defer approvalDeliveries.Done()
+			var err error
+			for attempt := 0; attempt < approvalCodeAttempts; attempt++ {
+				if attempt > 0 {
+					time.Sleep(approvalCodeBackoff << (attempt - 1))
+				}
+				if err = outbox.post(item); err == nil {
+					fmt.Fprintf(os.Stderr, "workflow-mcp: approval code for %s step %s sent to %s\n", st.ID, step.Name, item.URL)
+					return
+				}
+			}
+			fmt.Fprintf(os.Stderr, "workflow-mcp: webhook %s: giving up on the approval code for %s step %s: %v\n", item.URL, st.ID, step.Name, err)
+		}()
+	}
+}
+
+// checkApprovalGates refuses a workflow_step change (or a workflow_next)
+// that would get past an approval gate without going through
+// workflow_approve: changing a step that is awaiting approval, completing
+// or skipping a step that needs approval, or starting a step other than
+// one awaiting approval, or starting one after a gate that hasn't been
+// passed.
+func checkApprovalGates(st *WorkflowState, idx int, status string) error {
+	step := &st.Steps[idx]
+	hint := "call workflow_next() to request approval, then wait for it to be approved"
+	if step.Status == "awaiting_approval" {
+		return (&ToolError{
+			Message: fmt.Sprintf("step %s is awaiting approval", step.Name),
+			Hint:    "wait for it to be approved, or for feedback from workflow_iterate",
+		}).With("step", step.Name)
+	}
+	if step.NeedsApproval && (status == "completed" || status == "skipped") {
+		return (&ToolError{
+			Message: fmt.Sprintf("step %s needs approval and can't be marked %s without it", step.Name, status),
+			Hint:    hint,
+		}).With("step", step.Name)
+	}
+	if status != "in_progress" || step.Name == st.CurrentStep {
+		return nil
+	}
+	cur := stepIndex(st, st.CurrentStep)
+	if cur >= 0 && st.Steps[cur].Status == "awaiting_approval" {
+		return (&ToolError{
+			Message: fmt.Sprintf("step %s is awaiting approval; step %s can't start", st.CurrentStep, step.Name),
+			Hint:    "wait for it to be approved, or for feedback from workflow_iterate",
+		}).With("step", st.CurrentStep)
+	}
+	for i := max(cur, 0); i < idx; i++ {
+		gate := st.Steps[i]
+		if gate.NeedsApproval && gate.Status != "completed" && gate.Status != "skipped" {
+			return (&ToolError{
+				Message: fmt.Sprintf("step %s can't start before step %s is approved", step.Name, gate.Name),
+				Hint:    hint,
+			}).With("step", gate.Name).With("status", gate.Status)
+		}
+	}
+	return nil
+}
+
+// verifyApproval checks a code or token for step's pending approval.
+func verifyApproval(st *WorkflowState, step *WorkflowStep, code string) (string, bool) {
+	req := step.Approval
+	if req == nil || code == "" {
+		return "", false
+	}
+	if strings.HasPrefix(code, "v1.") {
+		secret := approvalSecret()
+		if secret == "" {
+			return "", false
+		}
+		want := approvalToken(secret, st.ID, step.Name, req.ID)
+		return "token", subtle.ConstantTimeCompare([]byte(code), []byte(want)) == 1
+	}
+	ok := subtle.ConstantTimeCompare([]byte(hashApprovalCode(code)), []byte(req.CodeHash)) == 1
+	return "code", ok
+}
+
+// rejectApproval records a workflow_approve without a valid code and
+// returns the error for the caller. After too many wrong codes the code is
+// replaced, so it can't be guessed.
+func rejectApproval(st *WorkflowState, step *WorkflowStep, code string) error {
+	reason := "no approval code given"
+	if code != "" {
+		reason = "invalid approval code"
+	}
+	newCode := ""
+	if step.Approval == nil {
+		// e.g. awaiting approval since before approval_mode was set
+		var err error
+		if newCode, err = newApprovalRequest(step); err != nil {
+			return err
+		}
+	} else if code != "" {
+		step.Approval.Attempts++
+		if step.Approval.Attempts >= maxApprovalAttempts {
+			var err error
+			if newCode, err = newApprovalRequest(step); err != nil {
+				return err
+			}
+			reason += "; too many attempts, a new code was issued"
+		}
+	}
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "approval_rejected",
+		WorkflowID: st.ID,
+		Step:       step.Name,
+		Status:     step.Status,
+		Message:    reason,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := store.Commit(st, &event); err != nil {
+		return err
+	}
+	if newCode != "" {
+		deliverApprovalCode(st, step, newCode)
+	}
+
+	return (&ToolError{
+		Message: fmt.Sprintf("step %s needs approval from a human: %s", step.Name, reason),
+		Hint:    "do not approve this step yourself. Ask the user to run `workflow-mcp approve --code <code>` with the approval code sent to them, or to give you that code (or a token from `workflow-mcp approval-token`) to pass as approval_code",
+	}).With("step", step.Name).With("approval_mode", approvalModeHumanToken)
+}
+
+func approvalMessage(approvedWith string) string {
+	switch approvedWith {
+	case "code":
+		return "approved with one-time code"
+	case "token":
+		return "approved with signed token"
+	case "":
+		return ""
+	}
+	return "approved via " + approvedWith
+}
+
+// joinMessages joins the non-empty parts of an event message.
+func joinMessages(parts ...string) string {
+	out := []string{}
+	for _, p := range parts {
+		if p != "" {
+			out = append(out, p)
+		}
+	}
+	return strings.Join(out, "; ")
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const approvalTestConfig = `name: gates
+approval_secret: s3cret
+steps:
+  - name: plan
+    needs_approval: true
+    approval_mode: %s
+    allows_iteration: true
+    instructions: Plan it.
+  - name: execute
+    instructions: Do it.
+  - name: verify
+    instructions: Check it.
+`
+
+func TestApprovalGates(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string
+		calls []toolCall
+		want  string // step statuses afterwards, see stepStatuses
+	}{
+		{
+			name: "agent approval",
+			mode: approvalModeAgent,
+			calls: []toolCall{
+				{tool: "workflow_next", want: map[string]any{"status": "awaiting_approval"}},
+				{tool: "workflow_next", wantErr: "step plan is awaiting approval"},
+				{tool: "workflow_approve", want: map[string]any{"approved": true, "current_step": "execute"}},
+			},
+			want: "plan=completed execute=in_progress verify=pending",
+		},
+		{
+			name: "next twice on a human_token step",
+			mode: approvalModeHumanToken,
+			calls: []toolCall{
+				{tool: "workflow_next", want: map[string]any{"status": "awaiting_approval", "approval_mode": approvalModeHumanToken}},
+				{tool: "workflow_next", wantErr: "step plan is awaiting approval"},
+				{tool: "workflow_next", args: `{"outcome":"failure"}`, wantErr: "step plan is awaiting approval"},
+			},
+			want: "plan=awaiting_approval execute=pending verify=pending",
+		},
+		{
+			name: "human_token approval without a code",
+			mode: approvalModeHumanToken,
+			calls: []toolCall{
+				{tool: "workflow_next"},
+				{tool: "workflow_approve", wantErr: "no approval code given"},
+				{tool: "workflow_approve", args: `{"approval_code":"AAAA-BBBB"}`, wantErr: "invalid approval code"},
+			},
+			want: "plan=awaiting_approval execute=pending verify=pending",
+		},
+		{
+			name: "next on a blocked gate",
+			mode: approvalModeHumanToken,
+			calls: []toolCall{
+				{tool: "workflow_blocked", args: `{"reason":"waiting on a decision"}`},
+				{tool: "workflow_next", wantErr: "step plan needs approval"},
+			},
+			want: "plan=blocked execute=pending verify=pending",
+		},
+		{
+			name: "workflow_step past a gate",
+			mode: approvalModeHumanToken,
+			calls: []toolCall{
+				{tool: "workflow_step", args: `{"step":"plan","status":"completed"}`, wantErr: "step plan needs approval"},
+				{tool: "workflow_step", args: `{"step":"plan","status":"skipped"}`, wantErr: "step plan needs approval"},
+				{tool: "workflow_step", args: `{"step":"verify","status":"in_progress"}`, wantErr: "step verify can't start before step plan is approved"},
+				{tool: "workflow_next"},
+				{tool: "workflow_step", args: `{"step":"plan","status":"in_progress"}`, wantErr: "step plan is awaiting approval"},
+				{tool: "workflow_step", args: `{"step":"execute","status":"in_progress"}`, wantErr: "step plan is awaiting approval"},
+			},
+			want: "plan=awaiting_approval execute=pending verify=pending",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer(t, strings.Replace(approvalTestConfig, "%s", tt.mode, 1))
+			runCalls(t, append([]toolCall{{tool: "workflow_init", args: `{"task":"gates"}`}}, tt.calls...))
+			if got := stepStatuses(activeState(t)); got != tt.want {
+				t.Errorf("steps = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestApprovalToken(t *testing.T) {
+	testServer(t, strings.Replace(approvalTestConfig, "%s", approvalModeHumanToken, 1))
+	runCalls(t, []toolCall{
+		{tool: "workflow_init", args: `{"task":"gates"}`},
+		{tool: "workflow_next"},
+	})
+
+	st := activeState(t)
+	req := st.Steps[0].Approval
+	if req == nil {
+		t.Fatal("no approval request on the waiting step")
+	}
+	if strings.Contains(stepStatuses(st), "completed") {
+		t.Fatalf("steps = %s before approval", stepStatuses(st))
+	}
+	wrongStep := approvalToken("s3cret", st.ID, "execute", req.ID)
+	token := approvalToken("s3cret", st.ID, "plan", req.ID)
+	runCalls(t, []toolCall{
+		{tool: "workflow_approve", args: `{"approval_code":"` + wrongStep + `"}`, wantErr: "invalid approval code"},
+		{tool: "workflow_approve", args: `{"approval_code":"` + token + `"}`, want: map[string]any{"approved": true, "current_step": "execute"}},
+	})
+
+	st = activeState(t)
+	if by := st.Steps[0].Attempts[len(st.Steps[0].Attempts)-1].ApprovedBy; by != "token" {
+		t.Errorf("approved_by = %s, want token", by)
+	}
+	if st.Steps[0].Approval != nil {
+		t.Errorf("approval request kept after approval")
+	}
+}
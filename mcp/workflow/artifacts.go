@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Artifact revisions. Setting an artifact again doesn't lose what it said
+// before: the superseded revision moves to ArtifactHistory, so a reviewer
+// can look at iteration 2 of the plan while reading iteration 3, and
+// workflow_diff_artifact can show what changed between them. Revisions are
+// numbered from 1; Artifacts holds the latest.
+
+// putArtifact stores content as the newest revision of artifactType and
+// returns it, and whether the type is new. The caller commits st.
+func putArtifact(st *WorkflowState, artifactType string, content any) (Artifact, bool) {
+	if st.Artifacts == nil {
+		st.Artifacts = make(map[string]Artifact)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	artifact := Artifact{
+		Type:      artifactType,
+		Content:   content,
+		Step:      st.CurrentStep,
+		CreatedAt: now,
+		UpdatedAt: now,
+		Revision:  1,
+		Iteration: st.IterationCount,
+	}
+
+	existing, exists := st.Artifacts[artifactType]
+	if exists {
+		// Keep the superseded revision, and the artifact's CreatedAt
+		existing.Revision = artifactRevision(existing)
+		if st.ArtifactHistory == nil {
+			st.ArtifactHistory = make(map[string][]Artifact)
+		}
+		st.ArtifactHistory[artifactType] = append(st.ArtifactHistory[artifactType], existing)
+		artifact.CreatedAt = existing.CreatedAt
+		artifact.Revision = existing.Revision + 1
+	}
+
+	st.Artifacts[artifactType] = artifact
+	return artifact, !exists
+}
+
+// artifactRevision is a's revision number; artifacts set before revisions
+// were recorded count as revision 1.
+func artifactRevision(a Artifact) int {
+	return max(a.Revision, 1)
+}
+
+// artifactRevisions returns every revision of artifactType, oldest first.
+func artifactRevisions(st *WorkflowState, artifactType string) []Artifact {
+	current, ok := st.Artifacts[artifactType]
+	if !ok {
+		return nil
+	}
+	return append(append([]Artifact{}, st.ArtifactHistory[artifactType]...), current)
+}
+
+// findRevision returns revision rev of artifactType; 0 means the latest.
+func findRevision(st *WorkflowState, artifactType string, rev int) (Artifact, error) {
+	revisions := artifactRevisions(st, artifactType)
+	if len(revisions) == 0 {
+		return Artifact{}, artifactNotFound(st, artifactType)
+	}
+	if rev == 0 {
+		return revisions[len(revisions)-1], nil
+	}
+	for _, a := range revisions {
+		if artifactRevision(a) == rev {
+			return a, nil
+		}
+	}
+	latest := artifactRevision(revisions[len(revisions)-1])
+	return Artifact{}, (&ToolError{
+		Message: fmt.Sprintf("artifact %s has no revision %d", artifactType, rev),
+		Hint:    fmt.Sprintf("revisions are numbered 1 to %d", latest),
+	}).With("type", artifactType).With("latest_revision", latest)
+}
+
+func artifactNotFound(st *WorkflowState, artifactType string) error {
+	types := []string{}
+	for t := range st.Artifacts {
+		types = append(types, t)
+	}
+	return toolError("workflow %s has no %s artifact", st.ID, artifactType).With("artifacts", types)
+}
+
+// artifactOwner picks the workflow to read artifacts from: the running
+// sub-workflow if it has artifactType (as with workflow://current
+// resources), otherwise st.
+func artifactOwner(st *WorkflowState, artifactType string) *WorkflowState {
+	if leaf, err := activeLeaf(st); err == nil && leaf != st {
+		if _, ok := leaf.Artifacts[artifactType]; ok {
+			return leaf
+		}
+	}
+	return st
+}
+
+// workflowGetArtifact returns one revision of an artifact (the latest by
+// default) with a summary of all its revisions.
+func workflowGetArtifact(st *WorkflowState, artifactType string, rev int) (string, error) {
+	st = artifactOwner(st, artifactType)
+	artifact, err := findRevision(st, artifactType, rev)
+	if err != nil {
+		return "", err
+	}
+
+	revisions := []map[string]any{}
+	for _, a := range artifactRevisions(st, artifactType) {
+		revisions = append(revisions, map[string]any{
+			"revision":   artifactRevision(a),
+			"step":       a.Step,
+			"iteration":  a.Iteration,
+			"updated_at": a.UpdatedAt,
+		})
+	}
+	artifact.Revision = artifactRevision(artifact)
+	output, _ := json.MarshalIndent(map[string]any{
+		"workflow_id": st.ID,
+		"artifact":    artifact,
+		"revisions":   revisions,
+	}, "", "  ")
+	return string(output), nil
+}
+
+// workflowDiffArtifact diffs two revisions of an artifact: by default the
+// latest against the one before it.
+func workflowDiffArtifact(st *WorkflowState, artifactType string, from, to int) (string, error) {
+	st = artifactOwner(st, artifactType)
+	newer, err := findRevision(st, artifactType, to)
+	if err != nil {
+		return "", err
+	}
+	to = artifactRevision(newer)
+	if from == 0 {
+		from = to - 1
+	}
+	if from < 1 {
+		return "", (&ToolError{
+			Message: fmt.Sprintf("artifact %s has only one revision", artifactType),
+			Hint:    "there is nothing to compare it with until it is set again",
+		}).With("type", artifactType)
+	}
+	older, err := findRevision(st, artifactType, from)
+	if err != nil {
+		return "", err
+	}
+
+	a, err := artifactLines(older)
+	if err != nil {
+		return "", err
+	}
+	b, err := artifactLines(newer)
+	if err != nil {
+		return "", err
+	}
+	diff := unifiedDiff(fmt.Sprintf("%s@%d", artifactType, from), fmt.Sprintf("%s@%d", artifactType, to), a, b)
+
+	output, _ := json.MarshalIndent(map[string]any{
+		"workflow_id":   st.ID,
+		"type":          artifactType,
+		"from_revision": from,
+		"to_revision":   to,
+		"changed":       diff != "",
+		"diff":          diff,
+	}, "", "  ")
+	return string(output), nil
+}
+
+// artifactLines splits an artifact's content into lines for diffing:
+// text by line, lists by item (non-string items as JSON).
+func artifactLines(a Artifact) ([]string, error) {
+	switch content := a.Content.(type) {
+	case string:
+		if content == "" {
+			return nil, nil
+		}
+		return strings.Split(strings.TrimSuffix(content, "\n"), "\n"), nil
+	case []any:
+		lines := make([]string, len(content))
+		for i, item := range content {
+			if s, ok := item.(string); ok {
+				lines[i] = s
+			} else {
+				data, _ := json.Marshal(item)
+				lines[i] = string(data)
+			}
+		}
+		return lines, nil
+	case []string:
+		return content, nil
+	}
+	return nil, (&ToolError{
+		Message: fmt.Sprintf("can't diff artifact %s: only text and list content can be diffed", a.Type),
+		Hint:    "use workflow_get_artifact with revision to compare other content",
+	}).With("type", a.Type)
+}
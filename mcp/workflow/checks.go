@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Executable checks. A step's `checks:` block, or a criterion's check,
+// names a shell command to run in the project directory (where
+// workflow.yaml is). workflow_run_checks runs them, stores exit codes,
+// durations and the tail of their output as the test_results artifact (a
+// TestReport with the checks as the cases of one suite), and marks the
+// criteria they verify pass or fail, so requires_criteria_pass rests on
+// commands that actually ran rather than on the agent's word.
+
+// defaultCheckTimeout applies to checks without a timeout.
+const defaultCheckTimeout = 10 * time.Minute
+
+// checkOutputLimit is how much of the end of stdout and of stderr is kept.
+const checkOutputLimit = 4096
+
+// Check is a command whose exit code verifies something.
+type Check struct {
+	Name      string `yaml:"name" json:"name,omitempty"`
+	Command   string `yaml:"command" json:"command"`
+	Dir       string `yaml:"dir" json:"dir,omitempty"`         // relative to the project directory
+	Timeout   string `yaml:"timeout" json:"timeout,omitempty"` // e.g. "90s"; 10m by default
+	ExitCode  int    `yaml:"exit_code" json:"exit_code,omitempty"`
+	Criterion string `yaml:"criterion" json:"criterion,omitempty"` // ID or text of the criterion it verifies (step checks only)
+}
+
+// CheckResult is one run of a check, as stored in test_results.
+type CheckResult struct {
+	Name       string `json:"name"`
+	Command    string `json:"command"`
+	Dir        string `json:"dir,omitempty"`
+	Criterion  string `json:"criterion,omitempty"`
+	Passed     bool   `json:"passed"`
+	ExitCode   int    `json:"exit_code"` // -1 if the command didn't exit by itself
+	Expected   int    `json:"expected_exit_code"`
+	TimedOut   bool   `json:"timed_out,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+	Stdout     string `json:"stdout,omitempty"`
+	Stderr     string `json:"stderr,omitempty"`
+}
+
+// plannedCheck is a check to run, and the ID of the criterion it verifies.
+type plannedCheck struct {
+	Check
+	criterion string
+}
+
+// checkRun is what workflowRunChecks decided to run, for recording the
+// results once the commands are done.
+type checkRun struct {
+	workflowID string
+	step       string
+	attempt    int // see runAttempt
+	checks     []plannedCheck
+}
+
+// runAttempt is the number of the running attempt at st's current step, or
+// 0 if it has none. Results are only recorded in the attempt whose checks
+// ran.
+func runAttempt(st *WorkflowState) int {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 || openAttempt(&st.Steps[idx]) == nil {
+		return 0
+	}
+	return len(st.Steps[idx].Attempts)
+}
+
+// projectDir is where checks run: the directory of workflow.yaml.
+func projectDir() string {
+	return filepath.Dir(configFile)
+}
+
+// checkTimeout parses c's timeout.
+func checkTimeout(c Check) (time.Duration, error) {
+	if c.Timeout == "" {
+		return defaultCheckTimeout, nil
+	}
+	d, err := time.ParseDuration(c.Timeout)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q: use a duration such as 90s or 5m", c.Timeout)
+	}
+	return d, nil
+}
+
+// findCriterion returns the index of the criterion with ID or text ref.
+func findCriterion(criteria []Criterion, ref string) int {
+	for i, c := range criteria {
+		if c.ID == ref {
+			return i
+		}
+	}
+	for i, c := range criteria {
+		if c.Text == ref {
+			return i
+		}
+	}
+	return -1
+}
+
+// planChecks collects the checks of st's current step (and its running
+// branches) and those attached to its criteria. only, if set, picks one
+// check by name or criterion ID.
+func planChecks(st *WorkflowState, only string) (*checkRun, error) {
+	criteria := loadCriteria(criteriaOwner(st))
+
+	var all []plannedCheck
+	if idx := stepIndex(st, st.CurrentStep); idx >= 0 {
+		steps := []WorkflowStep{st.Steps[idx]}
+		for _, b := range st.Steps[idx].Parallel {
+			if b.Status == "in_progress" {
+				steps = append(steps, b)
+			}
+		}
+		for _, step := range steps {
+			for _, c := range step.Checks {
+				p := plannedCheck{Check: c}
+				if p.Name == "" {
+					p.Name = p.Command
+				}
+				if c.Criterion != "" {
+					if i := findCriterion(criteria, c.Criterion); i >= 0 {
+						p.criterion = criteria[i].ID
+					}
+				}
+				all = append(all, p)
+			}
+		}
+	}
+	for _, c := range criteria {
+		if c.Check != nil && c.Check.Command != "" {
+			p := plannedCheck{Check: *c.Check, criterion: c.ID}
+			p.Name = c.ID
+			all = append(all, p)
+		}
+	}
+
+	if len(all) == 0 {
+		return nil, (&ToolError{
+			Message: fmt.Sprintf("step %s has no checks to run", st.CurrentStep),
+			Hint:    "add a checks: block to the step in workflow.yaml, or give criteria a check with workflow_set_criteria",
+		}).With("step", st.CurrentStep)
+	}
+
+	run := &checkRun{workflowID: st.ID, step: st.CurrentStep, attempt: runAttempt(st)}
+	names := []string{}
+	for _, p := range all {
+		names = append(names, p.Name)
+		if only == "" || p.Name == only || p.criterion == only {
+			run.checks = append(run.checks, p)
+		}
+	}
+	if len(run.checks) == 0 {
+		return nil, toolError("check %s not found", only).With("checks", names)
+	}
+	return run, nil
+}
+
+// runCheck runs one check and waits for it to finish or time out.
+func runCheck(p plannedCheck) CheckResult {
+	result := CheckResult{
+		Name:      p.Name,
+		Command:   p.Command,
+		Dir:       p.Dir,
+		Criterion: p.criterion,
+		ExitCode:  -1,
+		Expected:  p.ExitCode,
+	}
+	timeout, err := checkTimeout(p.Check)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	dir := projectDir()
+	if p.Dir != "" {
+		if filepath.IsAbs(p.Dir) {
+			dir = p.Dir
+		} else {
+			dir = filepath.Join(dir, p.Dir)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := shellCommand(ctx, p.Command)
+	cmd.Dir = dir
+	// Don't wait forever for output from processes the command left behind
+	cmd.WaitDelay = 5 * time.Second
+	stdout := &tailBuffer{limit: checkOutputLimit}
+	stderr := &tailBuffer{limit: checkOutputLimit}
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+
+	start := time.Now()
+	err = cmd.Run()
+	result.DurationMS = time.Since(start).Milliseconds()
+	result.Stdout, result.Stderr = stdout.String(), stderr.String()
+
+	var exitErr *exec.ExitError
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		result.TimedOut = true
+		result.Error = fmt.Sprintf("timed out after %s", timeout)
+	case err == nil:
+		result.ExitCode = 0
+	case errors.As(err, &exitErr) && exitErr.ExitCode() >= 0:
+		result.ExitCode = exitErr.ExitCode()
+	default:
+		result.Error = err.Error()
+	}
+	result.Passed = result.Error == "" && result.ExitCode == result.Expected
+	return result
+}
+
+// checkEvidence summarizes r as a criterion's evidence.
+func checkEvidence(r CheckResult) string {
+	return checkSummary(r) + "; see the test_results artifact"
+}
+
+// checkSummary describes how r ended, with the last line of its output if
+// it failed.
+func checkSummary(r CheckResult) string {
+	took := time.Duration(r.DurationMS) * time.Millisecond
+	if took >= time.Second {
+		took = took.Round(100 * time.Millisecond)
+	}
+	var s string
+	switch {
+	case r.Error != "":
+		s = fmt.Sprintf("`%s`: %s", r.Command, r.Error)
+	case r.Passed:
+		s = fmt.Sprintf("`%s` exited %d in %s", r.Command, r.ExitCode, took)
+	default:
+		s = fmt.Sprintf("`%s` exited %d (expected %d) in %s", r.Command, r.ExitCode, r.Expected, took)
+	}
+	if !r.Passed {
+		if line := lastLine(r.Stderr); line != "" {
+			s += ": " + line
+		} else if line := lastLine(r.Stdout); line != "" {
+			s += ": " + line
+		}
+	}
+	return s
+}
+
+func lastLine(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// workflowRunChecks runs the checks of the current step of the workflow
+// (the active one by default, descending into a running sub-workflow).
+// Unlike other tools it doesn't hold the store lock throughout: the lock
+// is released while the commands run, so a slow test suite doesn't hold up
+// every other server sharing the state directory.
+func workflowRunChecks(workflowID, only string) (string, error) {
+	run, err := withLock(func() (*checkRun, error) {
+		st, err := resolveWorkflow(workflowID)
+		if err != nil {
+			return nil, err
+		}
+		if st, err = activeLeaf(st); err != nil {
+			return nil, err
+		}
+		if err := checkToolAllowed(st, "workflow_run_checks"); err != nil {
+			return nil, err
+		}
+		return planChecks(st, only)
+	})
+	if err != nil {
+		return "", err
+	}
+
+	results := make([]CheckResult, len(run.checks))
+	for i, p := range run.checks {
+		results[i] = runCheck(p)
+	}
+
+	return withLock(func() (string, error) {
+		st, err := store.Load(run.workflowID)
+		if err != nil {
+			return "", err
+		}
+		// The workflow may have moved on while the commands ran
+		if st.CurrentStep != run.step || runAttempt(st) != run.attempt {
+			return "", (&ToolError{
+				Message: fmt.Sprintf("step %s ended while its checks ran; results not recorded", run.step),
+				Hint:    "run workflow_run_checks again in the current step",
+			}).With("step", run.step).With("current_step", st.CurrentStep).With("checks", results)
+		}
+		return recordCheckResults(st, run, results)
+	})
+}
+
+// recordCheckResults stores results as st's test_results artifact and marks
+// the criteria they verify. Waived criteria are left alone.
+func recordCheckResults(st *WorkflowState, run *checkRun, results []CheckResult) (string, error) {
+	passed := 0
+	for _, r := range results {
+		if r.Passed {
+			passed++
+		}
+	}
+	failed := len(results) - passed
+	status := criterionPass
+	if failed > 0 {
+		status = criterionFail
+	}
+
+	report := TestReport{Format: "checks", Suites: []TestSuite{{Name: run.step}}}
+	for _, r := range results {
+		c := TestCase{Name: r.Name, Status: testPassed, DurationMS: r.DurationMS}
+		if !r.Passed {
+			c.Status, c.Message = testFailed, checkSummary(r)
+		}
+		report.Suites[0].Cases = append(report.Suites[0].Cases, c)
+	}
+	report.count()
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	artifact, added := putArtifact(st, "test_results", struct {
+		TestReport
+		Step   string        `json:"step"`
+		RunAt  string        `json:"run_at"`
+		Checks []CheckResult `json:"checks"`
+	}{report, run.step, now, results})
+	st.UpdatedAt = now
+
+	// Mark the criteria the checks verify
+	owner := criteriaOwner(st)
+	criteria := loadCriteria(owner)
+	updated := []string{}
+	for _, r := range results {
+		i := findCriterion(criteria, r.Criterion)
+		if r.Criterion == "" || i < 0 || criteria[i].Status == criterionWaived {
+			continue
+		}
+		criteria[i].Status = criterionFail
+		if r.Passed {
+			criteria[i].Status = criterionPass
+		}
+		criteria[i].Evidence = checkEvidence(r)
+		criteria[i].UpdatedAt = now
+		if !containsString(updated, criteria[i].ID) {
+			updated = append(updated, criteria[i].ID)
+		}
+	}
+	if len(updated) > 0 {
+		storeCriteria(owner, criteria, now)
+	}
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "checks_run",
+		WorkflowID: st.ID,
+		Step:       run.step,
+		Status:     status,
+		Message:    fmt.Sprintf("%d of %d checks passed", passed, len(results)),
+		Timestamp:  now,
+	}
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+	artifactUpdated(st, "test_results", added)
+
+	if len(updated) > 0 {
+		if owner != st {
+			// The criteria belong to an enclosing workflow
+			ownerEvent := WorkflowEvent{
+				Event:      "workflow",
+				Type:       "criterion_updated",
+				WorkflowID: owner.ID,
+				Step:       run.step,
+				Status:     status,
+				Message:    fmt.Sprintf("%s: checked by workflow_run_checks in %s", strings.Join(updated, ", "), st.ID),
+				Timestamp:  now,
+			}
+			if err := store.Commit(owner, &ownerEvent); err != nil {
+				return "", err
+			}
+		}
+		artifactUpdated(owner, "criteria", false)
+	}
+
+	result := map[string]any{
+		"passed":           passed,
+		"failed":           failed,
+		"checks":           results,
+		"revision":         artifact.Revision,
+		"criteria_updated": updated,
+		"event":            event,
+	}
+	if criteria != nil {
+		result["criteria"] = criteriaSummary(criteria)
+	}
+	if failed > 0 {
+		result["message"] = "Some checks failed. Fix the problems and run the checks again."
+		if back := failureGoesBack(st, run.step); back != "" {
+			result["message"] = fmt.Sprintf("Some checks failed. Fix the problems and run the checks again, or call workflow_next(outcome: \"failure\") to go back to %s.", back)
+		}
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// tailBuffer is an io.Writer that keeps the last limit bytes written.
+type tailBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > 2*b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// String returns the kept output, starting at a line boundary if earlier
+// output was dropped.
+func (b *tailBuffer) String() string {
+	data := b.buf
+	truncated := b.truncated
+	if len(data) > b.limit {
+		data = data[len(data)-b.limit:]
+		truncated = true
+	}
+	if !truncated {
+		return string(data)
+	}
+	if i := strings.IndexByte(string(data), '\n'); i >= 0 && i < len(data)-1 {
+		data = data[i+1:]
+	}
+	return "[...]\n" + strings.ToValidUTF8(string(data), "")
+}
@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: workflow-mcp [command] [flags]
+
+With no command, serves MCP over stdio, or with --http over HTTP:
+  --http <addr>            serve MCP at /mcp, plus the REST API, event
+                           stream and dashboard, on addr (e.g. :7420, which
+                           is 127.0.0.1:7420 unless a token is set; other
+                           hosts need --http-token)
+  --http-token <token>     require this bearer token for HTTP requests
+                           (default $WORKFLOW_HTTP_TOKEN)
+
+Commands for humans, working on the same state as the MCP server (use
+--workflow <id> to pick a workflow other than the active one, and --json for
+the full JSON response):
+  status                   show the current step and progress
+  list [--all]             list workflows (--all includes archived ones)
+  history [step]           show each step's attempts, iterations and approvals
+  approve [--code <code>]  approve the step awaiting approval (human_token
+                           steps need the approval code or a signed token)
+  iterate --feedback <text>
+                           send the step awaiting approval back for changes
+  reject [--to <step>] --reason <text>
+                           send the workflow back to an earlier step
+  block [--reason <text>]  mark the current step blocked
+  unblock [--note <text>]  put a blocked step back in progress
+  reset --to <step>        restart the workflow from step
+  show-artifact <type> [--revision <n>]
+                           print an artifact (plan, criteria, ...), or an
+                           earlier revision of it
+
+Config:
+  validate [file]          check a workflow config (default ./workflow.yaml)
+  schema                   print the JSON Schema for workflow.yaml
+  approval-token [workflow_id]
+                           sign an approval token for a human_token step
+                           awaiting approval (needs approval_secret)
+  gen-skills <dir>         write Claude Code command files for the workflow
+                           (e.g. .claude/commands), same as the MCP prompts
+`
+
+// runCommand runs a command-line subcommand and returns the exit status.
+func runCommand(args []string) int {
+	switch args[0] {
+	case "validate":
+		return cmdValidate(args[1:])
+	case "schema":
+		os.Stdout.Write(configSchema)
+		return 0
+	case "approval-token":
+		return cmdApprovalToken(args[1:])
+	case "gen-skills":
+		return cmdGenSkills(args[1:])
+	case "status", "list", "history", "approve", "iterate", "reject", "block", "unblock", "reset", "show-artifact":
+		return cmdState(args[0], args[1:])
+	case "help", "-h", "--help":
+		fmt.Print(usage)
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "workflow-mcp: unknown command %q\n\n%s", args[0], usage)
+		return 2
+	}
+}
+
+// parseFlags parses flags that may come before or after positional
+// arguments, and returns the positional ones.
+func parseFlags(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// cmdState runs one of the human-facing state commands. Like a tool call it
+// holds the store lock and commits the same events, so a running MCP
+// session and webhook consumers see the change.
+func cmdState(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	workflowID := fs.String("workflow", "", "workflow ID (default: the active workflow)")
+	asJSON := fs.Bool("json", false, "print the full JSON response")
+	all := fs.Bool("all", false, "include archived workflows")
+	feedback := fs.String("feedback", "", "feedback for iterate")
+	code := fs.String("code", "", "approval code or signed token for approve")
+	reason := fs.String("reason", "", "reason for block or reject")
+	note := fs.String("note", "", "note for unblock")
+	to := fs.String("to", "", "step to reset or reject to")
+	revision := fs.Int("revision", 0, "artifact revision for show-artifact")
+	positional, err := parseFlags(fs, args)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp %s: %v\n\n%s", name, err, usage)
+		return 2
+	}
+
+	loadConfig()
+	defer approvalDeliveries.Wait() // after unlocking, for a code issued by approve
+	unlock, err := store.Lock()
+	if err != nil {
+		return cliError(err)
+	}
+	defer unlock()
+
+	if name == "list" {
+		output, err := workflowList(*all)
+		if err != nil {
+			return cliError(err)
+		}
+		if *asJSON {
+			fmt.Println(output)
+		} else {
+			printList(output)
+		}
+		return 0
+	}
+
+	st, err := resolveWorkflow(*workflowID)
+	if err == nil && name != "status" && name != "history" && name != "show-artifact" {
+		st, err = activeLeaf(st) // act where the work is, like the step tools
+	}
+	if err != nil {
+		return cliError(err)
+	}
+
+	var output string
+	switch name {
+	case "status":
+		if !*asJSON {
+			printStatus(st)
+			return 0
+		}
+		output, err = workflowStatus(st)
+	case "history":
+		step := ""
+		if len(positional) > 0 {
+			step = positional[0]
+		}
+		if output, err = workflowHistory(st, step); err == nil && !*asJSON {
+			printHistory(output)
+			return 0
+		}
+	case "approve":
+		output, err = approveStep(st, *code, "cli")
+	case "iterate":
+		if *feedback == "" {
+			fmt.Fprintln(os.Stderr, "workflow-mcp iterate: --feedback is required")
+			return 2
+		}
+		output, err = workflowIterate(st, *feedback)
+	case "reject":
+		if *reason == "" {
+			fmt.Fprintln(os.Stderr, "workflow-mcp reject: --reason is required")
+			return 2
+		}
+		output, err = workflowReject(st, *to, *reason)
+	case "block":
+		output, err = workflowBlocked(st, *reason)
+	case "unblock":
+		output, err = workflowUnblock(st, *note)
+	case "reset":
+		if *to == "" {
+			fmt.Fprintln(os.Stderr, "workflow-mcp reset: --to <step> is required")
+			return 2
+		}
+		output, err = workflowReset(st, *to)
+	case "show-artifact":
+		if len(positional) != 1 {
+			fmt.Fprintln(os.Stderr, "workflow-mcp show-artifact: expected one artifact type, e.g. plan")
+			return 2
+		}
+		return showArtifact(st, positional[0], *revision, *asJSON)
+	}
+	if err != nil {
+		return cliError(err)
+	}
+
+	if *asJSON {
+		fmt.Println(output)
+	} else {
+		printEvent(output)
+	}
+	return 0
+}
+
+func cliError(err error) int {
+	var te *ToolError
+	if errors.As(err, &te) {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: %s\n", te.Message)
+		if te.Hint != "" {
+			fmt.Fprintf(os.Stderr, "  %s\n", te.Hint)
+		}
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "workflow-mcp: %v\n", err)
+	return 1
+}
+
+// printEvent prints the event a command committed as one line.
+func printEvent(output string) {
+	var result struct {
+		Event WorkflowEvent `json:"event"`
+	}
+	json.Unmarshal([]byte(output), &result)
+	ev := result.Event
+	line := fmt.Sprintf("%s: %s %s", ev.WorkflowID, ev.Type, ev.Step)
+	if ev.NextStep != "" {
+		line += " -> " + ev.NextStep
+	}
+	if ev.Message != "" {
+		line += " (" + ev.Message + ")"
+	}
+	fmt.Println(line)
+}
+
+func printStatus(st *WorkflowState) {
+	active := ""
+	if store.ActiveID() == st.ID {
+		active = " (active)"
+	}
+	fmt.Printf("Workflow %s%s: %s\n", st.ID, active, st.Task)
+	fmt.Printf("Step:     %s\n", st.CurrentStep)
+	fmt.Printf("Progress: %.0f%%\n", rolledUpProgress(st))
+	now := time.Now()
+	fmt.Printf("Elapsed:  %s\n", formatDuration(workflowElapsed(st, now)))
+	for _, t := range currentStepTimings(st, now) {
+		line := fmt.Sprintf("%s started %s ago", t["step"], t["elapsed"])
+		if since, ok := t["awaiting_approval_for"]; ok {
+			line += fmt.Sprintf(", awaiting approval for %s", since)
+		}
+		if t["overdue"] == true {
+			line += fmt.Sprintf(" (OVERDUE: timeout %s)", t["timeout"])
+		} else if remaining, ok := t["remaining"]; ok {
+			line += fmt.Sprintf(" (%s left)", remaining)
+		}
+		fmt.Printf("          %s\n", line)
+	}
+	if idle := staleFor(st, now); idle > 0 {
+		fmt.Printf("Stale:    no activity for %s\n", formatDuration(idle))
+	}
+	if st.WaitingForApproval {
+		fmt.Println("Waiting for approval (workflow-mcp approve / iterate --feedback ...)")
+	}
+	if st.ParentID != "" {
+		fmt.Printf("Parent:   %s (step %s)\n", st.ParentID, st.ParentStep)
+	}
+	fmt.Println()
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, step := range st.Steps {
+		marker := " "
+		if step.Name == st.CurrentStep {
+			marker = ">"
+		}
+		extra := ""
+		if step.ChildID != "" {
+			extra = "sub-workflow " + step.ChildID
+		}
+		fmt.Fprintf(w, "%s %s\t%s\t%s\n", marker, step.Name, step.Status, extra)
+		for _, b := range step.Parallel {
+			fmt.Fprintf(w, "    %s\t%s\t\n", b.Name, b.Status)
+		}
+	}
+	w.Flush()
+}
+
+// printHistory prints workflow_history output, one line per attempt with
+// its iterations below it.
+func printHistory(output string) {
+	var result struct {
+		Steps []stepHistoryLine `json:"steps"`
+	}
+	json.Unmarshal([]byte(output), &result)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	var print func(s stepHistoryLine, indent string)
+	print = func(s stepHistoryLine, indent string) {
+		fmt.Fprintf(w, "%s%s\t%s\t%d attempt(s), %d iteration(s)\n", indent, s.Name, s.Status, len(s.Attempts), s.Iterations)
+		for i, a := range s.Attempts {
+			status := a.Status
+			if a.CompletedAt == "" {
+				status = "open"
+			}
+			line := fmt.Sprintf("%s  #%d\t%s\t%s -> %s", indent, i+1, status, orDash(a.StartedAt), orDash(a.CompletedAt))
+			if a.ApprovedBy != "" {
+				line += ", approved by " + a.ApprovedBy
+			}
+			fmt.Fprintln(w, line)
+			for _, it := range a.Iterations {
+				fmt.Fprintf(w, "%s\t  iterated\t%s %s\n", indent, it.Timestamp, it.Feedback)
+			}
+		}
+		for _, b := range s.Parallel {
+			print(b, indent+"  ")
+		}
+	}
+	for _, s := range result.Steps {
+		print(s, "")
+	}
+	w.Flush()
+}
+
+type stepHistoryLine struct {
+	Name       string            `json:"name"`
+	Status     string            `json:"status"`
+	Iterations int               `json:"iterations"`
+	Attempts   []StepAttempt     `json:"attempts"`
+	Parallel   []stepHistoryLine `json:"parallel"`
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func printList(output string) {
+	var result struct {
+		Workflows []struct {
+			ID          string `json:"workflow_id"`
+			Task        string `json:"task"`
+			CurrentStep string `json:"current_step"`
+			Progress    string `json:"progress"`
+			Active      bool   `json:"active"`
+			Archived    bool   `json:"archived"`
+			Waiting     bool   `json:"waiting_for_approval"`
+		} `json:"workflows"`
+	}
+	json.Unmarshal([]byte(output), &result)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "  ID\tSTEP\tPROGRESS\tTASK")
+	for _, wf := range result.Workflows {
+		marker := " "
+		if wf.Active {
+			marker = "*"
+		}
+		step := wf.CurrentStep
+		if wf.Waiting {
+			step += " (awaiting approval)"
+		}
+		if wf.Archived {
+			step += " (archived)"
+		}
+		fmt.Fprintf(w, "%s %s\t%s\t%s\t%s\n", marker, wf.ID, step, wf.Progress, wf.Task)
+	}
+	w.Flush()
+}
+
+func showArtifact(st *WorkflowState, artifactType string, revision int, asJSON bool) int {
+	if _, ok := st.Artifacts[artifactType]; !ok {
+		types := []string{}
+		for t := range st.Artifacts {
+			types = append(types, t)
+		}
+		fmt.Fprintf(os.Stderr, "workflow-mcp: workflow %s has no %s artifact (has: %s)\n", st.ID, artifactType, strings.Join(types, ", "))
+		return 1
+	}
+	artifact, err := findRevision(st, artifactType, revision)
+	if err != nil {
+		return cliError(err)
+	}
+	if text, isText := artifact.Content.(string); isText && !asJSON {
+		fmt.Println(text)
+		return 0
+	}
+	data, _ := json.MarshalIndent(artifact.Content, "", "  ")
+	fmt.Println(string(data))
+	return 0
+}
+
+func cmdValidate(args []string) int {
+	path := configFile
+	if len(args) > 0 {
+		path = args[0]
+	}
+	cfg, report, err := readConfig(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: %v\n", err)
+		return 1
+	}
+	for _, issue := range report.Errors {
+		fmt.Printf("%s: error: %s\n", issueLocation(issue), issueText(issue))
+	}
+	for _, issue := range report.Warnings {
+		fmt.Printf("%s: warning: %s\n", issueLocation(issue), issueText(issue))
+	}
+	if len(report.Errors) > 0 {
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", path, len(report.Errors), len(report.Warnings))
+		return 1
+	}
+	fmt.Printf("%s: ok (%s, %d steps, %d warning(s))\n", path, cfg.Name, len(cfg.Steps), len(report.Warnings))
+	return 0
+}
+
+func cmdApprovalToken(args []string) int {
+	loadConfig()
+	secret := approvalSecret()
+	if secret == "" {
+		fmt.Fprintln(os.Stderr, "workflow-mcp: approval_secret is not set in workflow.yaml (or its variable is empty)")
+		return 1
+	}
+	id := ""
+	if len(args) > 0 {
+		id = args[0]
+	}
+	st, err := resolveWorkflow(id)
+	if err == nil {
+		st, err = activeLeaf(st)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: %v\n", err)
+		return 1
+	}
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 || st.Steps[idx].Status != "awaiting_approval" || st.Steps[idx].Approval == nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: workflow %s has no step awaiting human approval\n", st.ID)
+		return 1
+	}
+	fmt.Println(approvalToken(secret, st.ID, st.CurrentStep, st.Steps[idx].Approval.ID))
+	return 0
+}
+
+// issueLocation and issueText split an issue compiler-style, as
+// file:line and path: message.
+func issueLocation(i ConfigIssue) string {
+	if i.Line > 0 {
+		return fmt.Sprintf("%s:%d", i.File, i.Line)
+	}
+	return i.File
+}
+
+func issueText(i ConfigIssue) string {
+	if i.Path != "" {
+		return i.Path + ": " + i.Message
+	}
+	return i.Message
+}
+
+// cmdGenSkills writes the MCP prompts for ./workflow.yaml to a directory as
+// command files.
+func cmdGenSkills(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "workflow-mcp gen-skills: expected a directory, e.g. .claude/commands\n")
+		return 2
+	}
+	loadConfig()
+	if len(configIssues.Errors) > 0 {
+		for _, issue := range configIssues.Errors {
+			fmt.Fprintf(os.Stderr, "%s: error: %s\n", issueLocation(issue), issueText(issue))
+		}
+		return 1
+	}
+	if configSource == "default" {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: no %s, using the built-in workflow\n", configFile)
+	}
+
+	written, err := genSkills(config, args[0])
+	for _, path := range written {
+		fmt.Println(path)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp gen-skills: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+// runCLI runs a command as main does and returns its exit status and what
+// it printed to stdout and stderr.
+func runCLI(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	savedOut, savedErr := os.Stdout, os.Stderr
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout, os.Stderr = outW, errW
+	stdout, stderr := make(chan string), make(chan string)
+	go func() { data, _ := io.ReadAll(outR); stdout <- string(data) }()
+	go func() { data, _ := io.ReadAll(errR); stderr <- string(data) }()
+
+	code := runCommand(args)
+
+	os.Stdout, os.Stderr = savedOut, savedErr
+	outW.Close()
+	errW.Close()
+	return code, <-stdout, <-stderr
+}
+
+func TestCLICommands(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string     // plan's approval_mode
+		setup    []toolCall // after workflow_init
+		args     []string
+		wantCode int
+		wantOut  string // substring of stdout
+		wantErr  string // substring of stderr
+		want     string // step statuses afterwards, see stepStatuses
+	}{
+		{
+			name:    "status",
+			mode:    approvalModeAgent,
+			args:    []string{"status"},
+			wantOut: "Step:     plan",
+			want:    "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:    "list",
+			mode:    approvalModeAgent,
+			args:    []string{"list"},
+			wantOut: "plan  0%",
+			want:    "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:    "approve",
+			mode:    approvalModeAgent,
+			setup:   []toolCall{{tool: "workflow_next"}},
+			args:    []string{"approve"},
+			wantOut: "approved plan -> execute (approved via cli)",
+			want:    "plan=completed execute=in_progress verify=pending",
+		},
+		{
+			name:     "approve a step that isn't waiting",
+			mode:     approvalModeAgent,
+			args:     []string{"approve"},
+			wantCode: 1,
+			wantErr:  "step is not awaiting approval",
+			want:     "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:     "approve a human_token step without a code",
+			mode:     approvalModeHumanToken,
+			setup:    []toolCall{{tool: "workflow_next"}},
+			args:     []string{"approve"},
+			wantCode: 1,
+			wantErr:  "no approval code given",
+			want:     "plan=awaiting_approval execute=pending verify=pending",
+		},
+		{
+			name:    "iterate",
+			mode:    approvalModeAgent,
+			setup:   []toolCall{{tool: "workflow_next"}},
+			args:    []string{"iterate", "--feedback", "smaller steps"},
+			wantOut: "iteration plan (smaller steps)",
+			want:    "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:     "iterate without feedback",
+			mode:     approvalModeAgent,
+			setup:    []toolCall{{tool: "workflow_next"}},
+			args:     []string{"iterate"},
+			wantCode: 2,
+			wantErr:  "--feedback is required",
+			want:     "plan=awaiting_approval execute=pending verify=pending",
+		},
+		{
+			name:    "block",
+			mode:    approvalModeAgent,
+			args:    []string{"block", "--reason", "waiting on access"},
+			wantOut: "blocked plan (waiting on access)",
+			want:    "plan=blocked execute=pending verify=pending",
+		},
+		{
+			name: "unblock",
+			mode: approvalModeAgent,
+			setup: []toolCall{
+				{tool: "workflow_blocked", args: `{"reason":"waiting on access"}`},
+			},
+			args:    []string{"unblock", "--note", "got it"},
+			wantOut: "unblocked plan",
+			want:    "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name: "reject back to an earlier step",
+			mode: approvalModeAgent,
+			setup: []toolCall{
+				{tool: "workflow_next"},
+				{tool: "workflow_approve"},
+			},
+			args:    []string{"reject", "--to", "plan", "--reason", "wrong approach"},
+			wantOut: "rolled_back execute -> plan (wrong approach)",
+			want:    "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:    "reset past an agent gate",
+			mode:    approvalModeAgent,
+			args:    []string{"reset", "--to", "verify"},
+			wantOut: "reset plan -> verify",
+			want:    "plan=skipped execute=skipped verify=in_progress",
+		},
+		{
+			name:     "reset past a human_token gate",
+			mode:     approvalModeHumanToken,
+			args:     []string{"reset", "--to", "verify"},
+			wantCode: 1,
+			wantErr:  "can't reset past step plan: it needs approval from a human",
+			want:     "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:     "reset past a waiting human_token gate",
+			mode:     approvalModeHumanToken,
+			setup:    []toolCall{{tool: "workflow_next"}},
+			args:     []string{"reset", "--to", "execute"},
+			wantCode: 1,
+			wantErr:  "can't reset past step plan",
+			want:     "plan=awaiting_approval execute=pending verify=pending",
+		},
+		{
+			name:     "reset without --to",
+			mode:     approvalModeAgent,
+			args:     []string{"reset"},
+			wantCode: 2,
+			wantErr:  "--to <step> is required",
+			want:     "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:     "unknown workflow",
+			mode:     approvalModeAgent,
+			args:     []string{"status", "--workflow", "wf_missing"},
+			wantCode: 1,
+			wantErr:  "workflow wf_missing not found",
+			want:     "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:     "unknown command",
+			mode:     approvalModeAgent,
+			args:     []string{"frobnicate"},
+			wantCode: 2,
+			wantErr:  `unknown command "frobnicate"`,
+			want:     "plan=in_progress execute=pending verify=pending",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer(t, strings.Replace(approvalTestConfig, "%s", tt.mode, 1))
+			runCalls(t, append([]toolCall{{tool: "workflow_init", args: `{"task":"gates"}`}}, tt.setup...))
+
+			code, stdout, stderr := runCLI(t, tt.args...)
+			if code != tt.wantCode {
+				t.Errorf("exit status %d, want %d (stderr: %s)", code, tt.wantCode, stderr)
+			}
+			if !strings.Contains(stdout, tt.wantOut) {
+				t.Errorf("stdout = %q, want it to contain %q", stdout, tt.wantOut)
+			}
+			if !strings.Contains(stderr, tt.wantErr) {
+				t.Errorf("stderr = %q, want it to contain %q", stderr, tt.wantErr)
+			}
+			if got := stepStatuses(activeState(t)); got != tt.want {
+				t.Errorf("steps = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCLIApprovalToken(t *testing.T) {
+	testServer(t, strings.Replace(approvalTestConfig, "%s", approvalModeHumanToken, 1))
+	runCalls(t, []toolCall{
+		{tool: "workflow_init", args: `{"task":"gates"}`},
+		{tool: "workflow_next"},
+	})
+
+	code, token, stderr := runCLI(t, "approval-token")
+	if code != 0 {
+		t.Fatalf("approval-token: exit status %d: %s", code, stderr)
+	}
+	code, stdout, stderr := runCLI(t, "approve", "--code", strings.TrimSpace(token))
+	if code != 0 {
+		t.Fatalf("approve --code: exit status %d: %s", code, stderr)
+	}
+	if !strings.Contains(stdout, "approved plan -> execute") {
+		t.Errorf("approve --code printed %q", stdout)
+	}
+	st := activeState(t)
+	if got := stepStatuses(st); got != "plan=completed execute=in_progress verify=pending" {
+		t.Errorf("steps = %s", got)
+	}
+	if by := st.Steps[0].Attempts[len(st.Steps[0].Attempts)-1].ApprovedBy; by != "token" {
+		t.Errorf("approved_by = %s, want token", by)
+	}
+}
+
+func TestCLIResetEndsSkippedAttempts(t *testing.T) {
+	testServer(t, strings.Replace(approvalTestConfig, "%s", approvalModeAgent, 1))
+	runCalls(t, []toolCall{{tool: "workflow_init", args: `{"task":"gates"}`}})
+
+	if code, _, stderr := runCLI(t, "reset", "--to", "verify"); code != 0 {
+		t.Fatalf("reset: exit status %d: %s", code, stderr)
+	}
+	st := activeState(t)
+	for _, step := range st.Steps[:2] {
+		for _, a := range step.Attempts {
+			if a.CompletedAt == "" {
+				t.Errorf("step %s (%s) still has an open attempt", step.Name, step.Status)
+			}
+		}
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// configSchema is the JSON Schema for workflow.yaml, for editors and the
+// `workflow-mcp schema` command.
+//
+//go:embed workflow.schema.json
+var configSchema []byte
+
+// ConfigIssue is an error or warning found in a workflow config file.
+type ConfigIssue struct {
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Path    string `json:"path,omitempty"` // e.g. steps[2].next[0].goto
+	Message string `json:"message"`
+}
+
+func (i ConfigIssue) String() string {
+	var sb strings.Builder
+	if i.File != "" {
+		sb.WriteString(i.File)
+		if i.Line > 0 {
+			fmt.Fprintf(&sb, ":%d", i.Line)
+		}
+		sb.WriteString(": ")
+	}
+	if i.Path != "" {
+		sb.WriteString(i.Path + ": ")
+	}
+	sb.WriteString(i.Message)
+	return sb.String()
+}
+
+// configReport collects the issues found while loading a config. Errors
+// make the config unusable; warnings are likely mistakes.
+type configReport struct {
+	Errors   []ConfigIssue `json:"errors"`
+	Warnings []ConfigIssue `json:"warnings"`
+}
+
+func (r *configReport) merge(other configReport) {
+	r.Errors = append(r.Errors, other.Errors...)
+	r.Warnings = append(r.Warnings, other.Warnings...)
+}
+
+// Where the loaded config came from and what was wrong with it, for
+// workflow_config and workflow_init.
+var (
+	configSource = "default"
+	configIssues configReport
+)
+
+// knownEventTypes are the WorkflowEvent types a webhook can subscribe to.
+var knownEventTypes = []string{
+	"init", "switched", "archived", "step_update", "blocked", "awaiting_approval",
+	"step_complete", "approved", "iteration", "artifact_set", "pr_set", "pr_check",
+	"migrated", "approval_code", "approval_rejected", "unblocked", "reset", "rolled_back", "criterion_updated",
+	"checks_run", "test_report", "step_overdue", "workflow_stale", "review_escalated",
+}
+
+// readConfig strictly decodes and validates a workflow config file. Parse
+// and validation problems are returned in the report; the error is only
+// for a file that can't be read.
+func readConfig(path string) (*WorkflowConfig, configReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, configReport{}, err
+	}
+	v := &configValidator{file: path, baseDir: filepath.Dir(path), visited: map[string]bool{}}
+	if abs, err := filepath.Abs(path); err == nil {
+		v.visited[abs] = true
+	}
+	cfg := v.decode(data)
+	if cfg != nil {
+		v.validateWorkflow(cfg, cfg, v.root, "")
+	}
+	return cfg, v.report, nil
+}
+
+type configValidator struct {
+	file    string
+	baseDir string
+	root    *yaml.Node
+	report  configReport
+	visited map[string]bool // files already checked, so `uses:` cycles terminate
+}
+
+var yamlLineRE = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// decode parses data twice: into a node tree for line numbers, and strictly
+// into a WorkflowConfig so misspelt keys are errors rather than ignored.
+func (v *configValidator) decode(data []byte) *WorkflowConfig {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		v.yamlError(err)
+		return nil
+	}
+	if len(root.Content) == 0 {
+		v.errorf(nil, "", "file is empty")
+		return nil
+	}
+	v.root = root.Content[0]
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	var cfg WorkflowConfig
+	if err := dec.Decode(&cfg); err != nil && !errors.Is(err, io.EOF) {
+		v.yamlError(err)
+		return nil
+	}
+	return &cfg
+}
+
+// yamlError turns a yaml.v3 error into issues, keeping its line numbers.
+func (v *configValidator) yamlError(err error) {
+	msgs := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	}
+	for _, msg := range msgs {
+		issue := ConfigIssue{File: v.file, Message: msg}
+		if m := yamlLineRE.FindStringSubmatch(msg); m != nil {
+			issue.Line, _ = strconv.Atoi(m[1])
+			issue.Message = strings.ReplaceAll(m[2], "main.", "")
+		}
+		v.report.Errors = append(v.report.Errors, issue)
+	}
+}
+
+func (v *configValidator) errorf(n *yaml.Node, path, format string, args ...any) {
+	v.report.Errors = append(v.report.Errors, ConfigIssue{File: v.file, Line: nodeLine(n), Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+func (v *configValidator) warnf(n *yaml.Node, path, format string, args ...any) {
+	v.report.Warnings = append(v.report.Warnings, ConfigIssue{File: v.file, Line: nodeLine(n), Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// validateWorkflow checks cfg, whose YAML is node. root is the file's top
+// level config, which holds the named workflows `uses:` can refer to.
+func (v *configValidator) validateWorkflow(cfg, root *WorkflowConfig, node *yaml.Node, prefix string) {
+	stepsNode := yamlField(node, "steps")
+	if len(cfg.Steps) == 0 {
+		v.errorf(node, prefix+"steps", "workflow has no steps")
+	}
+
+	// Step and branch names share a namespace: workflow_step takes either
+	seen := map[string]int{}
+	checkName := func(name string, n *yaml.Node, path string) {
+		switch {
+		case name == "":
+			v.errorf(n, path, "step has no name")
+		case name == doneStep:
+			v.errorf(yamlField(n, "name"), path+".name", "%q is reserved for the end of the workflow", doneStep)
+		case seen[name] != 0:
+			v.errorf(yamlField(n, "name"), path+".name", "duplicate step name %q (first defined on line %d)", name, seen[name])
+		default:
+			seen[name] = max(nodeLine(yamlField(n, "name")), 1)
+		}
+	}
+	topLevel := map[string]bool{}
+	for i, step := range cfg.Steps {
+		n := yamlItem(stepsNode, i)
+		path := fmt.Sprintf("%ssteps[%d]", prefix, i)
+		checkName(step.Name, n, path)
+		topLevel[step.Name] = true
+		for j, branch := range step.Parallel {
+			checkName(branch.Name, yamlItem(yamlField(n, "parallel"), j), fmt.Sprintf("%s.parallel[%d]", path, j))
+		}
+	}
+
+	for i, step := range cfg.Steps {
+		v.validateStep(step, root, yamlItem(stepsNode, i), fmt.Sprintf("%ssteps[%d]", prefix, i), topLevel)
+	}
+
+	for i, hook := range cfg.Webhooks {
+		n := yamlItem(yamlField(node, "webhooks"), i)
+		path := fmt.Sprintf("%swebhooks[%d]", prefix, i)
+		if hook.URL == "" {
+			v.errorf(n, path, "webhook has no url")
+		} else if !strings.HasPrefix(hook.URL, "http://") && !strings.HasPrefix(hook.URL, "https://") {
+			v.errorf(yamlField(n, "url"), path+".url", "url must be http:// or https://")
+		}
+		for j, ev := range hook.Events {
+			if ev != "*" && !containsString(knownEventTypes, ev) {
+				v.warnf(yamlItem(yamlField(n, "events"), j), fmt.Sprintf("%s.events[%d]", path, j), "unknown event type %q", ev)
+			}
+		}
+		if hook.Secret != "" && os.ExpandEnv(hook.Secret) == "" {
+			v.warnf(yamlField(n, "secret"), path+".secret", "%s expands to an empty string; deliveries will be unsigned", hook.Secret)
+		}
+	}
+
+	if _, err := parseDuration(cfg.StaleAfter); err != nil {
+		v.errorf(yamlField(node, "stale_after"), prefix+"stale_after", "%v", err)
+	}
+
+	if cfg.ApprovalSecret != "" && os.ExpandEnv(cfg.ApprovalSecret) == "" {
+		v.warnf(yamlField(node, "approval_secret"), prefix+"approval_secret", "%s expands to an empty string; approval tokens will be rejected", cfg.ApprovalSecret)
+	}
+
+	names := make([]string, 0, len(cfg.Workflows))
+	for name := range cfg.Workflows {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sub := cfg.Workflows[name]
+		n := yamlField(yamlField(node, "workflows"), name)
+		if sub == nil {
+			v.errorf(n, prefix+"workflows."+name, "workflow is empty")
+			continue
+		}
+		v.validateWorkflow(sub, root, n, prefix+"workflows."+name+".")
+	}
+}
+
+func (v *configValidator) validateStep(step StepConfig, root *WorkflowConfig, n *yaml.Node, path string, targets map[string]bool) {
+	checkTarget := func(target string, tn *yaml.Node, tpath string) {
+		if target != "" && target != doneStep && !targets[target] {
+			v.errorf(tn, tpath, "transition target %q is not a step", target)
+		}
+	}
+	checkTarget(step.OnSuccess, yamlField(n, "on_success"), path+".on_success")
+	checkTarget(step.OnFailure, yamlField(n, "on_failure"), path+".on_failure")
+	for i, t := range step.Next {
+		tn := yamlItem(yamlField(n, "next"), i)
+		tpath := fmt.Sprintf("%s.next[%d]", path, i)
+		if t.Goto == "" {
+			v.errorf(tn, tpath, "transition has no goto")
+		}
+		checkTarget(t.Goto, yamlField(tn, "goto"), tpath+".goto")
+		if t.When != "" {
+			if _, err := parseExpr(t.When); err != nil {
+				v.errorf(yamlField(tn, "when"), tpath+".when", "invalid condition: %v", err)
+			}
+		}
+	}
+
+	if step.ApprovalPrompt != "" && !step.NeedsApproval {
+		v.warnf(yamlField(n, "approval_prompt"), path+".approval_prompt", "has no effect without needs_approval: true")
+	}
+	switch step.ApprovalMode {
+	case "", approvalModeAgent:
+	case approvalModeHumanToken:
+		if !step.NeedsApproval {
+			v.warnf(yamlField(n, "approval_mode"), path+".approval_mode", "has no effect without needs_approval: true")
+		}
+		if root != nil && root.ApprovalSecret == "" && len(approvalCodeHooks(root.Webhooks)) == 0 {
+			v.errorf(yamlField(n, "approval_mode"), path+".approval_mode", "no webhook lists approval_code in its events and approval_secret is not set, so nobody could get an approval code or token")
+		}
+	default:
+		v.errorf(yamlField(n, "approval_mode"), path+".approval_mode", "must be %q or %q", approvalModeAgent, approvalModeHumanToken)
+	}
+	for i, name := range step.Tools {
+		if !stepTools[name] {
+			tn := yamlItem(yamlField(n, "tools"), i)
+			tpath := fmt.Sprintf("%s.tools[%d]", path, i)
+			if findTool(name) != nil {
+				v.warnf(tn, tpath, "%s is always available; tools: only lists step-level tools", name)
+			} else {
+				v.errorf(tn, tpath, "unknown tool %q", name)
+			}
+		}
+	}
+	v.validateLimits(step, n, path)
+	if step.Instructions == "" && step.Uses == "" && len(step.Parallel) == 0 {
+		v.warnf(n, path, "step %q has no instructions", step.Name)
+	}
+
+	if step.Uses != "" {
+		if len(step.Parallel) > 0 {
+			v.errorf(yamlField(n, "uses"), path+".uses", "a step can't have both uses and parallel")
+		}
+		v.validateUses(step.Uses, root, yamlField(n, "uses"), path+".uses")
+	}
+
+	if step.Quorum != 0 && len(step.Parallel) == 0 {
+		v.errorf(yamlField(n, "quorum"), path+".quorum", "quorum only applies to a step with parallel branches")
+	} else if step.Quorum != 0 && (step.Quorum < 1 || step.Quorum > len(step.Parallel)) {
+		v.errorf(yamlField(n, "quorum"), path+".quorum", "quorum must be between 1 and the number of parallel branches (%d)", len(step.Parallel))
+	}
+	for i, branch := range step.Parallel {
+		bn := yamlItem(yamlField(n, "parallel"), i)
+		bpath := fmt.Sprintf("%s.parallel[%d]", path, i)
+		v.validateLimits(branch, bn, bpath)
+		for _, f := range []struct {
+			key string
+			set bool
+		}{
+			{"parallel", len(branch.Parallel) > 0},
+			{"uses", branch.Uses != ""},
+			{"next", len(branch.Next) > 0},
+			{"on_success", branch.OnSuccess != ""},
+			{"on_failure", branch.OnFailure != ""},
+			{"needs_approval", branch.NeedsApproval},
+			{"quorum", branch.Quorum != 0},
+			{"approval_mode", branch.ApprovalMode != ""},
+		} {
+			if f.set {
+				v.errorf(yamlField(bn, f.key), bpath+"."+f.key, "not supported on a parallel branch; set it on the group")
+			}
+		}
+	}
+}
+
+// validateLimits checks a step's or branch's checks, time limits and
+// review settings.
+func (v *configValidator) validateLimits(step StepConfig, n *yaml.Node, path string) {
+	for i, c := range step.Checks {
+		cn := yamlItem(yamlField(n, "checks"), i)
+		cpath := fmt.Sprintf("%s.checks[%d]", path, i)
+		if strings.TrimSpace(c.Command) == "" {
+			v.errorf(cn, cpath, "check has no command")
+		}
+		if _, err := checkTimeout(c); err != nil {
+			v.errorf(yamlField(cn, "timeout"), cpath+".timeout", "%v", err)
+		}
+	}
+	warnAfter, err := parseDuration(step.WarnAfter)
+	if err != nil {
+		v.errorf(yamlField(n, "warn_after"), path+".warn_after", "%v", err)
+	}
+	timeout, err := parseDuration(step.Timeout)
+	if err != nil {
+		v.errorf(yamlField(n, "timeout"), path+".timeout", "%v", err)
+	}
+	if warnAfter > 0 && timeout > 0 && warnAfter >= timeout {
+		v.warnf(yamlField(n, "warn_after"), path+".warn_after", "warn_after %s is not before timeout %s; only the timeout will be reported", step.WarnAfter, step.Timeout)
+	}
+	switch {
+	case step.OnTimeout != "" && step.OnTimeout != onTimeoutBlock:
+		v.errorf(yamlField(n, "on_timeout"), path+".on_timeout", "must be %q", onTimeoutBlock)
+	case step.OnTimeout != "" && step.Timeout == "":
+		v.warnf(yamlField(n, "on_timeout"), path+".on_timeout", "has no effect without timeout")
+	}
+
+	if step.Review == nil {
+		return
+	}
+	rn := yamlField(n, "review")
+	for _, f := range []struct{ key, value string }{
+		{"quiet_period", step.Review.QuietPeriod},
+		{"poll_interval", step.Review.PollInterval},
+		{"max_wait", step.Review.MaxWait},
+	} {
+		if _, err := parseDuration(f.value); err != nil {
+			v.errorf(yamlField(rn, f.key), path+".review."+f.key, "%v", err)
+		}
+	}
+	limits, err := parseReview(step.Review)
+	if err != nil {
+		return
+	}
+	if limits.pollInterval > limits.quietPeriod {
+		v.warnf(yamlField(rn, "poll_interval"), path+".review.poll_interval", "poll_interval %s is longer than the quiet period %s", limits.pollInterval, limits.quietPeriod)
+	}
+	if limits.maxWait > 0 && limits.maxWait <= limits.quietPeriod {
+		v.warnf(yamlField(rn, "max_wait"), path+".review.max_wait", "max_wait %s is not longer than the quiet period %s; the review will always escalate", limits.maxWait, limits.quietPeriod)
+	}
+}
+
+// validateUses checks that a `uses:` reference resolves the way
+// loadSubWorkflow will resolve it, and validates referenced files.
+func (v *configValidator) validateUses(uses string, root *WorkflowConfig, n *yaml.Node, path string) {
+	file := ""
+	switch {
+	case strings.HasSuffix(uses, ".yaml") || strings.HasSuffix(uses, ".yml"):
+		file = uses
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(v.baseDir, file)
+		}
+	case root.Workflows[uses] != nil:
+		return
+	default:
+		file = filepath.Join(v.baseDir, "workflows", uses+".yaml")
+	}
+
+	abs, _ := filepath.Abs(file)
+	if v.visited[abs] {
+		return
+	}
+	v.visited[abs] = true
+	sub := &configValidator{file: file, baseDir: v.baseDir, visited: v.visited}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		v.errorf(n, path, "workflow %q not found (no entry under workflows: and %s: %v)", uses, file, errors.Unwrap(err))
+		return
+	}
+	if cfg := sub.decode(data); cfg != nil {
+		sub.validateWorkflow(cfg, root, sub.root, "")
+	}
+	v.report.merge(sub.report)
+}
+
+// yamlField returns the value node for key in mapping node n, or nil.
+func yamlField(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return n.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// yamlItem returns element i of sequence node n, or nil.
+func yamlItem(n *yaml.Node, i int) *yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode || i >= len(n.Content) {
+		return nil
+	}
+	return n.Content[i]
+}
+
+func nodeLine(n *yaml.Node) int {
+	if n == nil {
+		return 0
+	}
+	return n.Line
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// workflowConfig reports the loaded config and anything wrong with it.
+func workflowConfig() (string, error) {
+	result := map[string]any{
+		"config_file": configFile,
+		"source":      configSource,
+		"valid":       len(configIssues.Errors) == 0,
+		"errors":      issueStrings(configIssues.Errors),
+		"warnings":    issueStrings(configIssues.Warnings),
+		"workflow":    config,
+	}
+	if configSource == "default" && len(configIssues.Errors) == 0 {
+		result["message"] = "No workflow.yaml found; using the built-in default workflow"
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+func issueStrings(issues []ConfigIssue) []string {
+	out := []string{}
+	for _, issue := range issues {
+		out = append(out, issue.String())
+	}
+	return out
+}
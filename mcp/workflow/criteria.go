@@ -0,0 +1,405 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Verification criteria. The criteria artifact holds a list of Criterion
+// objects. workflow_set_criteria still takes strings: markdown checkboxes
+// such as "- [ ] npm test passes" are parsed, and criteria stored as strings
+// by earlier versions are read the same way ("- [x]" counts as passed there).
+// workflow_update_criterion records each one's result (for criteria with a
+// check, only workflow_run_checks does), and a step with
+// requires_criteria_pass can't complete successfully until every criterion
+// has passed or been waived.
+
+const (
+	criterionPending = "pending"
+	criterionPass    = "pass"
+	criterionFail    = "fail"
+	criterionWaived  = "waived"
+)
+
+var criterionStatuses = []string{criterionPending, criterionPass, criterionFail, criterionWaived}
+
+// Criterion is one verification criterion.
+type Criterion struct {
+	ID        string `json:"id"`
+	Text      string `json:"text"`
+	Status    string `json:"status"`
+	Evidence  string `json:"evidence,omitempty"` // test output, a link, or why it was waived
+	UpdatedAt string `json:"updated_at,omitempty"`
+	Check     *Check `json:"check,omitempty"` // run by workflow_run_checks
+}
+
+var (
+	checkboxPattern   = regexp.MustCompile(`^\s*(?:[-*+]|\d+[.)])?\s*\[([ xX])\]\s*`)
+	listMarkerPattern = regexp.MustCompile(`^\s*(?:[-*+]|\d+[.)])\s+`)
+)
+
+// parseCriterion reads a criterion from its string form.
+func parseCriterion(s string) Criterion {
+	c := Criterion{Status: criterionPending}
+	if m := checkboxPattern.FindStringSubmatch(s); m != nil {
+		s = s[len(m[0]):]
+		if m[1] != " " {
+			c.Status = criterionPass
+		}
+	} else if m := listMarkerPattern.FindString(s); m != "" {
+		s = s[len(m):]
+	}
+	c.Text = strings.TrimSpace(s)
+	return c
+}
+
+// parseCriteria reads criteria content in any form it has been stored in:
+// a list of Criterion objects, a list of strings, or markdown text with one
+// list item per criterion. IDs are not assigned. ok is false for content
+// that isn't criteria.
+func parseCriteria(content any) ([]Criterion, bool) {
+	var items []any
+	switch c := content.(type) {
+	case []Criterion:
+		return c, true
+	case []string:
+		for _, s := range c {
+			items = append(items, s)
+		}
+	case []any:
+		items = c
+	case string:
+		for _, line := range strings.Split(c, "\n") {
+			if checkboxPattern.MatchString(line) || listMarkerPattern.MatchString(line) {
+				items = append(items, line)
+			}
+		}
+	default:
+		return nil, false
+	}
+
+	criteria := []Criterion{}
+	for _, item := range items {
+		switch v := item.(type) {
+		case string:
+			if c := parseCriterion(v); c.Text != "" {
+				criteria = append(criteria, c)
+			}
+		case map[string]any:
+			var c Criterion
+			data, _ := json.Marshal(v)
+			if json.Unmarshal(data, &c) != nil || c.Text == "" {
+				return nil, false
+			}
+			if !containsString(criterionStatuses, c.Status) {
+				c.Status = criterionPending
+			}
+			criteria = append(criteria, c)
+		default:
+			return nil, false
+		}
+	}
+	return criteria, true
+}
+
+// assignCriterionIDs gives criteria without an ID the next free one of
+// c1, c2, ..., skipping those in reserved.
+func assignCriterionIDs(criteria []Criterion, reserved map[string]bool) {
+	used := map[string]bool{}
+	for id := range reserved {
+		used[id] = true
+	}
+	for _, c := range criteria {
+		used[c.ID] = true
+	}
+	n := 0
+	for i := range criteria {
+		for criteria[i].ID == "" {
+			n++
+			if id := fmt.Sprintf("c%d", n); !used[id] {
+				criteria[i].ID = id
+				used[id] = true
+			}
+		}
+	}
+}
+
+// loadCriteria returns st's criteria, or nil if it has none.
+func loadCriteria(st *WorkflowState) []Criterion {
+	artifact, ok := st.Artifacts["criteria"]
+	if !ok {
+		return nil
+	}
+	criteria, _ := parseCriteria(artifact.Content)
+	assignCriterionIDs(criteria, nil)
+	return criteria
+}
+
+// normalizeCriteria turns content being stored as the criteria artifact
+// into Criterion objects. New criteria start out pending, whatever status
+// they were given ("- [x]" included): results only come from
+// workflow_update_criterion and workflow_run_checks. A criterion whose text
+// is unchanged keeps its ID, and its result unless the criteria went stale
+// in a rollback; new ones get fresh IDs. A criterion given a different
+// check starts over as pending. Content that isn't criteria is stored as
+// it is.
+func normalizeCriteria(st *WorkflowState, content any) any {
+	criteria, ok := parseCriteria(content)
+	if !ok {
+		return content
+	}
+	for i := range criteria {
+		criteria[i].Status = criterionPending
+		criteria[i].Evidence = ""
+		criteria[i].UpdatedAt = ""
+	}
+	previous := loadCriteria(st)
+	stale := st.Artifacts["criteria"].Stale
+	reserved := map[string]bool{}
+	for _, p := range previous {
+		reserved[p.ID] = true
+	}
+	for i, c := range criteria {
+		for _, p := range previous {
+			if p.Text == c.Text && (c.ID == "" || c.ID == p.ID) {
+				if stale || !sameCheck(p.Check, c.Check) {
+					criteria[i].ID = p.ID
+				} else {
+					criteria[i] = p
+				}
+				break
+			}
+		}
+	}
+	assignCriterionIDs(criteria, reserved)
+	return criteria
+}
+
+func sameCheck(a, b *Check) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// criteriaOwner returns the workflow whose criteria apply to st: st itself
+// or the nearest enclosing workflow with criteria, so a sub-workflow can
+// verify criteria set by its parent.
+func criteriaOwner(st *WorkflowState) *WorkflowState {
+	owner := st
+	for depth := 0; depth <= maxSubWorkflowDepth; depth++ {
+		if _, ok := owner.Artifacts["criteria"]; ok || owner.ParentID == "" {
+			break
+		}
+		parent, err := store.Load(owner.ParentID)
+		if err != nil {
+			break
+		}
+		owner = parent
+	}
+	if _, ok := owner.Artifacts["criteria"]; !ok {
+		return st
+	}
+	return owner
+}
+
+// criteriaSummary counts criteria by status.
+func criteriaSummary(criteria []Criterion) map[string]int {
+	summary := map[string]int{"total": len(criteria)}
+	for _, s := range criterionStatuses {
+		summary[s] = 0
+	}
+	for _, c := range criteria {
+		summary[c.Status]++
+	}
+	return summary
+}
+
+// checkCriteriaGate refuses to let step complete while any criterion is
+// pending or failing, if the step has requires_criteria_pass.
+func checkCriteriaGate(st *WorkflowState, step *WorkflowStep) error {
+	if !step.RequiresCriteriaPass {
+		return nil
+	}
+	owner := criteriaOwner(st)
+	criteria := loadCriteria(owner)
+	if len(criteria) == 0 {
+		return (&ToolError{
+			Message: fmt.Sprintf("step %s requires verification criteria to pass, but none are set", step.Name),
+			Hint:    "set them with workflow_set_criteria, then record results with workflow_update_criterion",
+		}).With("step", step.Name)
+	}
+	var open []Criterion
+	for _, c := range criteria {
+		if c.Status != criterionPass && c.Status != criterionWaived {
+			open = append(open, c)
+		}
+	}
+	if len(open) == 0 {
+		return nil
+	}
+	hint := "record results with workflow_update_criterion (waive with evidence saying why)"
+	if back := failureGoesBack(st, step.Name); back != "" {
+		hint += fmt.Sprintf(", or call workflow_next(outcome: \"failure\") to go back to %s and fix them", back)
+	}
+	return (&ToolError{
+		Message: fmt.Sprintf("step %s requires all criteria to pass: %d of %d are pending or failing", step.Name, len(open), len(criteria)),
+		Hint:    hint,
+	}).With("step", step.Name).With("criteria", open)
+}
+
+// checkOutcomeGate runs checkCriteriaGate for step idx of st completing with
+// outcome. A failure gets past the gate only when it sends the workflow back
+// to an earlier step to fix things; carrying on forward needs the criteria
+// met as much as a success does.
+func checkOutcomeGate(st *WorkflowState, idx int, outcome string) error {
+	step := &st.Steps[idx]
+	if outcome != outcomeFailure || !step.RequiresCriteriaPass {
+		return checkCriteriaGate(st, step)
+	}
+	next, _, err := resolveNextStep(st, idx, outcome)
+	if err != nil {
+		return err
+	}
+	if next < idx {
+		return nil
+	}
+	if err := checkCriteriaGate(st, step); err != nil {
+		target := doneStep
+		if next < len(st.Steps) {
+			target = st.Steps[next].Name
+		}
+		return (&ToolError{
+			Message: fmt.Sprintf("step %s can't fail on to %s while its criteria are pending or failing; a failure has to go back to an earlier step", step.Name, target),
+			Hint:    "record results with workflow_update_criterion, or give the step an on_failure (or next rule) pointing back, e.g. on_failure: execute",
+		}).With("step", step.Name).With("target", target)
+	}
+	return nil
+}
+
+// failureGoesBack returns the step before step that a failure outcome would
+// send st back to, or "" if it wouldn't go back.
+func failureGoesBack(st *WorkflowState, step string) string {
+	idx := stepIndex(st, step)
+	if idx < 0 {
+		return ""
+	}
+	next, _, err := resolveNextStep(st, idx, outcomeFailure)
+	if err != nil || next >= idx {
+		return ""
+	}
+	return st.Steps[next].Name
+}
+
+// checkCriteriaGates runs checkCriteriaGate on the steps a move from step
+// index from to step index to leaves behind without completing them.
+func checkCriteriaGates(st *WorkflowState, from, to int) error {
+	for i := max(from, 0); i < to; i++ {
+		if step := &st.Steps[i]; step.Status != "completed" && step.Status != "skipped" {
+			if err := checkCriteriaGate(st, step); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// criterionCheck returns the check that verifies criteria[idx]: its own, or
+// a check on a step of one of workflows that names it, or nil.
+func criterionCheck(criteria []Criterion, idx int, workflows ...*WorkflowState) *Check {
+	if criteria[idx].Check != nil {
+		return criteria[idx].Check
+	}
+	for _, w := range workflows {
+		for i := range w.Steps {
+			steps := append([]WorkflowStep{w.Steps[i]}, w.Steps[i].Parallel...)
+			for _, step := range steps {
+				for j, c := range step.Checks {
+					if c.Criterion != "" && findCriterion(criteria, c.Criterion) == idx {
+						return &step.Checks[j]
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// storeCriteria saves updated results into st's criteria artifact. A result
+// is not a new revision of the criteria. The caller commits st.
+func storeCriteria(st *WorkflowState, criteria []Criterion, now string) {
+	artifact := st.Artifacts["criteria"]
+	artifact.Content = criteria
+	artifact.UpdatedAt = now
+	st.Artifacts["criteria"] = artifact
+	st.UpdatedAt = now
+}
+
+// workflowUpdateCriterion records the result of one criterion.
+func workflowUpdateCriterion(st *WorkflowState, id, status, evidence string) (string, error) {
+	owner := criteriaOwner(st)
+	criteria := loadCriteria(owner)
+	if criteria == nil {
+		return "", (&ToolError{
+			Message: "no criteria set",
+			Hint:    "set them with workflow_set_criteria first",
+		}).With("workflow_id", st.ID)
+	}
+	if status == criterionWaived && strings.TrimSpace(evidence) == "" {
+		return "", (&ToolError{
+			Message: "waiving a criterion needs evidence",
+			Hint:    "say in evidence why the criterion doesn't apply",
+		}).With("id", id)
+	}
+
+	idx := -1
+	ids := make([]string, len(criteria))
+	for i, c := range criteria {
+		ids[i] = c.ID
+		if c.ID == id {
+			idx = i
+		}
+	}
+	if idx < 0 {
+		return "", toolError("criterion %s not found", id).With("ids", ids)
+	}
+	if check := criterionCheck(criteria, idx, st, owner); check != nil {
+		return "", (&ToolError{
+			Message: fmt.Sprintf("criterion %s is verified by a check; only workflow_run_checks records its result", id),
+			Hint:    "run workflow_run_checks to record its result",
+		}).With("id", id).With("command", check.Command)
+	}
+
+	now := time.Now().UTC().Format(time.RFC3339)
+	criteria[idx].Status = status
+	criteria[idx].Evidence = evidence
+	criteria[idx].UpdatedAt = now
+
+	storeCriteria(owner, criteria, now)
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "criterion_updated",
+		WorkflowID: owner.ID,
+		Step:       st.CurrentStep,
+		Status:     status,
+		Message:    fmt.Sprintf("%s: %s", id, criteria[idx].Text),
+		Timestamp:  now,
+	}
+
+	if err := store.Commit(owner, &event); err != nil {
+		return "", err
+	}
+	artifactUpdated(owner, "criteria", false)
+
+	output, _ := json.MarshalIndent(map[string]any{
+		"updated":   true,
+		"criterion": criteria[idx],
+		"summary":   criteriaSummary(criteria),
+		"event":     event,
+	}, "", "  ")
+	return string(output), nil
+}
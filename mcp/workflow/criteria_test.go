@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+const criteriaTestConfig = `name: gated
+steps:
+  - name: criteria
+    instructions: Set criteria.
+  - name: execute
+    instructions: Do it.
+  - name: verify
+    requires_criteria_pass: true%s
+    instructions: Check it.
+  - name: pr
+    instructions: Ship it.
+`
+
+// criteriaConfig is criteriaTestConfig with verify's on_failure set to
+// onFailure, if any.
+func criteriaConfig(onFailure string) string {
+	if onFailure != "" {
+		onFailure = "\n    on_failure: " + onFailure
+	}
+	return strings.Replace(criteriaTestConfig, "%s", onFailure, 1)
+}
+
+func TestCriteriaGate(t *testing.T) {
+	tests := []struct {
+		name      string
+		onFailure string
+		calls     []toolCall
+		want      string // step statuses afterwards, see stepStatuses
+	}{
+		{
+			name:  "success with criteria open",
+			calls: []toolCall{{tool: "workflow_next", wantErr: "step verify requires all criteria to pass: 2 of 2"}},
+			want:  "criteria=completed execute=completed verify=in_progress pr=pending",
+		},
+		{
+			name: "success once criteria pass or are waived",
+			calls: []toolCall{
+				{tool: "workflow_update_criterion", args: `{"id":"c1","status":"pass","evidence":"ran it"}`},
+				{tool: "workflow_next", wantErr: "1 of 2 are pending or failing"},
+				{tool: "workflow_update_criterion", args: `{"id":"c2","status":"waived","evidence":"not relevant here"}`},
+				{tool: "workflow_next", want: map[string]any{"current_step": "pr"}},
+			},
+			want: "criteria=completed execute=completed verify=completed pr=in_progress",
+		},
+		{
+			name:  "failure without on_failure",
+			calls: []toolCall{{tool: "workflow_next", args: `{"outcome":"failure"}`, wantErr: "step verify can't fail on to pr while its criteria are pending or failing"}},
+			want:  "criteria=completed execute=completed verify=in_progress pr=pending",
+		},
+		{
+			name:      "failure on to a later step",
+			onFailure: "pr",
+			calls:     []toolCall{{tool: "workflow_next", args: `{"outcome":"failure"}`, wantErr: "can't fail on to pr"}},
+			want:      "criteria=completed execute=completed verify=in_progress pr=pending",
+		},
+		{
+			name:      "failure back to execute",
+			onFailure: "execute",
+			calls:     []toolCall{{tool: "workflow_next", args: `{"outcome":"failure"}`, want: map[string]any{"current_step": "execute"}}},
+			want:      "criteria=completed execute=in_progress verify=pending pr=pending",
+		},
+		{
+			name: "workflow_step past the gate",
+			calls: []toolCall{
+				{tool: "workflow_step", args: `{"step":"verify","status":"completed"}`, wantErr: "step verify requires all criteria to pass"},
+				{tool: "workflow_step", args: `{"step":"pr","status":"in_progress"}`, wantErr: "step verify requires all criteria to pass"},
+			},
+			want: "criteria=completed execute=completed verify=in_progress pr=pending",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer(t, criteriaConfig(tt.onFailure))
+			runCalls(t, append([]toolCall{
+				{tool: "workflow_init", args: `{"task":"gated"}`},
+				{tool: "workflow_set_criteria", args: `{"criteria":["tests pass","docs updated"]}`},
+				{tool: "workflow_next", want: map[string]any{"current_step": "execute"}},
+				{tool: "workflow_next", want: map[string]any{"current_step": "verify"}},
+			}, tt.calls...))
+			if got := stepStatuses(activeState(t)); got != tt.want {
+				t.Errorf("steps = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCriteriaGateHint(t *testing.T) {
+	for _, onFailure := range []string{"", "execute"} {
+		t.Run("on_failure="+onFailure, func(t *testing.T) {
+			testServer(t, criteriaConfig(onFailure))
+			runCalls(t, []toolCall{
+				{tool: "workflow_init", args: `{"task":"gated"}`},
+				{tool: "workflow_set_criteria", args: `{"criteria":["tests pass"]}`},
+				{tool: "workflow_next"},
+				{tool: "workflow_next"},
+			})
+
+			_, err := callTool(t, "workflow_next", "")
+			var te *ToolError
+			if !errors.As(err, &te) {
+				t.Fatalf("workflow_next error = %v, want a tool error", err)
+			}
+			suggestsFailure := strings.Contains(te.Hint, `outcome: "failure"`)
+			if suggestsFailure != (onFailure != "") {
+				t.Errorf("hint = %q, suggesting a failure outcome is %v, want %v", te.Hint, suggestsFailure, onFailure != "")
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// diffInput splits a test case's space-separated lines.
+func diffInput(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, " ")
+}
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		a, b  string // space-separated lines
+		edits int    // lines added plus lines removed in a shortest script
+	}{
+		{"both empty", "", "", 0},
+		{"from empty", "", "a b c", 3},
+		{"to empty", "a b c", "", 3},
+		{"equal", "a b c", "a b c", 0},
+		{"one changed", "a b c", "a x c", 2},
+		{"inserted", "a c", "a b c", 1},
+		{"removed", "a b c", "a c", 1},
+		{"myers paper", "A B C A B B A", "C B A B A C", 5},
+		{"nothing shared", "a b", "c d", 4},
+		{"repeated lines", "x x x", "x x", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := diffInput(tt.a), diffInput(tt.b)
+			ops := diffLines(a, b)
+
+			var gotA, gotB []string
+			edits := 0
+			for _, op := range ops {
+				switch op.kind {
+				case ' ':
+					gotA, gotB = append(gotA, op.line), append(gotB, op.line)
+				case '-':
+					gotA = append(gotA, op.line)
+					edits++
+				case '+':
+					gotB = append(gotB, op.line)
+					edits++
+				default:
+					t.Fatalf("op kind %q", op.kind)
+				}
+			}
+			if strings.Join(gotA, " ") != tt.a || strings.Join(gotB, " ") != tt.b {
+				t.Errorf("script turns %q into %q, want %q into %q", strings.Join(gotA, " "), strings.Join(gotB, " "), tt.a, tt.b)
+			}
+			if edits != tt.edits {
+				t.Errorf("script has %d edits, want %d", edits, tt.edits)
+			}
+		})
+	}
+}
+
+func TestUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string // space-separated lines
+		want string
+	}{
+		{"equal", "a b c", "a b c", ""},
+		{"both empty", "", "", ""},
+		{
+			"single line", "a", "b",
+			"--- from\n+++ to\n@@ -1 +1 @@\n-a\n+b\n",
+		},
+		{
+			"from empty", "", "a b",
+			"--- from\n+++ to\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			"to empty", "a b", "",
+			"--- from\n+++ to\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			"context is trimmed", "1 2 3 4 5 6 7 8 9", "1 2 3 4 x 6 7 8 9",
+			"--- from\n+++ to\n@@ -2,7 +2,7 @@\n 2\n 3\n 4\n-5\n+x\n 6\n 7\n 8\n",
+		},
+		{
+			"changes close together share a hunk", "1 2 3 4 5 6 7 8 9", "x 2 3 4 5 6 7 y 9",
+			"--- from\n+++ to\n@@ -1,9 +1,9 @@\n-1\n+x\n 2\n 3\n 4\n 5\n 6\n 7\n-8\n+y\n 9\n",
+		},
+		{
+			"changes far apart get their own hunks", "1 2 3 4 5 6 7 8 9 10 11 12", "x 2 3 4 5 6 7 8 9 10 11 y",
+			"--- from\n+++ to\n@@ -1,4 +1,4 @@\n-1\n+x\n 2\n 3\n 4\n@@ -9,4 +9,4 @@\n 9\n 10\n 11\n-12\n+y\n",
+		},
+		{
+			"insertion names the line before it", "1 2 3 4 5 6 7 8", "1 2 3 4 5 6 7 8 9",
+			"--- from\n+++ to\n@@ -6,3 +6,4 @@\n 6\n 7\n 8\n+9\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := unifiedDiff("from", "to", diffInput(tt.a), diffInput(tt.b)); got != tt.want {
+				t.Errorf("unifiedDiff() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
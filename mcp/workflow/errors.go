@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSON-RPC 2.0 error codes
+const (
+	codeParseError     = -32700
+	codeInvalidRequest = -32600
+	codeMethodNotFound = -32601
+	codeInvalidParams  = -32602
+	codeInternalError  = -32603
+
+	// MCP: unknown resource URI
+	codeResourceNotFound = -32002
+)
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func rpcError(code int, format string, a ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, a...)}
+}
+
+// ToolError is a tool failure that is reported to the client as a normal
+// tools/call result with isError set, so the model can read it and recover.
+type ToolError struct {
+	Message string
+	Hint    string
+	Details map[string]any
+}
+
+func (e *ToolError) Error() string {
+	return e.Message
+}
+
+// With attaches an extra field to the error payload.
+func (e *ToolError) With(key string, value any) *ToolError {
+	if e.Details == nil {
+		e.Details = make(map[string]any)
+	}
+	e.Details[key] = value
+	return e
+}
+
+// JSON renders the error in the same shape the tools have always used:
+// {"error": "...", "hint": "...", ...details}
+func (e *ToolError) JSON() string {
+	payload := map[string]any{"error": e.Message}
+	if e.Hint != "" {
+		payload["hint"] = e.Hint
+	}
+	for k, v := range e.Details {
+		payload[k] = v
+	}
+	output, _ := json.MarshalIndent(payload, "", "  ")
+	return string(output)
+}
+
+func toolError(format string, a ...any) *ToolError {
+	return &ToolError{Message: fmt.Sprintf(format, a...)}
+}
+
+func errNoWorkflow() *ToolError {
+	return &ToolError{Message: "no workflow initialized", Hint: "call workflow_init first"}
+}
+
+// toolResult wraps tool output in an MCP CallToolResult.
+func toolResult(text string, isError bool) map[string]any {
+	result := map[string]any{
+		"content": []map[string]any{
+			{
+				"type": "text",
+				"text": text,
+			},
+		},
+	}
+	if isError {
+		result["isError"] = true
+	}
+	return result
+}
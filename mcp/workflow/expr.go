@@ -0,0 +1,477 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// A small expression language for step transitions, e.g.
+//
+//	artifacts.test_results.content.failed > 0
+//	outcome == "failure" || iteration_count >= 3
+//	len(artifacts.criteria.content) == 0
+//
+// Paths are resolved against the JSON form of the workflow state plus a few
+// extra variables (see transitionContext). A path that doesn't exist
+// evaluates to null, which compares unequal to everything except null and
+// is never greater or less than anything.
+
+type exprNode interface {
+	eval(ctx map[string]any) (any, error)
+}
+
+// parseExpr compiles an expression so it can be checked at config load time
+// and evaluated repeatedly.
+func parseExpr(src string) (exprNode, error) {
+	p := &exprParser{src: src}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q at offset %d", p.tokens[p.pos].text, p.tokens[p.pos].offset)
+	}
+	return node, nil
+}
+
+// evalCondition evaluates src and reports whether the result is truthy.
+func evalCondition(src string, ctx map[string]any) (bool, error) {
+	node, err := parseExpr(src)
+	if err != nil {
+		return false, err
+	}
+	v, err := node.eval(ctx)
+	if err != nil {
+		return false, err
+	}
+	return truthy(v), nil
+}
+
+type tokenKind int
+
+const (
+	tokIdent tokenKind = iota
+	tokNumber
+	tokString
+	tokOp
+)
+
+type exprToken struct {
+	kind   tokenKind
+	text   string
+	num    float64
+	offset int
+}
+
+type exprParser struct {
+	src    string
+	tokens []exprToken
+	pos    int
+}
+
+var exprOperators = []string{"&&", "||", "==", "!=", ">=", "<=", ">", "<", "!", "(", ")", "[", "]", "."}
+
+func (p *exprParser) tokenize() error {
+	src := p.src
+	for i := 0; i < len(src); {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case c == '"' || c == '\'':
+			j := i + 1
+			var sb strings.Builder
+			for j < len(src) && rune(src[j]) != c {
+				if src[j] == '\\' && j+1 < len(src) {
+					j++
+				}
+				sb.WriteByte(src[j])
+				j++
+			}
+			if j >= len(src) {
+				return fmt.Errorf("unterminated string at offset %d", i)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokString, text: sb.String(), offset: i})
+			i = j + 1
+		case unicode.IsDigit(c) || (c == '-' && i+1 < len(src) && unicode.IsDigit(rune(src[i+1])) && p.expectsOperand()):
+			j := i + 1
+			for j < len(src) && (unicode.IsDigit(rune(src[j])) || src[j] == '.') {
+				j++
+			}
+			n, err := strconv.ParseFloat(src[i:j], 64)
+			if err != nil {
+				return fmt.Errorf("invalid number %q at offset %d", src[i:j], i)
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokNumber, text: src[i:j], num: n, offset: i})
+			i = j
+		case unicode.IsLetter(c) || c == '_':
+			j := i + 1
+			for j < len(src) && (unicode.IsLetter(rune(src[j])) || unicode.IsDigit(rune(src[j])) || src[j] == '_' || src[j] == '-') {
+				j++
+			}
+			p.tokens = append(p.tokens, exprToken{kind: tokIdent, text: src[i:j], offset: i})
+			i = j
+		default:
+			matched := false
+			for _, op := range exprOperators {
+				if strings.HasPrefix(src[i:], op) {
+					p.tokens = append(p.tokens, exprToken{kind: tokOp, text: op, offset: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return fmt.Errorf("unexpected character %q at offset %d", c, i)
+			}
+		}
+	}
+	return nil
+}
+
+// expectsOperand reports whether a '-' at this point starts a negative
+// number rather than being an (unsupported) binary minus.
+func (p *exprParser) expectsOperand() bool {
+	if len(p.tokens) == 0 {
+		return true
+	}
+	last := p.tokens[len(p.tokens)-1]
+	return last.kind == tokOp && last.text != ")" && last.text != "]"
+}
+
+func (p *exprParser) peek() *exprToken {
+	if p.pos < len(p.tokens) {
+		return &p.tokens[p.pos]
+	}
+	return nil
+}
+
+func (p *exprParser) acceptOp(ops ...string) string {
+	if t := p.peek(); t != nil && t.kind == tokOp {
+		for _, op := range ops {
+			if t.text == op {
+				p.pos++
+				return op
+			}
+		}
+	}
+	return ""
+}
+
+func (p *exprParser) expectOp(op string) error {
+	if p.acceptOp(op) == "" {
+		if t := p.peek(); t != nil {
+			return fmt.Errorf("expected %q at offset %d, got %q", op, t.offset, t.text)
+		}
+		return fmt.Errorf("expected %q at end of expression", op)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("||") != "" {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.acceptOp("&&") != "" {
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if p.acceptOp("!") != "" {
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+	if op := p.acceptOp("==", "!=", ">=", "<=", ">", "<"); op != "" {
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return compareNode{op: op, left: left, right: right}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.peek()
+	if t == nil {
+		return nil, fmt.Errorf("unexpected end of expression")
+	}
+	switch t.kind {
+	case tokNumber:
+		p.pos++
+		return literalNode{t.num}, nil
+	case tokString:
+		p.pos++
+		return literalNode{t.text}, nil
+	case tokIdent:
+		p.pos++
+		switch t.text {
+		case "true":
+			return literalNode{true}, nil
+		case "false":
+			return literalNode{false}, nil
+		case "null":
+			return literalNode{nil}, nil
+		}
+		if p.acceptOp("(") != "" {
+			return p.parseCall(t.text)
+		}
+		return p.parsePath(t.text)
+	case tokOp:
+		if t.text == "(" {
+			p.pos++
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expectOp(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at offset %d", t.text, t.offset)
+}
+
+func (p *exprParser) parsePath(root string) (exprNode, error) {
+	path := pathNode{root}
+	for {
+		if p.acceptOp(".") != "" {
+			t := p.peek()
+			if t == nil || t.kind != tokIdent {
+				return nil, fmt.Errorf("expected field name after '.' in %s", strings.Join(path, "."))
+			}
+			p.pos++
+			path = append(path, t.text)
+		} else if p.acceptOp("[") != "" {
+			t := p.peek()
+			if t == nil || (t.kind != tokNumber && t.kind != tokString) {
+				return nil, fmt.Errorf("expected index after '[' in %s", strings.Join(path, "."))
+			}
+			p.pos++
+			path = append(path, t.text)
+			if err := p.expectOp("]"); err != nil {
+				return nil, err
+			}
+		} else {
+			return path, nil
+		}
+	}
+}
+
+var exprFunctions = map[string]func(any) any{
+	// len returns the length of a string, list or object (0 for null)
+	"len": func(v any) any {
+		switch x := v.(type) {
+		case string:
+			return float64(len(x))
+		case []any:
+			return float64(len(x))
+		case map[string]any:
+			return float64(len(x))
+		}
+		return float64(0)
+	},
+	// exists reports whether a path resolved to a non-null value
+	"exists": func(v any) any {
+		return v != nil
+	},
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	fn, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s()", name)
+	}
+	arg, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expectOp(")"); err != nil {
+		return nil, err
+	}
+	return callNode{fn: fn, arg: arg}, nil
+}
+
+type literalNode struct{ value any }
+
+func (n literalNode) eval(map[string]any) (any, error) { return n.value, nil }
+
+type pathNode []string
+
+func (n pathNode) eval(ctx map[string]any) (any, error) {
+	var cur any = ctx
+	for _, part := range n {
+		switch x := cur.(type) {
+		case map[string]any:
+			cur = x[part]
+		case []any:
+			i, err := strconv.Atoi(part)
+			if err != nil || i < 0 || i >= len(x) {
+				return nil, nil
+			}
+			cur = x[i]
+		default:
+			return nil, nil
+		}
+	}
+	return cur, nil
+}
+
+type callNode struct {
+	fn  func(any) any
+	arg exprNode
+}
+
+func (n callNode) eval(ctx map[string]any) (any, error) {
+	v, err := n.arg.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return n.fn(v), nil
+}
+
+type notNode struct{ operand exprNode }
+
+func (n notNode) eval(ctx map[string]any) (any, error) {
+	v, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(v), nil
+}
+
+type logicalNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n logicalNode) eval(ctx map[string]any) (any, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if n.op == "&&" && !truthy(l) {
+		return false, nil
+	}
+	if n.op == "||" && truthy(l) {
+		return true, nil
+	}
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return truthy(r), nil
+}
+
+type compareNode struct {
+	op          string
+	left, right exprNode
+}
+
+func (n compareNode) eval(ctx map[string]any) (any, error) {
+	l, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	r, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch n.op {
+	case "==":
+		return reflect.DeepEqual(l, r), nil
+	case "!=":
+		return !reflect.DeepEqual(l, r), nil
+	}
+
+	var cmp int
+	switch lv := l.(type) {
+	case float64:
+		rv, ok := r.(float64)
+		if !ok {
+			return false, nil
+		}
+		switch {
+		case lv < rv:
+			cmp = -1
+		case lv > rv:
+			cmp = 1
+		}
+	case string:
+		rv, ok := r.(string)
+		if !ok {
+			return false, nil
+		}
+		cmp = strings.Compare(lv, rv)
+	default:
+		return false, nil
+	}
+	switch n.op {
+	case ">":
+		return cmp > 0, nil
+	case ">=":
+		return cmp >= 0, nil
+	case "<":
+		return cmp < 0, nil
+	default: // "<="
+		return cmp <= 0, nil
+	}
+}
+
+func truthy(v any) bool {
+	switch x := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return x
+	case float64:
+		return x != 0
+	case string:
+		return x != ""
+	case []any:
+		return len(x) > 0
+	case map[string]any:
+		return len(x) > 0
+	}
+	return true
+}
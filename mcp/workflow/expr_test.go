@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestEvalCondition(t *testing.T) {
+	var ctx map[string]any
+	if err := json.Unmarshal([]byte(`{
+		"outcome": "failure",
+		"iteration_count": 3,
+		"task": "",
+		"artifacts": {
+			"test_results": {"content": {"failed": 2, "passed": 10}},
+			"criteria": {"content": [
+				{"id": "c1", "status": "pass"},
+				{"id": "c2", "status": "fail"}
+			]},
+			"notes": {"content": {}}
+		},
+		"flags": {"draft": true, "skip-ci": false}
+	}`), &ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// Comparisons
+		{`outcome == "failure"`, true},
+		{`outcome != 'failure'`, false},
+		{`iteration_count >= 3`, true},
+		{`iteration_count > 3`, false},
+		{`iteration_count < 3.5`, true},
+		{`iteration_count <= -1`, false},
+		{`artifacts.test_results.content.failed > 0`, true},
+		{`"abc" < "abd"`, true},
+		{`outcome > 1`, false},
+
+		// Paths
+		{`artifacts.criteria.content[1].status == "fail"`, true},
+		{`artifacts.criteria.content["0"].id == "c1"`, true},
+		{`artifacts.criteria.content[5].id == null`, true},
+		{`artifacts.missing.content.failed > 0`, false},
+		{`artifacts.missing.content.failed < 0`, false},
+		{`artifacts.missing == null`, true},
+		{`flags.skip-ci == false`, true},
+
+		// Logic and precedence
+		{`outcome == "failure" || iteration_count >= 10`, true},
+		{`outcome == "success" || iteration_count >= 10`, false},
+		{`outcome == "failure" && iteration_count >= 10`, false},
+		{`!(outcome == "success")`, true},
+		{`true || false && false`, true},
+		{`(true || false) && false`, false},
+		{`!flags.draft`, false},
+
+		// Truthiness
+		{`task`, false},
+		{`outcome`, true},
+		{`artifacts.notes.content`, false},
+		{`artifacts.criteria.content`, true},
+		{`null`, false},
+		{`0`, false},
+
+		// Functions
+		{`len(artifacts.criteria.content) == 2`, true},
+		{`len(outcome) == 7`, true},
+		{`len(artifacts.missing) == 0`, true},
+		{`exists(artifacts.test_results)`, true},
+		{`exists(artifacts.plan)`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			got, err := evalCondition(tt.expr, ctx)
+			if err != nil {
+				t.Fatalf("evalCondition(%s) error = %v", tt.expr, err)
+			}
+			if got != tt.want {
+				t.Errorf("evalCondition(%s) = %v, want %v", tt.expr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	tests := []struct {
+		expr    string
+		wantErr string
+	}{
+		{``, "unexpected end"},
+		{`outcome ==`, "unexpected end"},
+		{`"unterminated`, "unterminated string"},
+		{`iteration_count - 1 > 0`, "unexpected character"},
+		{`a = 1`, "unexpected character"},
+		{`(a == 1`, ")"},
+		{`a == 1)`, "unexpected \")\""},
+		{`a.`, "expected field name"},
+		{`a[b]`, "expected index"},
+		{`size(a) > 0`, "unknown function size()"},
+		{`1.2.3 > 0`, "invalid number"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			_, err := parseExpr(tt.expr)
+			if err == nil {
+				t.Fatalf("parseExpr(%s) succeeded, want error", tt.expr)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseExpr(%s) error = %v, want it to mention %q", tt.expr, err, tt.wantErr)
+			}
+		})
+	}
+}
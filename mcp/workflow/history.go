@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Per-step history. Each time a step starts it gets a new StepAttempt,
+// which records the iterations it went through and how it ended, so the
+// rounds a step took survive the transition to the next step.
+// IterationCount and IterationFeedback on the workflow only describe the
+// current step.
+
+// StepAttempt is one run of a step, from starting it to leaving it.
+type StepAttempt struct {
+	StartedAt   string      `json:"started_at,omitempty"`
+	CompletedAt string      `json:"completed_at,omitempty"`
+	Status      string      `json:"status,omitempty"` // how it ended: completed, skipped, reset or rolled_back
+	Outcome     string      `json:"outcome,omitempty"`
+	Iterations  []Iteration `json:"iterations,omitempty"`
+	ApprovedBy  string      `json:"approved_by,omitempty"` // agent, code, token, cli, ...
+	// See timing.go
+	AwaitingApprovalAt string `json:"awaiting_approval_at,omitempty"`
+	WarnedAt           string `json:"warned_at,omitempty"`  // warn_after passed
+	OverdueAt          string `json:"overdue_at,omitempty"` // timeout passed
+}
+
+// Iteration is one round of feedback from workflow_iterate.
+type Iteration struct {
+	Feedback  string `json:"feedback"`
+	Timestamp string `json:"timestamp"`
+}
+
+// beginAttempt starts a new attempt of step, unless one is still open.
+func beginAttempt(step *WorkflowStep) {
+	if n := len(step.Attempts); n > 0 && step.Attempts[n-1].CompletedAt == "" {
+		return
+	}
+	step.Attempts = append(step.Attempts, StepAttempt{StartedAt: time.Now().UTC().Format(time.RFC3339)})
+}
+
+// currentAttempt returns step's open attempt, opening one (without a start
+// time) for a step started before attempts were recorded.
+func currentAttempt(step *WorkflowStep) *StepAttempt {
+	n := len(step.Attempts)
+	if n == 0 || step.Attempts[n-1].CompletedAt != "" {
+		step.Attempts = append(step.Attempts, StepAttempt{})
+		n++
+	}
+	return &step.Attempts[n-1]
+}
+
+// endAttempt closes step's open attempt, if any, with status.
+func endAttempt(step *WorkflowStep, status string) {
+	n := len(step.Attempts)
+	if n == 0 || step.Attempts[n-1].CompletedAt != "" {
+		return
+	}
+	a := &step.Attempts[n-1]
+	a.CompletedAt = time.Now().UTC().Format(time.RFC3339)
+	a.Status = status
+	a.Outcome = step.Outcome
+}
+
+// stepHistory summarizes step's attempts for workflow_history.
+func stepHistory(step WorkflowStep) map[string]any {
+	iterations := 0
+	for _, a := range step.Attempts {
+		iterations += len(a.Iterations)
+	}
+	entry := map[string]any{
+		"name":       step.Name,
+		"status":     step.Status,
+		"attempts":   step.Attempts,
+		"iterations": iterations,
+	}
+	if step.ChildID != "" {
+		entry["child_workflow_id"] = step.ChildID
+	}
+	if len(step.Parallel) > 0 {
+		branches := []map[string]any{}
+		for _, b := range step.Parallel {
+			branches = append(branches, stepHistory(b))
+		}
+		entry["parallel"] = branches
+	}
+	return entry
+}
+
+// workflowHistory returns the attempts of every step of st, or of the
+// named step (or branch) only.
+func workflowHistory(st *WorkflowState, step string) (string, error) {
+	steps := []map[string]any{}
+	for _, s := range st.Steps {
+		if step == "" || s.Name == step {
+			steps = append(steps, stepHistory(s))
+			continue
+		}
+		for _, b := range s.Parallel {
+			if b.Name == step {
+				steps = append(steps, stepHistory(b))
+			}
+		}
+	}
+	if step != "" && len(steps) == 0 {
+		return "", toolError("step %s not found", step).With("workflow_id", st.ID)
+	}
+
+	result := map[string]any{
+		"workflow_id":  st.ID,
+		"task":         st.Task,
+		"current_step": st.CurrentStep,
+		"steps":        steps,
+	}
+	if len(st.Rollbacks) > 0 {
+		result["rollbacks"] = st.Rollbacks
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/subtle"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// HTTP mode (`workflow-mcp --http :7420`): MCP over Streamable HTTP at
+// /mcp, a REST API over the same store, a Server-Sent Events stream of
+// workflow events, and a small dashboard page. It is meant for clients,
+// apps and people that can't run or read ~/state directly, e.g. from
+// another container.
+//
+// Events are read from the workflow journals rather than from this process,
+// so the stream also carries events committed by MCP servers and CLI
+// commands running elsewhere. Events that are never journaled, like
+// approval codes, are never streamed.
+
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// eventPollInterval is how often the event stream looks for new journal
+// entries.
+const eventPollInterval = 500 * time.Millisecond
+
+type httpServer struct {
+	token string // required bearer token, if set
+}
+
+func serveHTTP(addr, token string) error {
+	addr, err := listenAddr(addr, token)
+	if err != nil {
+		return err
+	}
+	s := &httpServer{token: token}
+	fmt.Fprintf(os.Stderr, "workflow-mcp: serving HTTP on %s\n", addr)
+	return http.ListenAndServe(addr, s.handler())
+}
+
+// handler routes the HTTP endpoints, behind authorize.
+func (s *httpServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/mcp", serveMCP)
+	mux.HandleFunc("GET /{$}", s.dashboard)
+	mux.HandleFunc("GET /workflows", s.listWorkflows)
+	mux.HandleFunc("GET /workflows/{id}", s.getWorkflow)
+	mux.HandleFunc("POST /workflows/{id}/approve", s.approve)
+	mux.HandleFunc("POST /workflows/{id}/iterate", s.iterate)
+	mux.HandleFunc("POST /workflows/{id}/reject", s.reject)
+	mux.HandleFunc("GET /events", s.events)
+	return s.authorize(mux)
+}
+
+// listenAddr picks the address to listen on. Anyone who can reach the
+// server can approve steps and call tools, so without a token it only
+// listens on loopback: a bare port (":7420") binds 127.0.0.1, and other
+// hosts are refused.
+func listenAddr(addr, token string) (string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("invalid --http address %q: %w", addr, err)
+	}
+	if token != "" || host == "localhost" {
+		return addr, nil
+	}
+	if host == "" {
+		return net.JoinHostPort("127.0.0.1", port), nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return addr, nil
+	}
+	return "", fmt.Errorf("refusing to serve HTTP on %s without a token: set --http-token (or WORKFLOW_HTTP_TOKEN), or listen on 127.0.0.1", addr)
+}
+
+// authorize checks the bearer token, which browsers that can't set headers
+// (EventSource, a bookmarked dashboard) may pass as ?token= instead.
+// Without a token only loopback origins are allowed.
+func (s *httpServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.token == "" && !checkOrigin(r) {
+			writeHTTPError(w, http.StatusForbidden, &ToolError{
+				Message: "origin " + r.Header.Get("Origin") + " not allowed",
+				Hint:    "set --http-token to allow browsers on other hosts",
+			})
+			return
+		}
+		if s.token != "" {
+			given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if given == "" {
+				given = r.URL.Query().Get("token")
+			}
+			if subtle.ConstantTimeCompare([]byte(given), []byte(s.token)) != 1 {
+				writeHTTPError(w, http.StatusUnauthorized, &ToolError{
+					Message: "missing or invalid token",
+					Hint:    "send the --http-token value as a bearer token in the Authorization header, or as ?token=",
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *httpServer) dashboard(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(dashboardHTML)
+}
+
+func (s *httpServer) listWorkflows(w http.ResponseWriter, r *http.Request) {
+	all := r.URL.Query().Get("all") != ""
+	output, err := withLock(func() (string, error) {
+		return workflowList(all)
+	})
+	writeHTTPResult(w, output, err)
+}
+
+func (s *httpServer) getWorkflow(w http.ResponseWriter, r *http.Request) {
+	output, err := withLock(func() (string, error) {
+		st, err := store.Load(r.PathValue("id"))
+		if err != nil {
+			return "", err
+		}
+		return workflowStatus(st)
+	})
+	writeHTTPResult(w, output, err)
+}
+
+// approve approves the step awaiting approval. Anything that can reach the
+// port (including the agent) can call it, so human_token gates need the
+// approval code or token in the body.
+func (s *httpServer) approve(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ApprovalCode string `json:"approval_code"`
+	}
+	if !readHTTPBody(w, r, &body) {
+		return
+	}
+	output, err := withLock(func() (string, error) {
+		st, err := loadLeaf(r.PathValue("id"))
+		if err != nil {
+			return "", err
+		}
+		return workflowApprove(st, body.ApprovalCode)
+	})
+	writeHTTPResult(w, output, err)
+}
+
+func (s *httpServer) iterate(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Feedback string `json:"feedback"`
+	}
+	if !readHTTPBody(w, r, &body) {
+		return
+	}
+	output, err := withLock(func() (string, error) {
+		st, err := loadLeaf(r.PathValue("id"))
+		if err != nil {
+			return "", err
+		}
+		return workflowIterate(st, body.Feedback)
+	})
+	writeHTTPResult(w, output, err)
+}
+
+func (s *httpServer) reject(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		To     string `json:"to"`
+		Reason string `json:"reason"`
+	}
+	if !readHTTPBody(w, r, &body) {
+		return
+	}
+	output, err := withLock(func() (string, error) {
+		st, err := loadLeaf(r.PathValue("id"))
+		if err != nil {
+			return "", err
+		}
+		return workflowReject(st, body.To, body.Reason)
+	})
+	writeHTTPResult(w, output, err)
+}
+
+// loadLeaf loads a workflow and descends into its running sub-workflow, the
+// way step-level tools do.
+func loadLeaf(id string) (*WorkflowState, error) {
+	st, err := store.Load(id)
+	if err != nil {
+		return nil, err
+	}
+	return activeLeaf(st)
+}
+
+// events streams journaled events as they are committed, optionally only
+// those of one workflow (?workflow=<id>). Each event's SSE id is
+// <workflow_id>/<seq>.
+func (s *httpServer) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+	only := r.URL.Query().Get("workflow")
+	if only != "" {
+		if err := checkWorkflowID(only); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": connected\n\n")
+	flusher.Flush()
+
+	tail := newJournalTail(only)
+	tail.poll() // skip what's already there
+	ticker := time.NewTicker(eventPollInterval)
+	defer ticker.Stop()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case <-ticker.C:
+			events := tail.poll()
+			for _, ev := range events {
+				data, _ := json.Marshal(ev)
+				fmt.Fprintf(w, "id: %s/%d\ndata: %s\n\n", ev.WorkflowID, ev.Seq, data)
+			}
+			if len(events) > 0 {
+				flusher.Flush()
+			}
+		}
+	}
+}
+
+// journalTail follows the event journals in the store, remembering the
+// last sequence number seen in each.
+type journalTail struct {
+	only   string
+	seen   map[string]int64
+	size   map[string]int64
+	primed bool // past the first poll, which only records where journals end
+}
+
+func newJournalTail(only string) *journalTail {
+	return &journalTail{only: only, seen: map[string]int64{}, size: map[string]int64{}}
+}
+
+// poll returns the events appended since the last poll.
+func (t *journalTail) poll() []WorkflowEvent {
+	pattern := "*.events.jsonl"
+	if t.only != "" {
+		pattern = t.only + ".events.jsonl"
+	}
+	paths, _ := filepath.Glob(filepath.Join(store.dir, pattern))
+
+	var events []WorkflowEvent
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil || info.Size() == t.size[path] {
+			continue
+		}
+		t.size[path] = info.Size()
+
+		id := strings.TrimSuffix(filepath.Base(path), ".events.jsonl")
+		entries, _, err := store.ReadJournal(id, t.seen[path], 0)
+		if err != nil || len(entries) == 0 {
+			continue
+		}
+		t.seen[path] = entries[len(entries)-1].Seq
+		if !t.primed {
+			continue
+		}
+		for _, entry := range entries {
+			events = append(events, entry.WorkflowEvent)
+		}
+	}
+	t.primed = true
+	return events
+}
+
+func readHTTPBody(w http.ResponseWriter, r *http.Request, v any) bool {
+	if r.ContentLength == 0 {
+		return true
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(v); err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON body: %w", err))
+		return false
+	}
+	return true
+}
+
+func writeHTTPResult(w http.ResponseWriter, output string, err error) {
+	if err != nil {
+		status := http.StatusInternalServerError
+		var te *ToolError
+		if errors.As(err, &te) {
+			status = http.StatusConflict
+			if strings.HasSuffix(te.Message, "not found") {
+				status = http.StatusNotFound
+			} else if strings.HasPrefix(te.Message, "invalid workflow_id") {
+				status = http.StatusBadRequest
+			}
+		}
+		writeHTTPError(w, status, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintln(w, output)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, err error) {
+	te, ok := err.(*ToolError)
+	if !ok {
+		te = &ToolError{Message: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, te.JSON())
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpCall is one request to the HTTP server: method, path (with the
+// active workflow's ID in place of {id}), JSON body and headers, and what
+// must come back.
+type httpCall struct {
+	method, path, body string
+	header             map[string]string
+	wantStatus         int
+	want               map[string]any // fields of the JSON response, see toolCall
+}
+
+// doHTTP makes c against srv and decodes the JSON response, if any.
+func doHTTP(t *testing.T, srv *httptest.Server, c httpCall) (*http.Response, map[string]any) {
+	t.Helper()
+	path := strings.ReplaceAll(c.path, "{id}", store.ActiveID())
+	req, err := http.NewRequest(c.method, srv.URL+path, strings.NewReader(c.body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range c.header {
+		req.Header.Set(k, v)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	result := map[string]any{}
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		if err := json.Unmarshal(data, &result); err != nil {
+			t.Fatalf("%s %s: response isn't a JSON object: %s", c.method, path, data)
+		}
+	}
+	if resp.StatusCode != c.wantStatus {
+		t.Fatalf("%s %s: status %d, want %d: %s", c.method, path, resp.StatusCode, c.wantStatus, data)
+	}
+	for k, want := range c.want {
+		if got := fmt.Sprint(resultField(result, k)); got != fmt.Sprint(want) {
+			t.Fatalf("%s %s: %s = %s, want %v", c.method, path, k, got, want)
+		}
+	}
+	return resp, result
+}
+
+func TestHTTPAPI(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  string // plan's approval_mode
+		token string
+		setup []toolCall // after workflow_init
+		calls []httpCall
+		want  string // step statuses afterwards, see stepStatuses
+	}{
+		{
+			name: "list and get workflows",
+			mode: approvalModeAgent,
+			calls: []httpCall{
+				{method: "GET", path: "/workflows", wantStatus: 200},
+				{method: "GET", path: "/workflows/{id}", wantStatus: 200, want: map[string]any{"current_step": "plan", "task": "gates"}},
+				{method: "GET", path: "/workflows/wf_missing", wantStatus: 404, want: map[string]any{"error": "workflow wf_missing not found"}},
+				{method: "GET", path: "/workflows/.hidden", wantStatus: 400},
+			},
+			want: "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:  "approve",
+			mode:  approvalModeAgent,
+			setup: []toolCall{{tool: "workflow_next"}},
+			calls: []httpCall{
+				{method: "POST", path: "/workflows/{id}/approve", wantStatus: 200, want: map[string]any{"approved": true, "current_step": "execute"}},
+				{method: "POST", path: "/workflows/{id}/approve", wantStatus: 409, want: map[string]any{"error": "step is not awaiting approval"}},
+			},
+			want: "plan=completed execute=in_progress verify=pending",
+		},
+		{
+			name:  "approve a human_token step",
+			mode:  approvalModeHumanToken,
+			setup: []toolCall{{tool: "workflow_next"}},
+			calls: []httpCall{
+				{method: "POST", path: "/workflows/{id}/approve", wantStatus: 409, want: map[string]any{"error": "step plan needs approval from a human: no approval code given"}},
+				{method: "POST", path: "/workflows/{id}/approve", body: `{"approval_code":"AAAA-BBBB"}`, wantStatus: 409, want: map[string]any{"error": "step plan needs approval from a human: invalid approval code"}},
+				{method: "POST", path: "/workflows/{id}/approve", body: `{"approval_code":`, wantStatus: 400},
+			},
+			want: "plan=awaiting_approval execute=pending verify=pending",
+		},
+		{
+			name:  "iterate",
+			mode:  approvalModeAgent,
+			setup: []toolCall{{tool: "workflow_next"}},
+			calls: []httpCall{
+				{method: "POST", path: "/workflows/{id}/iterate", body: `{"feedback":"smaller steps"}`, wantStatus: 200, want: map[string]any{"iterated": true, "step": "plan", "iteration_count": 1}},
+			},
+			want: "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:  "reject",
+			mode:  approvalModeAgent,
+			setup: []toolCall{{tool: "workflow_next"}, {tool: "workflow_approve"}},
+			calls: []httpCall{
+				{method: "POST", path: "/workflows/{id}/reject", body: `{"to":"plan","reason":"wrong approach"}`, wantStatus: 200, want: map[string]any{"current_step": "plan"}},
+			},
+			want: "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name:  "token",
+			mode:  approvalModeAgent,
+			token: "t0ken",
+			calls: []httpCall{
+				{method: "GET", path: "/workflows", wantStatus: 401, want: map[string]any{"error": "missing or invalid token"}},
+				{method: "GET", path: "/workflows", header: map[string]string{"Authorization": "Bearer wrong"}, wantStatus: 401},
+				{method: "GET", path: "/workflows", header: map[string]string{"Authorization": "Bearer t0ken"}, wantStatus: 200},
+				{method: "GET", path: "/workflows?token=t0ken", wantStatus: 200},
+				{method: "GET", path: "/", header: map[string]string{"Origin": "https://elsewhere.example", "Authorization": "Bearer t0ken"}, wantStatus: 200},
+			},
+			want: "plan=in_progress execute=pending verify=pending",
+		},
+		{
+			name: "origin without a token",
+			mode: approvalModeAgent,
+			calls: []httpCall{
+				{method: "GET", path: "/", wantStatus: 200},
+				{method: "GET", path: "/workflows", header: map[string]string{"Origin": "http://localhost:3000"}, wantStatus: 200},
+				{method: "GET", path: "/workflows", header: map[string]string{"Origin": "http://127.0.0.1:8080"}, wantStatus: 200},
+				{method: "POST", path: "/workflows/{id}/approve", header: map[string]string{"Origin": "https://elsewhere.example"}, wantStatus: 403},
+			},
+			want: "plan=in_progress execute=pending verify=pending",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer(t, strings.Replace(approvalTestConfig, "%s", tt.mode, 1))
+			runCalls(t, append([]toolCall{{tool: "workflow_init", args: `{"task":"gates"}`}}, tt.setup...))
+			srv := httptest.NewServer((&httpServer{token: tt.token}).handler())
+			defer srv.Close()
+
+			for _, c := range tt.calls {
+				doHTTP(t, srv, c)
+			}
+			if got := stepStatuses(activeState(t)); got != tt.want {
+				t.Errorf("steps = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHTTPMCP(t *testing.T) {
+	testServer(t, strings.Replace(approvalTestConfig, "%s", approvalModeAgent, 1))
+	srv := httptest.NewServer((&httpServer{}).handler())
+	defer srv.Close()
+
+	resp, _ := doHTTP(t, srv, httpCall{
+		method:     "POST",
+		path:       "/mcp",
+		body:       `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"protocolVersion":"2025-03-26","capabilities":{},"clientInfo":{"name":"test","version":"1"}}}`,
+		wantStatus: 200,
+		want:       map[string]any{"result.serverInfo.name": "workflow-mcp"},
+	})
+	session := map[string]string{sessionHeader: resp.Header.Get(sessionHeader)}
+	if session[sessionHeader] == "" {
+		t.Fatal("initialize didn't return a session ID")
+	}
+
+	doHTTP(t, srv, httpCall{
+		method:     "POST",
+		path:       "/mcp",
+		body:       `{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"workflow_init","arguments":{"task":"over http"}}}`,
+		wantStatus: 400,
+		want:       map[string]any{"error": "missing " + sessionHeader + " header"},
+	})
+	_, result := doHTTP(t, srv, httpCall{
+		method:     "POST",
+		path:       "/mcp",
+		header:     session,
+		body:       `{"jsonrpc":"2.0","id":2,"method":"tools/call","params":{"name":"workflow_init","arguments":{"task":"over http"}}}`,
+		wantStatus: 200,
+		want:       map[string]any{"id": 2, "result.isError": nil},
+	})
+	if st := activeState(t); st.Task != "over http" {
+		t.Errorf("active workflow %s has task %q: %v", st.ID, st.Task, result)
+	}
+	doHTTP(t, srv, httpCall{method: "POST", path: "/mcp", header: session, body: `{"jsonrpc":"2.0","method":"notifications/initialized"}`, wantStatus: 202})
+	doHTTP(t, srv, httpCall{method: "DELETE", path: "/mcp", header: session, wantStatus: 204})
+	doHTTP(t, srv, httpCall{method: "DELETE", path: "/mcp", header: session, wantStatus: 404})
+}
+
+func TestHTTPEvents(t *testing.T) {
+	testServer(t, strings.Replace(approvalTestConfig, "%s", approvalModeAgent, 1))
+	runCalls(t, []toolCall{{tool: "workflow_init", args: `{"task":"gates"}`}})
+	srv := httptest.NewServer((&httpServer{}).handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", srv.URL+"/events?workflow="+store.ActiveID(), nil)
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	lines := bufio.NewScanner(resp.Body)
+	if !lines.Scan() || lines.Text() != ": connected" {
+		t.Fatalf("stream starts with %q, want : connected", lines.Text())
+	}
+
+	// Only events committed after connecting are streamed
+	runCalls(t, []toolCall{{tool: "workflow_next"}})
+	var ev WorkflowEvent
+	for lines.Scan() {
+		if data, ok := strings.CutPrefix(lines.Text(), "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatalf("bad event %s: %v", data, err)
+			}
+			break
+		}
+	}
+	if ev.Type != "awaiting_approval" || ev.Step != "plan" {
+		t.Errorf("streamed event %s for step %s, want awaiting_approval for plan (%v)", ev.Type, ev.Step, lines.Err())
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+)
+
+// journalEntry is one line of a workflow's append-only event journal
+// (~/state/workflows/<id>.events.jsonl). Besides the event itself it holds
+// a JSON merge patch (RFC 7386) from the previous state to the state after
+// the event, so the state can be rebuilt from the journal alone. A merge
+// patch reads null as "delete", so when the new state holds a null the
+// patch can't carry (say in an artifact's content), the entry has the
+// whole state instead.
+type journalEntry struct {
+	WorkflowEvent
+	Patch json.RawMessage `json:"patch,omitempty"`
+	State json.RawMessage `json:"state,omitempty"`
+}
+
+// eventSinks are called with every committed event, after it has been
+// journaled and the state saved. Sinks must not block.
+var eventSinks []func(WorkflowEvent)
+
+func publishEvent(ev WorkflowEvent) {
+	for _, sink := range eventSinks {
+		sink(ev)
+	}
+}
+
+func (s *Store) journalPath(id string) string {
+	return filepath.Join(s.dir, id+".events.jsonl")
+}
+
+// appendJournal assigns ev the next sequence number and appends it, with
+// its state patch or the whole state, to the workflow's journal.
+func (s *Store) appendJournal(id string, ev *WorkflowEvent, patch, state json.RawMessage) error {
+	path := s.journalPath(id)
+	last, err := lastJournalSeq(path)
+	if err != nil {
+		return err
+	}
+	ev.Seq = last + 1
+	if ev.WorkflowID == "" {
+		ev.WorkflowID = id
+	}
+
+	line, err := json.Marshal(journalEntry{WorkflowEvent: *ev, Patch: patch, State: state})
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	// Terminate a torn line left by a crash so this entry starts cleanly
+	if info, err := f.Stat(); err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte("\n"), line...)
+		}
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// lastJournalSeq returns the sequence number of the last intact entry in
+// the journal, reading backwards from the end so large journals stay cheap.
+// A torn final line left by a crash is skipped.
+func lastJournalSeq(path string) (int64, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	const chunk = 4096
+	end := info.Size()
+	var tail []byte
+	for end > 0 {
+		start := max(end-chunk, 0)
+		buf := make([]byte, end-start)
+		if _, err := f.ReadAt(buf, start); err != nil && err != io.EOF {
+			return 0, err
+		}
+		tail = append(buf, tail...)
+		end = start
+
+		// Try complete lines from the last one backwards; the first line in
+		// tail is only complete once we've reached the start of the file
+		lines := bytes.Split(tail, []byte("\n"))
+		first := 1
+		if end == 0 {
+			first = 0
+		}
+		for i := len(lines) - 1; i >= first; i-- {
+			var entry struct {
+				Seq int64 `json:"seq"`
+			}
+			if json.Unmarshal(lines[i], &entry) == nil && entry.Seq > 0 {
+				return entry.Seq, nil
+			}
+		}
+		if first == 1 {
+			tail = lines[0]
+		}
+	}
+	return 0, nil
+}
+
+// ReadJournal returns up to limit entries with a sequence number greater
+// than since, and whether more entries follow.
+func (s *Store) ReadJournal(id string, since int64, limit int) ([]journalEntry, bool, error) {
+	f, err := os.Open(s.journalPath(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			var entry journalEntry
+			if jerr := json.Unmarshal(line, &entry); jerr != nil {
+				// A torn write from a crash; appendJournal starts a fresh line after it
+				fmt.Fprintf(os.Stderr, "workflow-mcp: skipping unreadable journal line in %s: %v\n", s.journalPath(id), jerr)
+			} else if entry.Seq > since {
+				if limit > 0 && len(entries) == limit {
+					return entries, true, nil
+				}
+				entries = append(entries, entry)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	return entries, false, nil
+}
+
+// Replay rebuilds a workflow's state by applying the journal's patches (or
+// taking its whole states) in order, stopping after untilSeq (0 means the
+// whole journal).
+func (s *Store) Replay(id string, untilSeq int64) (*WorkflowState, int64, error) {
+	entries, _, err := s.ReadJournal(id, 0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	var doc any
+	var seq int64
+	for _, entry := range entries {
+		if untilSeq > 0 && entry.Seq > untilSeq {
+			break
+		}
+		if len(entry.State) > 0 {
+			doc = nil
+			if err := json.Unmarshal(entry.State, &doc); err != nil {
+				return nil, 0, fmt.Errorf("journal entry %d: %w", entry.Seq, err)
+			}
+		} else if len(entry.Patch) > 0 {
+			var patch any
+			if err := json.Unmarshal(entry.Patch, &patch); err != nil {
+				return nil, 0, fmt.Errorf("journal entry %d: %w", entry.Seq, err)
+			}
+			doc = applyMergePatch(doc, patch)
+		}
+		seq = entry.Seq
+	}
+	if doc == nil {
+		return nil, seq, toolError("journal for workflow %s has no state", id)
+	}
+
+	data, _ := json.Marshal(doc)
+	st := &WorkflowState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, 0, fmt.Errorf("replayed state does not decode: %w", err)
+	}
+	return st, seq, nil
+}
+
+// mergeDiff returns the JSON merge patch that turns before into after, or
+// nil if they are equal. A nil before is treated as an empty document.
+// exact is false if the patch loses a null in after, and so doesn't
+// reproduce it.
+func mergeDiff(before, after []byte) (patch json.RawMessage, exact bool, err error) {
+	var a, b any
+	if len(before) > 0 {
+		if err := json.Unmarshal(before, &a); err != nil {
+			return nil, false, err
+		}
+	}
+	if err := json.Unmarshal(after, &b); err != nil {
+		return nil, false, err
+	}
+	diff, changed := diffValues(a, b)
+	if !changed {
+		return nil, true, nil
+	}
+	if patch, err = json.Marshal(diff); err != nil {
+		return nil, false, err
+	}
+	// a is only needed to check the patch now, so it may be modified
+	return patch, reflect.DeepEqual(applyMergePatch(a, diff), b), nil
+}
+
+func diffValues(a, b any) (any, bool) {
+	am, aok := a.(map[string]any)
+	bm, bok := b.(map[string]any)
+	if !aok || !bok {
+		// Merge patches replace anything that isn't an object wholesale
+		return b, !reflect.DeepEqual(a, b)
+	}
+	patch := map[string]any{}
+	for k := range am {
+		if _, ok := bm[k]; !ok {
+			patch[k] = nil
+		}
+	}
+	for k, bv := range bm {
+		av, ok := am[k]
+		if !ok {
+			patch[k] = bv
+			continue
+		}
+		if sub, changed := diffValues(av, bv); changed {
+			patch[k] = sub
+		}
+	}
+	return patch, len(patch) > 0
+}
+
+func applyMergePatch(target, patch any) any {
+	pm, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+	tm, ok := target.(map[string]any)
+	if !ok {
+		tm = map[string]any{}
+	}
+	for k, v := range pm {
+		if v == nil {
+			delete(tm, k)
+		} else {
+			tm[k] = applyMergePatch(tm[k], v)
+		}
+	}
+	return tm
+}
+
+const (
+	defaultEventsLimit = 50
+	maxEventsLimit     = 500
+)
+
+func workflowEvents(st *WorkflowState, since int64, limit int) (string, error) {
+	if limit <= 0 {
+		limit = defaultEventsLimit
+	}
+	limit = min(limit, maxEventsLimit)
+
+	entries, hasMore, err := store.ReadJournal(st.ID, since, limit)
+	if err != nil {
+		return "", err
+	}
+
+	events := []WorkflowEvent{}
+	nextSince := since
+	for _, entry := range entries {
+		events = append(events, entry.WorkflowEvent)
+		nextSince = entry.Seq
+	}
+
+	output, _ := json.MarshalIndent(map[string]any{
+		"workflow_id": st.ID,
+		"events":      events,
+		"next_since":  nextSince,
+		"has_more":    hasMore,
+	}, "", "  ")
+	return string(output), nil
+}
+
+func workflowReplay(st *WorkflowState, untilSeq int64) (string, error) {
+	rebuilt, seq, err := store.Replay(st.ID, untilSeq)
+	if err != nil {
+		return "", err
+	}
+
+	// Compare against the live state on the persisted fields only
+	current, _ := json.Marshal(st)
+	replayed, _ := json.Marshal(rebuilt)
+
+	output, _ := json.MarshalIndent(map[string]any{
+		"workflow_id":     st.ID,
+		"replayed_to_seq": seq,
+		"matches_current": bytes.Equal(current, replayed),
+		"state":           rebuilt,
+	}, "", "  ")
+	return string(output), nil
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMergeDiff(t *testing.T) {
+	tests := []struct {
+		name      string
+		before    string
+		after     string
+		wantPatch string // "" for no patch
+		wantExact bool
+	}{
+		{"equal", `{"a":1}`, `{"a":1}`, "", true},
+		{"no before", "", `{"a":1}`, `{"a":1}`, true},
+		{"changed value", `{"a":1,"b":2}`, `{"a":1,"b":3}`, `{"b":3}`, true},
+		{"added key", `{"a":1}`, `{"a":1,"b":{"c":2}}`, `{"b":{"c":2}}`, true},
+		{"removed key", `{"a":1,"b":2}`, `{"a":1}`, `{"b":null}`, true},
+		{"nested change", `{"a":{"b":1,"c":2}}`, `{"a":{"b":1,"c":3}}`, `{"a":{"c":3}}`, true},
+		{"array replaced", `{"a":[1,2]}`, `{"a":[1,3]}`, `{"a":[1,3]}`, true},
+		{"null in array", `{"a":[1]}`, `{"a":[1,null]}`, `{"a":[1,null]}`, true},
+		{"value set to null", `{"a":1}`, `{"a":null}`, `{"a":null}`, false},
+		{"added object with null", `{}`, `{"a":{"b":null}}`, `{"a":{"b":null}}`, false},
+		{"object replaces scalar", `{"a":1}`, `{"a":{"b":null,"c":1}}`, `{"a":{"b":null,"c":1}}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before []byte
+			if tt.before != "" {
+				before = []byte(tt.before)
+			}
+			patch, exact, err := mergeDiff(before, []byte(tt.after))
+			if err != nil {
+				t.Fatalf("mergeDiff() error = %v", err)
+			}
+			if string(patch) != tt.wantPatch {
+				t.Errorf("mergeDiff() patch = %s, want %s", patch, tt.wantPatch)
+			}
+			if exact != tt.wantExact {
+				t.Errorf("mergeDiff() exact = %v, want %v", exact, tt.wantExact)
+			}
+		})
+	}
+}
+
+func TestApplyMergePatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		patch  string
+		want   string
+	}{
+		{"replace value", `{"a":1}`, `{"a":2}`, `{"a":2}`},
+		{"delete key", `{"a":1,"b":2}`, `{"b":null}`, `{"a":1}`},
+		{"merge nested", `{"a":{"b":1}}`, `{"a":{"c":2}}`, `{"a":{"b":1,"c":2}}`},
+		{"replace array", `{"a":[1,2]}`, `{"a":[3]}`, `{"a":[3]}`},
+		{"into nothing", `null`, `{"a":{"b":1}}`, `{"a":{"b":1}}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var target, patch, want any
+			json.Unmarshal([]byte(tt.target), &target)
+			json.Unmarshal([]byte(tt.patch), &patch)
+			json.Unmarshal([]byte(tt.want), &want)
+			if got := applyMergePatch(target, patch); !reflect.DeepEqual(got, want) {
+				t.Errorf("applyMergePatch() = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	s := newStore(t.TempDir())
+	unlock, err := s.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlock()
+
+	st := &WorkflowState{
+		ID:          "wf_test",
+		Task:        "replay",
+		CurrentStep: "plan",
+		Steps:       []WorkflowStep{{Name: "plan", Status: "in_progress"}, {Name: "execute", Status: "pending"}},
+		Artifacts:   map[string]Artifact{},
+	}
+
+	changes := []struct {
+		name   string
+		change func()
+	}{
+		{"init", func() {}},
+		{"plan", func() {
+			st.Artifacts["plan"] = Artifact{Type: "plan", Content: "do it", Step: "plan"}
+		}},
+		{"content with nulls", func() {
+			st.Artifacts["notes"] = Artifact{Type: "notes", Content: map[string]any{"a": nil, "b": map[string]any{"c": nil, "d": 1.0}}, Step: "plan"}
+		}},
+		{"null removed", func() {
+			st.Artifacts["notes"] = Artifact{Type: "notes", Content: map[string]any{"b": map[string]any{"d": 2.0}}, Step: "plan"}
+		}},
+		{"next step", func() {
+			st.Steps[0].Status = "completed"
+			st.Steps[1].Status = "in_progress"
+			st.CurrentStep = "execute"
+			delete(st.Artifacts, "plan")
+		}},
+	}
+
+	var snapshots [][]byte
+	for _, c := range changes {
+		c.change()
+		ev := WorkflowEvent{Event: "workflow", Type: c.name}
+		if err := s.Commit(st, &ev); err != nil {
+			t.Fatalf("%s: Commit() error = %v", c.name, err)
+		}
+		data, _ := json.Marshal(st)
+		snapshots = append(snapshots, data)
+	}
+
+	for i, want := range snapshots {
+		seq := int64(i + 1)
+		got, gotSeq, err := s.Replay(st.ID, seq)
+		if err != nil {
+			t.Fatalf("Replay(%d) error = %v", seq, err)
+		}
+		if gotSeq != seq {
+			t.Errorf("Replay(%d) seq = %d", seq, gotSeq)
+		}
+		data, _ := json.Marshal(got)
+		if string(data) != string(want) {
+			t.Errorf("Replay(%d) after %s =\n%s\nwant\n%s", seq, changes[i].name, data, want)
+		}
+	}
+
+	// Only the entry that introduced the nulls needs the whole state
+	journal, err := os.ReadFile(s.journalPath(st.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, line := range strings.Split(strings.TrimSpace(string(journal)), "\n") {
+		var entry journalEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("journal line %d: %v", i+1, err)
+		}
+		if full := len(entry.State) > 0; full != (entry.Type == "content with nulls") {
+			t.Errorf("journal entry %s has whole state: %v", entry.Type, full)
+		}
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// lockFile is a no-op on platforms without flock; state writes are still
+// atomic, but concurrent servers are not serialized.
+func lockFile(path string) (func(), error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+func tryLockFile(path string) (unlock func(), ok bool, err error) {
+	unlock, err = lockFile(path)
+	return unlock, err == nil, err
+}
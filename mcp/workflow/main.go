@@ -1,14 +1,13 @@
 package main
 
 import (
-	"bufio"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
 	"time"
-
-	"gopkg.in/yaml.v3"
 )
 
 // MCP JSON-RPC types
@@ -40,52 +39,126 @@ type StepMetadata struct {
 
 // Artifact stores step outputs in a consistent structure
 type Artifact struct {
-	Type      string `json:"type"`                 // "plan", "criteria", "pr", "test_results", etc.
-	Content   any    `json:"content"`              // flexible content (string, []string, map, etc.)
-	Step      string `json:"step"`                 // which step created this
+	Type      string `json:"type"`    // "plan", "criteria", "pr", "test_results", etc.
+	Content   any    `json:"content"` // flexible content (string, []string, map, etc.)
+	Step      string `json:"step"`    // which step created this
 	CreatedAt string `json:"created_at"`
 	UpdatedAt string `json:"updated_at,omitempty"`
+	Stale     bool   `json:"stale,omitempty"`     // its step was rolled back; cleared when set again
+	Revision  int    `json:"revision,omitempty"`  // 1 for the first version, see workflow_get_artifact
+	Iteration int    `json:"iteration,omitempty"` // the step's iteration_count when it was set
 }
 
 // Workflow configuration (loaded from YAML)
 type WorkflowConfig struct {
-	Name        string       `yaml:"name" json:"name"`
-	Description string       `yaml:"description" json:"description"`
-	Steps       []StepConfig `yaml:"steps" json:"steps"`
+	Name        string          `yaml:"name" json:"name"`
+	Description string          `yaml:"description" json:"description"`
+	Steps       []StepConfig    `yaml:"steps" json:"steps"`
+	Webhooks    []WebhookConfig `yaml:"webhooks" json:"webhooks,omitempty"`
+	// Named workflows that steps can run with `uses: <name>`
+	Workflows map[string]*WorkflowConfig `yaml:"workflows" json:"workflows,omitempty"`
+	// ApprovalSecret signs approval tokens for human_token steps. $VAR
+	// references are expanded from the environment.
+	ApprovalSecret string `yaml:"approval_secret" json:"-"`
+	// StaleAfter flags workflows with no activity for this long (e.g. "72h")
+	StaleAfter string `yaml:"stale_after" json:"stale_after,omitempty"`
 }
 
 type StepConfig struct {
-	Name             string `yaml:"name" json:"name"`
-	NeedsApproval    bool   `yaml:"needs_approval" json:"needs_approval"`
-	AllowsIteration  bool   `yaml:"allows_iteration" json:"allows_iteration"`
-	ApprovalPrompt   string `yaml:"approval_prompt" json:"approval_prompt,omitempty"`
-	Instructions     string `yaml:"instructions" json:"instructions"`
+	Name            string `yaml:"name" json:"name"`
+	NeedsApproval   bool   `yaml:"needs_approval" json:"needs_approval"`
+	AllowsIteration bool   `yaml:"allows_iteration" json:"allows_iteration"`
+	ApprovalPrompt  string `yaml:"approval_prompt" json:"approval_prompt,omitempty"`
+	Instructions    string `yaml:"instructions" json:"instructions"`
+	// ApprovalMode is who may approve: "agent" (default) or "human_token"
+	ApprovalMode string `yaml:"approval_mode" json:"approval_mode,omitempty"`
+	// Transitions; without them the workflow moves to the following step
+	OnSuccess string       `yaml:"on_success" json:"on_success,omitempty"`
+	OnFailure string       `yaml:"on_failure" json:"on_failure,omitempty"`
+	Next      []Transition `yaml:"next" json:"next,omitempty"`
+	// Uses runs another workflow (a name from `workflows:` or a YAML file
+	// path relative to this config) as this step
+	Uses string `yaml:"uses" json:"uses,omitempty"`
+	// Parallel makes this step a group of branches that run at once; it
+	// completes when Quorum of them have (all of them if Quorum is 0)
+	Parallel []StepConfig `yaml:"parallel" json:"parallel,omitempty"`
+	Quorum   int          `yaml:"quorum" json:"quorum,omitempty"`
+	// Tools limits the step-level tools listed (and allowed) during this
+	// step; see visibleTools for the default
+	Tools []string `yaml:"tools" json:"tools,omitempty"`
+	// RequiresCriteriaPass keeps the step from completing successfully
+	// until every verification criterion has passed or been waived
+	RequiresCriteriaPass bool `yaml:"requires_criteria_pass" json:"requires_criteria_pass,omitempty"`
+	// Checks are commands workflow_run_checks runs during this step
+	Checks []Check `yaml:"checks" json:"checks,omitempty"`
+	// WarnAfter and Timeout are how long the step should take (e.g.
+	// "30m"), from when it started; see step_overdue events. OnTimeout
+	// "block" marks it blocked once the timeout passes.
+	WarnAfter string `yaml:"warn_after" json:"warn_after,omitempty"`
+	Timeout   string `yaml:"timeout" json:"timeout,omitempty"`
+	OnTimeout string `yaml:"on_timeout" json:"on_timeout,omitempty"`
+	// Review sets how workflow_check_pr waits for PR comments to settle
+	Review *ReviewConfig `yaml:"review" json:"review,omitempty"`
 }
 
 // Workflow runtime state
 type WorkflowState struct {
-	ID                 string              `json:"id"`
-	Task               string              `json:"task"`
-	CurrentStep        string              `json:"current_step"`
-	Steps              []WorkflowStep      `json:"steps"`
-	WaitingForApproval bool                `json:"waiting_for_approval"`
-	Artifacts          map[string]Artifact `json:"artifacts,omitempty"`
-	IterationCount     int                 `json:"iteration_count"`
-	IterationFeedback  []string            `json:"iteration_feedback,omitempty"`
+	ID                 string                `json:"id"`
+	Task               string                `json:"task"`
+	Workflow           string                `json:"workflow,omitempty"`       // name of the config it was started from
+	ConfigVersion      string                `json:"config_version,omitempty"` // configVersion of that config, see workflow_migrate
+	CurrentStep        string                `json:"current_step"`
+	ActiveSteps        []string              `json:"active_steps,omitempty"` // branches in progress when CurrentStep is a parallel group
+	Steps              []WorkflowStep        `json:"steps"`
+	WaitingForApproval bool                  `json:"waiting_for_approval"`
+	Artifacts          map[string]Artifact   `json:"artifacts,omitempty"`
+	ArtifactHistory    map[string][]Artifact `json:"artifact_history,omitempty"` // superseded revisions, oldest first
+	IterationCount     int                   `json:"iteration_count"`
+	IterationFeedback  []string              `json:"iteration_feedback,omitempty"`
+	Rollbacks          []Rollback            `json:"rollbacks,omitempty"` // see workflow_reject
 	// PR tracking
-	PRNumber         int    `json:"pr_number,omitempty"`
-	LastCommentCheck string `json:"last_comment_check,omitempty"`
-	LastCommentCount int    `json:"last_comment_count,omitempty"`
-	CreatedAt        string `json:"created_at"`
-	UpdatedAt        string `json:"updated_at"`
+	PRNumber            int    `json:"pr_number,omitempty"`
+	LastCommentCheck    string `json:"last_comment_check,omitempty"`
+	LastCommentCount    int    `json:"last_comment_count,omitempty"`
+	LastCommentActivity string `json:"last_comment_activity,omitempty"` // set_pr or the last new comments; the quiet period runs from here
+	ReviewEscalatedAt   string `json:"review_escalated_at,omitempty"`   // when review_escalated was last sent, see max_wait
+
+	CreatedAt  string `json:"created_at"`
+	UpdatedAt  string `json:"updated_at"`
+	ArchivedAt string `json:"archived_at,omitempty"`
+	// Set on sub-workflows started by a parent's `uses:` step
+	ParentID   string `json:"parent_workflow_id,omitempty"`
+	ParentStep string `json:"parent_step,omitempty"`
+	// When a workflow_stale event was last sent, see stale_after
+	StaleNotifiedAt string `json:"stale_notified_at,omitempty"`
+
+	loadedData []byte // state file content when loaded, for conflict detection and journal patches
 }
 
 type WorkflowStep struct {
-	Name          string        `json:"name"`
-	Status        string        `json:"status"` // pending, in_progress, awaiting_approval, completed, blocked
-	NeedsApproval bool          `json:"needs_approval"`
-	Instructions  string        `json:"instructions"`
-	Metadata      *StepMetadata `json:"metadata,omitempty"`
+	Name                 string           `json:"name"`
+	Status               string           `json:"status"` // pending, in_progress, awaiting_approval, completed, blocked, skipped
+	NeedsApproval        bool             `json:"needs_approval"`
+	Instructions         string           `json:"instructions"`
+	Metadata             *StepMetadata    `json:"metadata,omitempty"`
+	OnSuccess            string           `json:"on_success,omitempty"`
+	OnFailure            string           `json:"on_failure,omitempty"`
+	Next                 []Transition     `json:"next,omitempty"`
+	Outcome              string           `json:"outcome,omitempty"` // success or failure, as reported by workflow_next
+	Uses                 string           `json:"uses,omitempty"`
+	ChildID              string           `json:"child_workflow_id,omitempty"` // sub-workflow started for this step
+	Parallel             []WorkflowStep   `json:"parallel,omitempty"`          // branches of a parallel group
+	Quorum               int              `json:"quorum,omitempty"`
+	ApprovalMode         string           `json:"approval_mode,omitempty"`
+	Approval             *ApprovalRequest `json:"approval,omitempty"` // pending human_token approval
+	Tools                []string         `json:"tools,omitempty"`
+	Attempts             []StepAttempt    `json:"attempts,omitempty"` // see workflow_history
+	RequiresCriteriaPass bool             `json:"requires_criteria_pass,omitempty"`
+	Checks               []Check          `json:"checks,omitempty"`
+	WarnAfter            string           `json:"warn_after,omitempty"`
+	Timeout              string           `json:"timeout,omitempty"`
+	OnTimeout            string           `json:"on_timeout,omitempty"`
+	Review               *ReviewConfig    `json:"review,omitempty"`
 }
 
 type WorkflowEvent struct {
@@ -99,11 +172,12 @@ type WorkflowEvent struct {
 	ApprovalPrompt string `json:"approval_prompt,omitempty"`
 	CanIterate     bool   `json:"can_iterate,omitempty"`
 	Timestamp      string `json:"timestamp"`
+	Seq            int64  `json:"seq,omitempty"`           // position in the workflow's event journal
+	ApprovalCode   string `json:"approval_code,omitempty"` // only on approval_code events, which aren't journaled
 }
 
-var state *WorkflowState
+var store *Store
 var config *WorkflowConfig
-var stateFile string
 var configFile string
 
 // Default approval prompts for each step
@@ -116,66 +190,143 @@ func main() {
 	// Determine file locations
 	cwd, _ := os.Getwd()
 	homeDir, _ := os.UserHomeDir()
-	stateFile = filepath.Join(homeDir, "state", "workflow_state.json")
+	stateDir := filepath.Join(homeDir, "state")
+	store = newStore(stateDir)
 	configFile = filepath.Join(cwd, "workflow.yaml")
 
-	// Load workflow configuration
+	// Events go to configured webhooks through the outbox
+	outbox = newOutbox(filepath.Join(stateDir, "outbox"))
+	eventSinks = append(eventSinks, outbox.Enqueue)
+	// and to MCP clients subscribed to the workflow's resources or tool list
+	eventSinks = append(eventSinks, statusResourceSink, toolListSink)
+
+	httpAddr := flag.String("http", "", "serve MCP (Streamable HTTP), the REST API and the dashboard on this address instead of MCP over stdio")
+	httpToken := flag.String("http-token", os.Getenv("WORKFLOW_HTTP_TOKEN"), "require this bearer token for HTTP requests")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	// Subcommands, e.g. `workflow-mcp validate`
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
+
+	// Load workflow configuration; it is reloaded when the file changes
+	configStamp = statConfig()
 	loadConfig()
 
-	// Try to load existing state
-	loadState()
+	// Import a pre-registry workflow_state.json, if any
+	if err := store.migrateLegacy(); err != nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: %v\n", err)
+	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	for scanner.Scan() {
-		line := scanner.Text()
-		var req Request
-		if err := json.Unmarshal([]byte(line), &req); err != nil {
-			continue
+	// Deliver webhook events in the background
+	go outbox.Run()
+	// and report overdue steps and stale workflows
+	go watchDeadlines()
+
+	if *httpAddr != "" {
+		if err := serveHTTP(*httpAddr, *httpToken); err != nil {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: %v\n", err)
+			os.Exit(1)
 		}
+		return
+	}
 
-		resp := handleRequest(req)
-		output, _ := json.Marshal(resp)
-		fmt.Println(string(output))
+	if err := serveStdio(os.Stdin, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: %v\n", err)
+		os.Exit(1)
 	}
+	// Approval codes aren't queued, so finish sending them before exiting
+	approvalDeliveries.Wait()
 }
 
+// loadConfig loads workflow.yaml, falling back to the built-in default
+// workflow when there is none. An invalid file is reported on stderr and
+// through workflow_config, and workflow_init refuses to start until it is
+// fixed rather than quietly running a different workflow. On a reload the
+// previous config stays in effect while the file is invalid.
 func loadConfig() {
-	config = &WorkflowConfig{
+	if config == nil {
+		config = defaultConfig()
+		configSource = "default"
+	}
+
+	loaded, report, err := readConfig(configFile)
+	configIssues = report
+	if errors.Is(err, os.ErrNotExist) {
+		config = defaultConfig() // Use default config
+		configSource = "default"
+		return
+	}
+	if err != nil {
+		configIssues.Errors = append(configIssues.Errors, ConfigIssue{File: configFile, Message: err.Error()})
+	}
+	for _, issue := range configIssues.Errors {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: error: %s\n", issue)
+	}
+	for _, issue := range configIssues.Warnings {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: warning: %s\n", issue)
+	}
+	if len(configIssues.Errors) == 0 {
+		config = loaded
+		configSource = "file"
+	}
+}
+
+func defaultConfig() *WorkflowConfig {
+	return &WorkflowConfig{
 		Name:        "default",
 		Description: "Default workflow",
 		Steps: []StepConfig{
 			{Name: "plan", NeedsApproval: true, AllowsIteration: true, ApprovalPrompt: defaultApprovalPrompts["plan"], Instructions: "Explore the codebase and design your approach. Include diagrams to visualize architecture."},
 			{Name: "criteria", NeedsApproval: true, AllowsIteration: true, ApprovalPrompt: defaultApprovalPrompts["criteria"], Instructions: "Define specific, measurable completion criteria."},
 			{Name: "execute", NeedsApproval: false, AllowsIteration: true, Instructions: "Implement the changes."},
-			{Name: "verify", NeedsApproval: false, AllowsIteration: true, Instructions: "Run tests and verify all criteria pass."},
+			{Name: "verify", NeedsApproval: false, AllowsIteration: true, RequiresCriteriaPass: true, OnFailure: "execute", Instructions: "Run checks with workflow_run_checks, and record the result of each other criterion with workflow_update_criterion."},
 			{Name: "pr", NeedsApproval: false, AllowsIteration: false, Instructions: "Create a pull request."},
-			{Name: "review", NeedsApproval: false, AllowsIteration: true, Instructions: "Monitor PR for comments, address feedback, auto-proceed after 5 mins quiet."},
+			{Name: "review", NeedsApproval: false, AllowsIteration: true, Instructions: "Monitor PR for comments, address feedback, auto-proceed after 5 mins quiet.", Review: &ReviewConfig{QuietPeriod: "5m", PollInterval: "60s", MaxWait: "2h"}},
 			{Name: "human_review", NeedsApproval: true, AllowsIteration: false, ApprovalPrompt: "PR reviewed. Ready to merge?", Instructions: "Present PR status, wait for human approval to merge."},
 			{Name: "complete", NeedsApproval: false, AllowsIteration: false, Instructions: "Summarize accomplishments."},
 		},
 	}
+}
 
-	data, err := os.ReadFile(configFile)
-	if err != nil {
-		return // Use default config
-	}
+// handleRequest dispatches a single JSON-RPC message. It returns nil for
+// notifications, which must not be answered.
+func handleRequest(sess *session, req Request) (resp *Response) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: panic handling %s: %v\n", req.Method, r)
+			resp = &Response{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Error:   rpcError(codeInternalError, "internal error: %v", r),
+			}
+		}
+	}()
 
-	var loaded WorkflowConfig
-	if err := yaml.Unmarshal(data, &loaded); err == nil && len(loaded.Steps) > 0 {
-		config = &loaded
+	if req.ID == nil {
+		// Notifications (e.g. notifications/initialized) get no response
+		return nil
+	}
+	if req.JSONRPC != "2.0" || req.Method == "" {
+		return &Response{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Error:   rpcError(codeInvalidRequest, "invalid request"),
+		}
 	}
-}
 
-func handleRequest(req Request) Response {
 	switch req.Method {
 	case "initialize":
-		return Response{
+		return &Response{
 			JSONRPC: "2.0",
 			ID:      req.ID,
 			Result: map[string]any{
-				"protocolVersion": "2024-11-05",
+				"protocolVersion": negotiateProtocolVersion(req.Params),
 				"capabilities": map[string]any{
-					"tools": map[string]any{},
+					"tools":     map[string]any{"listChanged": true},
+					"resources": map[string]any{"subscribe": true, "listChanged": true},
+					"prompts":   map[string]any{"listChanged": true},
 				},
 				"serverInfo": map[string]any{
 					"name":    "workflow-mcp",
@@ -184,165 +335,75 @@ func handleRequest(req Request) Response {
 			},
 		}
 
+	case "ping":
+		return &Response{
+			JSONRPC: "2.0",
+			ID:      req.ID,
+			Result:  map[string]any{},
+		}
+
+	case "resources/list":
+		resources, err := withLock(listResources)
+		if err != nil {
+			return &Response{JSONRPC: "2.0", ID: req.ID, Error: rpcError(codeInternalError, "%v", err)}
+		}
+		return &Response{JSONRPC: "2.0", ID: req.ID, Result: map[string]any{"resources": resources}}
+
+	case "resources/templates/list":
+		return &Response{JSONRPC: "2.0", ID: req.ID, Result: map[string]any{"resourceTemplates": resourceTemplates}}
+
+	case "resources/read", "resources/subscribe", "resources/unsubscribe":
+		var params struct {
+			URI string `json:"uri"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil || params.URI == "" {
+			return &Response{JSONRPC: "2.0", ID: req.ID, Error: rpcError(codeInvalidParams, "%s needs a uri", req.Method)}
+		}
+		if req.Method != "resources/read" {
+			if _, ok := parseResourceURI(params.URI); !ok {
+				return &Response{JSONRPC: "2.0", ID: req.ID, Error: rpcError(codeResourceNotFound, "unknown resource %s", params.URI)}
+			}
+			sess.subscribe(params.URI, req.Method == "resources/subscribe")
+			return &Response{JSONRPC: "2.0", ID: req.ID, Result: map[string]any{}}
+		}
+		contents, err := withLock(func() (map[string]any, error) { return readResource(params.URI) })
+		if err != nil {
+			rpcErr, ok := err.(*Error)
+			if !ok {
+				rpcErr = rpcError(codeInternalError, "%v", err)
+			}
+			return &Response{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+		}
+		return &Response{JSONRPC: "2.0", ID: req.ID, Result: map[string]any{"contents": []map[string]any{contents}}}
+
+	case "prompts/list":
+		prompts, _ := withLock(func() ([]map[string]any, error) { return listPrompts(config), nil })
+		return &Response{JSONRPC: "2.0", ID: req.ID, Result: map[string]any{"prompts": prompts}}
+
+	case "prompts/get":
+		var params struct {
+			Name      string            `json:"name"`
+			Arguments map[string]string `json:"arguments"`
+		}
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return &Response{JSONRPC: "2.0", ID: req.ID, Error: rpcError(codeInvalidParams, "invalid prompts/get params: %v", err)}
+		}
+		prompt, err := withLock(func() (map[string]any, error) { return getPrompt(config, params.Name, params.Arguments) })
+		if err != nil {
+			rpcErr, ok := err.(*Error)
+			if !ok {
+				rpcErr = rpcError(codeInternalError, "%v", err)
+			}
+			return &Response{JSONRPC: "2.0", ID: req.ID, Error: rpcErr}
+		}
+		return &Response{JSONRPC: "2.0", ID: req.ID, Result: prompt}
+
 	case "tools/list":
-		return Response{
+		return &Response{
 			JSONRPC: "2.0",
 			ID:      req.ID,
 			Result: map[string]any{
-				"tools": []map[string]any{
-					{
-						"name":        "workflow_init",
-						"description": "Initialize a new workflow with a task description. Returns workflow config and first step instructions.",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"task": map[string]any{
-									"type":        "string",
-									"description": "Description of the task",
-								},
-							},
-							"required": []string{"task"},
-						},
-					},
-					{
-						"name":        "workflow_status",
-						"description": "Get current workflow status, progress, and step instructions",
-						"inputSchema": map[string]any{
-							"type":       "object",
-							"properties": map[string]any{},
-						},
-					},
-					{
-						"name":        "workflow_step",
-						"description": "Update workflow step status",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"step": map[string]any{
-									"type":        "string",
-									"description": "Step name",
-								},
-								"status": map[string]any{
-									"type":        "string",
-									"description": "New status (in_progress, completed, blocked)",
-								},
-							},
-							"required": []string{"step", "status"},
-						},
-					},
-					{
-						"name":        "workflow_blocked",
-						"description": "Mark workflow as blocked due to external dependencies (not for approval gates)",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"reason": map[string]any{
-									"type":        "string",
-									"description": "Reason for blocking (external dependency)",
-								},
-							},
-							"required": []string{"reason"},
-						},
-					},
-					{
-						"name":        "workflow_next",
-						"description": "Request to move to the next step. If step requires approval, sets status to awaiting_approval. Otherwise moves to next step.",
-						"inputSchema": map[string]any{
-							"type":       "object",
-							"properties": map[string]any{},
-						},
-					},
-					{
-						"name":        "workflow_approve",
-						"description": "Approve the current step and move to the next step. Only works when step is awaiting_approval.",
-						"inputSchema": map[string]any{
-							"type":       "object",
-							"properties": map[string]any{},
-						},
-					},
-					{
-						"name":        "workflow_iterate",
-						"description": "Provide feedback and iterate on the current step. Keeps you on the same step to revise based on feedback.",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"feedback": map[string]any{
-									"type":        "string",
-									"description": "Feedback for iteration - what needs to change",
-								},
-							},
-							"required": []string{"feedback"},
-						},
-					},
-					{
-						"name":        "workflow_set_criteria",
-						"description": "Set verification criteria to be checked in the verify step",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"criteria": map[string]any{
-									"type":        "array",
-									"items":       map[string]any{"type": "string"},
-									"description": "List of verification criteria (tests to run, checks to perform)",
-								},
-							},
-							"required": []string{"criteria"},
-						},
-					},
-					{
-						"name":        "workflow_set_artifact",
-						"description": "Store an artifact (plan, criteria, test results, etc.) in the workflow state. Artifacts are keyed by type and can be retrieved by vibe apps.",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"type": map[string]any{
-									"type":        "string",
-									"description": "Artifact type (e.g., 'plan', 'criteria', 'pr', 'test_results')",
-								},
-								"content": map[string]any{
-									"description": "The artifact content (string, array, or object)",
-								},
-							},
-							"required": []string{"type", "content"},
-						},
-					},
-					{
-						"name":        "workflow_set_pr",
-						"description": "Set the PR details for tracking. Used by the review step to monitor comments.",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"pr_number": map[string]any{
-									"type":        "integer",
-									"description": "The pull request number",
-								},
-								"pr_url": map[string]any{
-									"type":        "string",
-									"description": "The pull request URL",
-								},
-								"branch": map[string]any{
-									"type":        "string",
-									"description": "The branch name (e.g., feature/todo-app)",
-								},
-							},
-							"required": []string{"pr_number", "pr_url", "branch"},
-						},
-					},
-					{
-						"name":        "workflow_check_pr",
-						"description": "Check if there are new PR comments since last check. Returns comment status and suggests next action.",
-						"inputSchema": map[string]any{
-							"type": "object",
-							"properties": map[string]any{
-								"comment_count": map[string]any{
-									"type":        "integer",
-									"description": "Current number of comments on the PR (from gh pr view)",
-								},
-							},
-							"required": []string{"comment_count"},
-						},
-					},
-				},
+				"tools": listTools(),
 			},
 		}
 
@@ -351,136 +412,189 @@ func handleRequest(req Request) Response {
 			Name      string         `json:"name"`
 			Arguments map[string]any `json:"arguments"`
 		}
-		json.Unmarshal(req.Params, &params)
+		if err := json.Unmarshal(req.Params, &params); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Error:   rpcError(codeInvalidParams, "invalid tools/call params: %v", err),
+			}
+		}
+		if params.Arguments == nil {
+			params.Arguments = map[string]any{}
+		}
 
-		result := handleToolCall(params.Name, params.Arguments)
-		return Response{
+		tool := findTool(params.Name)
+		if tool == nil {
+			return &Response{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Error:   rpcError(codeInvalidParams, "unknown tool: %s", params.Name),
+			}
+		}
+		if err := validateArgs(tool.InputSchema, params.Arguments); err != nil {
+			return &Response{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Error:   rpcError(codeInvalidParams, "%s: %v", tool.Name, err),
+			}
+		}
+
+		result, err := handleToolCall(params.Name, params.Arguments)
+		if err != nil {
+			text := err.Error()
+			if te, ok := err.(*ToolError); ok {
+				text = te.JSON()
+			} else {
+				text = toolError("%v", err).JSON()
+			}
+			return &Response{
+				JSONRPC: "2.0",
+				ID:      req.ID,
+				Result:  toolResult(text, true),
+			}
+		}
+		return &Response{
 			JSONRPC: "2.0",
 			ID:      req.ID,
-			Result: map[string]any{
-				"content": []map[string]any{
-					{
-						"type": "text",
-						"text": result,
-					},
-				},
-			},
+			Result:  toolResult(result, false),
 		}
 
 	default:
-		return Response{
+		return &Response{
 			JSONRPC: "2.0",
 			ID:      req.ID,
-			Result:  map[string]any{},
+			Error:   rpcError(codeMethodNotFound, "method not found: %s", req.Method),
 		}
 	}
 }
 
-func handleToolCall(name string, args map[string]any) string {
+// stepTools operate on the current step, so they descend into a running
+// sub-workflow.
+var stepTools = map[string]bool{
+	"workflow_step":               true,
+	"workflow_blocked":            true,
+	"workflow_next":               true,
+	"workflow_approve":            true,
+	"workflow_iterate":            true,
+	"workflow_reject":             true,
+	"workflow_set_criteria":       true,
+	"workflow_update_criterion":   true,
+	"workflow_run_checks":         true,
+	"workflow_ingest_test_report": true,
+	"workflow_set_plan":           true,
+	"workflow_set_artifact":       true,
+	"workflow_set_pr":             true,
+	"workflow_check_pr":           true,
+}
+
+func handleToolCall(name string, args map[string]any) (string, error) {
+	// Checks take the lock themselves, and not while the commands run
+	if name == "workflow_run_checks" {
+		return workflowRunChecks(stringArg(args, "workflow_id"), stringArg(args, "name"))
+	}
+
+	// Hold the store lock for the whole load-modify-save cycle so concurrent
+	// servers sharing the state directory can't interleave updates
+	unlock, err := store.Lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	reloadConfigIfChanged()
+
+	// Tools that don't operate on an existing workflow
 	switch name {
 	case "workflow_init":
-		return workflowInit(args["task"].(string))
+		return workflowInit(stringArg(args, "task"))
+	case "workflow_list":
+		return workflowList(boolArg(args, "include_archived"))
+	case "workflow_config":
+		return workflowConfig()
+	}
+
+	st, err := resolveWorkflow(stringArg(args, "workflow_id"))
+	if err != nil {
+		return "", err
+	}
+
+	// Step-level tools act on the running sub-workflow, if any
+	if stepTools[name] {
+		if st, err = activeLeaf(st); err != nil {
+			return "", err
+		}
+		if err := checkToolAllowed(st, name); err != nil {
+			return "", err
+		}
+	}
+
+	switch name {
+	case "workflow_switch":
+		return workflowSwitch(st)
+	case "workflow_archive":
+		return workflowArchive(st)
 	case "workflow_status":
-		return workflowStatus()
+		return workflowStatus(st)
 	case "workflow_step":
-		return workflowStep(args["step"].(string), args["status"].(string))
+		return workflowStep(st, stringArg(args, "step"), stringArg(args, "status"))
 	case "workflow_blocked":
-		return workflowBlocked(args["reason"].(string))
+		return workflowBlocked(st, stringArg(args, "reason"))
 	case "workflow_next":
-		return workflowNext()
+		return workflowNext(st, stringArg(args, "outcome"))
 	case "workflow_approve":
-		return workflowApprove()
+		return workflowApprove(st, stringArg(args, "approval_code"))
 	case "workflow_iterate":
-		feedback := ""
-		if f, ok := args["feedback"].(string); ok {
-			feedback = f
-		}
-		return workflowIterate(feedback)
+		return workflowIterate(st, stringArg(args, "feedback"))
+	case "workflow_reject":
+		return workflowReject(st, stringArg(args, "to"), stringArg(args, "reason"))
 	case "workflow_set_criteria":
-		criteria := []string{}
-		if c, ok := args["criteria"].([]any); ok {
-			for _, item := range c {
-				if s, ok := item.(string); ok {
-					criteria = append(criteria, s)
-				}
-			}
-		}
-		return workflowSetCriteria(criteria)
+		criteria, _ := args["criteria"].([]any)
+		return workflowSetCriteria(st, criteria)
+	case "workflow_update_criterion":
+		return workflowUpdateCriterion(st, stringArg(args, "id"), stringArg(args, "status"), stringArg(args, "evidence"))
+	case "workflow_ingest_test_report":
+		return workflowIngestTestReport(st, stringArg(args, "format"), stringArg(args, "path"), stringArg(args, "data"))
 	case "workflow_set_plan":
-		plan := ""
-		if p, ok := args["plan"].(string); ok {
-			plan = p
-		}
-		return workflowSetPlan(plan)
+		return workflowSetPlan(st, stringArg(args, "plan"))
 	case "workflow_set_artifact":
-		artifactType := ""
-		if t, ok := args["type"].(string); ok {
-			artifactType = t
-		}
-		content := args["content"]
-		return workflowSetArtifact(artifactType, content)
+		return workflowSetArtifact(st, stringArg(args, "type"), args["content"])
 	case "workflow_set_pr":
-		prNumber := 0
-		if n, ok := args["pr_number"].(float64); ok {
-			prNumber = int(n)
-		}
-		prURL := ""
-		if u, ok := args["pr_url"].(string); ok {
-			prURL = u
-		}
-		branch := ""
-		if b, ok := args["branch"].(string); ok {
-			branch = b
-		}
-		return workflowSetPR(prNumber, prURL, branch)
+		return workflowSetPR(st, intArg(args, "pr_number"), stringArg(args, "pr_url"), stringArg(args, "branch"))
 	case "workflow_check_pr":
-		commentCount := 0
-		if c, ok := args["comment_count"].(float64); ok {
-			commentCount = int(c)
-		}
-		return workflowCheckPR(commentCount)
+		return workflowCheckPR(st, intArg(args, "comment_count"))
+	case "workflow_get_artifact":
+		return workflowGetArtifact(st, stringArg(args, "type"), intArg(args, "revision"))
+	case "workflow_diff_artifact":
+		return workflowDiffArtifact(st, stringArg(args, "type"), intArg(args, "from_revision"), intArg(args, "to_revision"))
+	case "workflow_events":
+		return workflowEvents(st, int64(intArg(args, "since")), intArg(args, "limit"))
+	case "workflow_history":
+		return workflowHistory(st, stringArg(args, "step"))
+	case "workflow_replay":
+		return workflowReplay(st, int64(intArg(args, "until_seq")))
+	case "workflow_migrate":
+		return workflowMigrate(st, stringMapArg(args, "renames"), stringArg(args, "resume_at"), boolArg(args, "dry_run"))
 	default:
-		return `{"error": "unknown tool"}`
+		return "", toolError("unknown tool: %s", name)
 	}
 }
 
-func workflowInit(task string) string {
+// newWorkflowState builds a fresh workflow from cfg with its first step in
+// progress. It is not saved.
+func newWorkflowState(cfg *WorkflowConfig, task string) *WorkflowState {
 	// Build steps from config with metadata
-	steps := make([]WorkflowStep, len(config.Steps))
-	for i, sc := range config.Steps {
-		status := "pending"
-		if i == 0 {
-			status = "in_progress"
-		}
-
-		// Build metadata
-		metadata := &StepMetadata{
-			RequiresApproval: sc.NeedsApproval,
-			AllowsIteration:  sc.AllowsIteration,
-			ApprovalPrompt:   sc.ApprovalPrompt,
-		}
-
-		// Use default approval prompt if not specified
-		if metadata.RequiresApproval && metadata.ApprovalPrompt == "" {
-			if prompt, ok := defaultApprovalPrompts[sc.Name]; ok {
-				metadata.ApprovalPrompt = prompt
-			}
-		}
-
-		steps[i] = WorkflowStep{
-			Name:          sc.Name,
-			Status:        status,
-			NeedsApproval: sc.NeedsApproval,
-			Instructions:  sc.Instructions,
-			Metadata:      metadata,
-		}
+	steps := make([]WorkflowStep, len(cfg.Steps))
+	for i, sc := range cfg.Steps {
+		steps[i] = newWorkflowStep(sc)
 	}
+	startStep(&steps[0])
 
-	firstStep := config.Steps[0]
-	state = &WorkflowState{
+	st := &WorkflowState{
 		ID:                 fmt.Sprintf("wf_%d", time.Now().UnixNano()),
 		Task:               task,
-		CurrentStep:        firstStep.Name,
+		Workflow:           cfg.Name,
+		ConfigVersion:      configVersion(cfg),
+		CurrentStep:        cfg.Steps[0].Name,
 		Steps:              steps,
 		WaitingForApproval: false, // Not waiting yet - work must be done first
 		Artifacts:          make(map[string]Artifact),
@@ -489,51 +603,231 @@ func workflowInit(task string) string {
 		CreatedAt:          time.Now().UTC().Format(time.RFC3339),
 		UpdatedAt:          time.Now().UTC().Format(time.RFC3339),
 	}
-	saveState()
+	syncActiveSteps(st)
+	return st
+}
+
+// newWorkflowStep builds a pending step from its config.
+func newWorkflowStep(sc StepConfig) WorkflowStep {
+	// Build metadata
+	metadata := &StepMetadata{
+		RequiresApproval: sc.NeedsApproval,
+		AllowsIteration:  sc.AllowsIteration,
+		ApprovalPrompt:   sc.ApprovalPrompt,
+	}
+
+	// Use default approval prompt if not specified
+	if metadata.RequiresApproval && metadata.ApprovalPrompt == "" {
+		if prompt, ok := defaultApprovalPrompts[sc.Name]; ok {
+			metadata.ApprovalPrompt = prompt
+		}
+	}
+
+	step := WorkflowStep{
+		Name:                 sc.Name,
+		Status:               "pending",
+		NeedsApproval:        sc.NeedsApproval,
+		Instructions:         sc.Instructions,
+		Metadata:             metadata,
+		OnSuccess:            sc.OnSuccess,
+		OnFailure:            sc.OnFailure,
+		Next:                 sc.Next,
+		Uses:                 sc.Uses,
+		Quorum:               sc.Quorum,
+		ApprovalMode:         sc.ApprovalMode,
+		Tools:                sc.Tools,
+		RequiresCriteriaPass: sc.RequiresCriteriaPass,
+		Checks:               sc.Checks,
+		WarnAfter:            sc.WarnAfter,
+		Timeout:              sc.Timeout,
+		OnTimeout:            sc.OnTimeout,
+		Review:               sc.Review,
+	}
+	for _, branch := range sc.Parallel {
+		step.Parallel = append(step.Parallel, newWorkflowStep(branch))
+	}
+	return step
+}
+
+func workflowInit(task string) (string, error) {
+	if len(configIssues.Errors) > 0 {
+		return "", (&ToolError{
+			Message: fmt.Sprintf("%s is invalid", configFile),
+			Hint:    "fix the errors listed (also shown by workflow_config and `workflow-mcp validate`), then retry",
+		}).With("errors", issueStrings(configIssues.Errors))
+	}
+	firstStep := config.Steps[0]
+	st := newWorkflowState(config, task)
+
+	// The first step may itself run a sub-workflow
+	child, err := startSubWorkflow(st, 0)
+	if err != nil {
+		return "", err
+	}
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "init",
-		WorkflowID: state.ID,
+		WorkflowID: st.ID,
 		Step:       firstStep.Name,
 		Status:     "in_progress",
 		CanIterate: firstStep.AllowsIteration,
 		Timestamp:  time.Now().UTC().Format(time.RFC3339),
 	}
 
-	output, _ := json.MarshalIndent(map[string]any{
-		"workflow_id":          state.ID,
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+	if err := store.SetActive(st.ID); err != nil {
+		return "", err
+	}
+
+	result := map[string]any{
+		"workflow_id":          st.ID,
 		"task":                 task,
-		"current_step":         state.CurrentStep,
-		"waiting_for_approval": state.WaitingForApproval,
+		"current_step":         st.CurrentStep,
+		"waiting_for_approval": st.WaitingForApproval,
 		"requires_approval":    firstStep.NeedsApproval,
 		"allows_iteration":     firstStep.AllowsIteration,
 		"instructions":         firstStep.Instructions,
-		"steps":                state.Steps,
+		"steps":                st.Steps,
 		"event":                event,
-	}, "", "  ")
-	return string(output)
+	}
+	if child != nil {
+		result["sub_workflow"] = subWorkflowSummary(child)
+	}
+	groupResult(st, result)
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
 }
 
-func workflowStatus() string {
-	if state == nil {
-		return `{"error": "no workflow initialized", "hint": "call workflow_init first"}`
+// workflowProgress returns the percentage of completed (or skipped) steps,
+// counting a running parallel group by the share of its quorum reached.
+func workflowProgress(st *WorkflowState) float64 {
+	if len(st.Steps) == 0 {
+		return 0
 	}
-
-	// Calculate progress
-	completed := 0
-	for _, s := range state.Steps {
-		if s.Status == "completed" {
+	completed := 0.0
+	for _, s := range st.Steps {
+		if s.Status == "completed" || s.Status == "skipped" {
 			completed++
+		} else if done, needed := groupProgress(s); len(s.Parallel) > 0 && needed > 0 {
+			completed += float64(min(done, needed)) / float64(needed)
 		}
 	}
-	progress := float64(completed) / float64(len(state.Steps)) * 100
+	return completed / float64(len(st.Steps)) * 100
+}
+
+func workflowList(includeArchived bool) (string, error) {
+	workflows, err := store.List(includeArchived)
+	if err != nil {
+		return "", err
+	}
+	activeID := store.ActiveID()
+	now := time.Now()
+
+	summaries := []map[string]any{}
+	for _, st := range workflows {
+		summary := map[string]any{
+			"workflow_id":          st.ID,
+			"task":                 st.Task,
+			"current_step":         st.CurrentStep,
+			"waiting_for_approval": st.WaitingForApproval,
+			"progress":             fmt.Sprintf("%.0f%%", rolledUpProgress(st)),
+			"active":               st.ID == activeID,
+			"archived":             st.ArchivedAt != "",
+			"updated_at":           st.UpdatedAt,
+		}
+		if st.ParentID != "" {
+			summary["parent_workflow_id"] = st.ParentID
+		}
+		if isOverdue(st, now) {
+			summary["overdue"] = true
+		}
+		if idle := staleFor(st, now); idle > 0 {
+			summary["stale"] = true
+			summary["idle_for"] = formatDuration(idle)
+		}
+		summaries = append(summaries, summary)
+	}
+
+	output, _ := json.MarshalIndent(map[string]any{
+		"active_workflow_id": activeID,
+		"workflows":          summaries,
+	}, "", "  ")
+	return string(output), nil
+}
+
+func workflowSwitch(st *WorkflowState) (string, error) {
+	if err := store.SetActive(st.ID); err != nil {
+		return "", err
+	}
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "switched",
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	output, _ := json.MarshalIndent(map[string]any{
+		"switched":             true,
+		"workflow_id":          st.ID,
+		"task":                 st.Task,
+		"current_step":         st.CurrentStep,
+		"waiting_for_approval": st.WaitingForApproval,
+		"event":                event,
+	}, "", "  ")
+	return string(output), nil
+}
+
+func workflowArchive(st *WorkflowState) (string, error) {
+	wasActive := store.ActiveID() == st.ID
+	st.ArchivedAt = time.Now().UTC().Format(time.RFC3339)
+	st.UpdatedAt = st.ArchivedAt
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "archived",
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
+		Timestamp:  st.ArchivedAt,
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+	if err := store.Archive(st); err != nil {
+		return "", err
+	}
+
+	result := map[string]any{
+		"archived":    true,
+		"workflow_id": st.ID,
+		"event":       event,
+	}
+	if wasActive {
+		result["message"] = "Archived the active workflow. Call workflow_switch or workflow_init to continue."
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+func workflowStatus(st *WorkflowState) (string, error) {
+	progress := rolledUpProgress(st)
 
 	// Get current step info
 	var instructions string
 	var metadata *StepMetadata
-	for _, s := range state.Steps {
-		if s.Name == state.CurrentStep {
+	for _, s := range st.Steps {
+		if s.Name == st.CurrentStep {
 			instructions = s.Instructions
 			metadata = s.Metadata
 			break
@@ -541,23 +835,70 @@ func workflowStatus() string {
 	}
 
 	result := map[string]any{
-		"workflow_id":          state.ID,
-		"task":                 state.Task,
-		"current_step":         state.CurrentStep,
-		"waiting_for_approval": state.WaitingForApproval,
-		"artifacts":            state.Artifacts,
-		"iteration_count":      state.IterationCount,
-		"iteration_feedback":   state.IterationFeedback,
+		"workflow_id":          st.ID,
+		"task":                 st.Task,
+		"current_step":         st.CurrentStep,
+		"waiting_for_approval": st.WaitingForApproval,
+		"artifacts":            st.Artifacts,
+		"iteration_count":      st.IterationCount,
+		"iteration_feedback":   st.IterationFeedback,
 		"progress":             fmt.Sprintf("%.0f%%", progress),
 		"instructions":         instructions,
-		"steps":                state.Steps,
+		"steps":                st.Steps,
+	}
+
+	// Show where work is actually happening if a step runs a sub-workflow
+	if idx := stepIndex(st, st.CurrentStep); idx >= 0 && st.Steps[idx].ChildID != "" {
+		if child, err := store.Load(st.Steps[idx].ChildID); err == nil {
+			result["sub_workflow"] = subWorkflowSummary(child)
+		}
+	}
+	if st.ParentID != "" {
+		result["parent_workflow_id"] = st.ParentID
+		result["parent_step"] = st.ParentStep
+	}
+
+	groupResult(st, result)
+
+	if configOutdated(st) {
+		result["config_outdated"] = true
+		result["config_hint"] = "workflow.yaml changed since this workflow started; call workflow_migrate to apply the new steps"
+	}
+
+	if len(st.Rollbacks) > 0 {
+		result["rollbacks"] = st.Rollbacks
+	}
+	if criteria := loadCriteria(st); criteria != nil {
+		result["criteria"] = criteriaSummary(criteria)
+	}
+	if idx := stepIndex(st, st.CurrentStep); idx >= 0 && len(st.Steps[idx].Attempts) > 1 {
+		result["attempt"] = len(st.Steps[idx].Attempts)
+	}
+
+	now := time.Now()
+	result["elapsed"] = formatDuration(workflowElapsed(st, now))
+	result["overdue"] = isOverdue(st, now)
+	if timings := currentStepTimings(st, now); timings != nil {
+		result["step_timing"] = timings
+	}
+	if idle := staleFor(st, now); idle > 0 {
+		result["stale"] = true
+		result["idle_for"] = formatDuration(idle)
 	}
 
 	// Add PR tracking if set
-	if state.PRNumber > 0 {
-		result["pr_number"] = state.PRNumber
-		result["last_comment_check"] = state.LastCommentCheck
-		result["last_comment_count"] = state.LastCommentCount
+	if st.PRNumber > 0 {
+		result["pr_number"] = st.PRNumber
+		result["last_comment_check"] = st.LastCommentCheck
+		result["last_comment_count"] = st.LastCommentCount
+		result["last_comment_activity"] = st.LastCommentActivity
+	}
+
+	if idx := stepIndex(st, st.CurrentStep); idx >= 0 && st.Steps[idx].ApprovalMode == approvalModeHumanToken {
+		result["approval_mode"] = approvalModeHumanToken
+		if req := st.Steps[idx].Approval; req != nil {
+			result["approval_request_id"] = req.ID
+		}
 	}
 
 	if metadata != nil {
@@ -569,109 +910,263 @@ func workflowStatus() string {
 	}
 
 	output, _ := json.MarshalIndent(result, "", "  ")
-	return string(output)
+	return string(output), nil
 }
 
-func workflowStep(step, status string) string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
+func workflowStep(st *WorkflowState, step, status string) (string, error) {
+	if group, branch := findBranch(st, step); branch != nil {
+		return workflowBranchStep(st, group, branch, status)
+	}
+	idx := stepIndex(st, step)
+	if idx < 0 {
+		return "", toolError("step %s not found", step).With("workflow_id", st.ID)
+	}
+	if err := checkApprovalGates(st, idx, status); err != nil {
+		return "", err
+	}
+	// Completing a step, or starting one past it, has to meet its criteria
+	var err error
+	switch status {
+	case "completed", "skipped":
+		err = checkCriteriaGate(st, &st.Steps[idx])
+	case "in_progress":
+		err = checkCriteriaGates(st, stepIndex(st, st.CurrentStep), idx)
+	}
+	if err != nil {
+		return "", err
 	}
 
 	// Update step status
-	for i, s := range state.Steps {
-		if s.Name == step {
-			state.Steps[i].Status = status
-			if status == "in_progress" {
-				state.CurrentStep = step
-				state.WaitingForApproval = false
-				state.IterationCount = 0
-				state.IterationFeedback = []string{}
-			}
-			break
-		}
+	st.Steps[idx].Status = status
+	switch status {
+	case "completed", "skipped":
+		endAttempt(&st.Steps[idx], status)
+	case "in_progress":
+		startStep(&st.Steps[idx])
+		st.CurrentStep = step
+		syncActiveSteps(st)
+		st.WaitingForApproval = false
+		st.IterationCount = 0
+		st.IterationFeedback = []string{}
 	}
-	state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	saveState()
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "step_update",
-		WorkflowID: state.ID,
+		WorkflowID: st.ID,
 		Step:       step,
 		Status:     status,
 		Timestamp:  time.Now().UTC().Format(time.RFC3339),
 	}
 
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
 	output, _ := json.MarshalIndent(map[string]any{
 		"updated":              true,
-		"current_step":         state.CurrentStep,
-		"waiting_for_approval": state.WaitingForApproval,
+		"current_step":         st.CurrentStep,
+		"waiting_for_approval": st.WaitingForApproval,
 		"event":                event,
 	}, "", "  ")
-	return string(output)
+	return string(output), nil
 }
 
-func workflowBlocked(reason string) string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
-	}
-
+func workflowBlocked(st *WorkflowState, reason string) (string, error) {
 	// Mark current step as blocked
-	for i, s := range state.Steps {
-		if s.Name == state.CurrentStep {
-			state.Steps[i].Status = "blocked"
+	for i, s := range st.Steps {
+		if s.Name == st.CurrentStep {
+			st.Steps[i].Status = "blocked"
 			break
 		}
 	}
-	state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	saveState()
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "blocked",
-		WorkflowID: state.ID,
-		Step:       state.CurrentStep,
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
 		Status:     "blocked",
 		Message:    reason,
 		Timestamp:  time.Now().UTC().Format(time.RFC3339),
 	}
 
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
 	output, _ := json.MarshalIndent(map[string]any{
 		"blocked":                  true,
-		"step":                     state.CurrentStep,
+		"step":                     st.CurrentStep,
 		"reason":                   reason,
 		"needs_human_intervention": true,
 		"event":                    event,
 	}, "", "  ")
-	return string(output)
+	return string(output), nil
 }
 
-func workflowNext() string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
+// workflowUnblock puts a blocked current step (or blocked branches of the
+// current parallel group) back in progress.
+func workflowUnblock(st *WorkflowState, note string) (string, error) {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return "", toolError("current step not found").With("current_step", st.CurrentStep)
+	}
+	step := &st.Steps[idx]
+	unblocked := []string{}
+	if step.Status == "blocked" {
+		step.Status = "in_progress"
+		unblocked = append(unblocked, step.Name)
+	}
+	for i := range step.Parallel {
+		if step.Parallel[i].Status == "blocked" {
+			step.Parallel[i].Status = "in_progress"
+			unblocked = append(unblocked, step.Parallel[i].Name)
+		}
+	}
+	if len(unblocked) == 0 {
+		return "", toolError("step %s is not blocked", step.Name).With("status", step.Status)
+	}
+	syncActiveSteps(st)
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "unblocked",
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
+		Status:     "in_progress",
+		Message:    note,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	output, _ := json.MarshalIndent(map[string]any{
+		"unblocked":    unblocked,
+		"current_step": st.CurrentStep,
+		"event":        event,
+	}, "", "  ")
+	return string(output), nil
+}
+
+// workflowReset moves the workflow to step to, discarding the progress of
+// that step and everything after it. Steps jumped over going forward are
+// skipped.
+func workflowReset(st *WorkflowState, to string) (string, error) {
+	idx := stepIndex(st, to)
+	if idx < 0 {
+		return "", toolError("step %s not found", to).With("workflow_id", st.ID)
+	}
+	previous := st.CurrentStep
+	if err := checkCriteriaGates(st, stepIndex(st, previous), idx); err != nil {
+		return "", err
+	}
+	for i := 0; i < idx; i++ {
+		if gate := st.Steps[i]; gate.ApprovalMode == approvalModeHumanToken && gate.Status != "completed" && gate.Status != "skipped" {
+			return "", (&ToolError{
+				Message: fmt.Sprintf("can't reset past step %s: it needs approval from a human", gate.Name),
+				Hint:    "approve it with `workflow-mcp approve --code <code>` first",
+			}).With("step", gate.Name).With("status", gate.Status)
+		}
+	}
+	for i := 0; i < idx; i++ {
+		if st.Steps[i].Status != "completed" && st.Steps[i].Status != "skipped" {
+			st.Steps[i].Status = "skipped"
+			endAttempt(&st.Steps[i], "skipped")
+		}
+	}
+	child, err := restartFrom(st, idx, "reset")
+	if err != nil {
+		return "", err
+	}
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "reset",
+		WorkflowID: st.ID,
+		Step:       previous,
+		NextStep:   to,
+		Status:     "in_progress",
+		Message:    fmt.Sprintf("reset from %s to %s", previous, to),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	result := groupResult(st, map[string]any{
+		"previous_step": previous,
+		"current_step":  st.CurrentStep,
+		"event":         event,
+	})
+	if child != nil {
+		result["sub_workflow"] = subWorkflowSummary(child)
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+func workflowNext(st *WorkflowState, outcome string) (string, error) {
+	if outcome == "" {
+		outcome = outcomeSuccess
 	}
 
 	// Find current step
 	var currentStepIdx int = -1
 	var currentStep *WorkflowStep
-	for i, s := range state.Steps {
-		if s.Name == state.CurrentStep {
+	for i, s := range st.Steps {
+		if s.Name == st.CurrentStep {
 			currentStepIdx = i
-			currentStep = &state.Steps[i]
+			currentStep = &st.Steps[i]
 			break
 		}
 	}
 
 	if currentStep == nil {
-		return `{"error": "current step not found"}`
+		return "", toolError("current step not found").With("current_step", st.CurrentStep)
+	}
+
+	// A parallel group only moves on once enough branches have completed
+	if completed, needed := groupProgress(*currentStep); completed < needed {
+		return "", (&ToolError{
+			Message: fmt.Sprintf("parallel group %s has %d of %d required branches completed", currentStep.Name, completed, needed),
+			Hint:    "complete branches with workflow_step(step, \"completed\"); the group moves on by itself when enough have",
+		}).With("active_steps", st.ActiveSteps)
+	}
+
+	if err := checkOutcomeGate(st, currentStepIdx, outcome); err != nil {
+		return "", err
+	}
+
+	// A step that needs approval only completes through approveStep, so
+	// calling workflow_next again while it waits (or is blocked) must not
+	// move past it
+	if currentStep.NeedsApproval && currentStep.Status != "in_progress" {
+		return "", checkApprovalGates(st, currentStepIdx, "completed")
 	}
 
 	// If step requires approval and is in_progress, set to awaiting_approval
 	if currentStep.NeedsApproval && currentStep.Status == "in_progress" {
-		state.Steps[currentStepIdx].Status = "awaiting_approval"
-		state.WaitingForApproval = true
-		state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-		saveState()
+		st.Steps[currentStepIdx].Status = "awaiting_approval"
+		st.Steps[currentStepIdx].Outcome = outcome // applied when approved
+		st.WaitingForApproval = true
+		st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+		currentAttempt(currentStep).AwaitingApprovalAt = st.UpdatedAt
+
+		code := ""
+		if currentStep.ApprovalMode == approvalModeHumanToken {
+			var err error
+			if code, err = newApprovalRequest(currentStep); err != nil {
+				return "", err
+			}
+		}
 
 		approvalPrompt := ""
 		canIterate := false
@@ -683,7 +1178,7 @@ func workflowNext() string {
 		event := WorkflowEvent{
 			Event:          "workflow",
 			Type:           "awaiting_approval",
-			WorkflowID:     state.ID,
+			WorkflowID:     st.ID,
 			Step:           currentStep.Name,
 			Status:         "awaiting_approval",
 			ApprovalPrompt: approvalPrompt,
@@ -691,7 +1186,11 @@ func workflowNext() string {
 			Timestamp:      time.Now().UTC().Format(time.RFC3339),
 		}
 
-		output, _ := json.MarshalIndent(map[string]any{
+		if err := store.Commit(st, &event); err != nil {
+			return "", err
+		}
+
+		result := map[string]any{
 			"status":               "awaiting_approval",
 			"step":                 currentStep.Name,
 			"waiting_for_approval": true,
@@ -699,155 +1198,214 @@ func workflowNext() string {
 			"can_iterate":          canIterate,
 			"message":              "STOP AND WAIT for user approval. Do not proceed until user calls /workflow-approve or /workflow-iterate",
 			"event":                event,
-		}, "", "  ")
-		return string(output)
-	}
+		}
+		if code != "" {
+			deliverApprovalCode(st, currentStep, code)
+			result["approval_mode"] = approvalModeHumanToken
+			result["message"] = "STOP AND WAIT. This step must be approved by a human: a one-time approval code was sent to them out of band. Pass it to workflow_approve as approval_code only when they give it to you. Never try to approve it yourself."
+		}
 
-	// Step doesn't require approval or is already approved - move to next
-	previousStep := currentStep.Name
-	state.Steps[currentStepIdx].Status = "completed"
+		output, _ := json.MarshalIndent(result, "", "  ")
+		return string(output), nil
+	}
 
-	var nextStep string
-	var instructions string
-	var requiresApproval bool
-	var allowsIteration bool
-
-	if currentStepIdx+1 < len(state.Steps) {
-		nextStep = state.Steps[currentStepIdx+1].Name
-		state.Steps[currentStepIdx+1].Status = "in_progress"
-		state.CurrentStep = nextStep
-		instructions = state.Steps[currentStepIdx+1].Instructions
-		if state.Steps[currentStepIdx+1].Metadata != nil {
-			requiresApproval = state.Steps[currentStepIdx+1].Metadata.RequiresApproval
-			allowsIteration = state.Steps[currentStepIdx+1].Metadata.AllowsIteration
-		}
-	} else {
-		state.CurrentStep = "done"
+	// Step doesn't require approval - move to next
+	tr, err := completeStep(st, currentStepIdx, outcome)
+	if err != nil {
+		return "", err
+	}
+	nextStep, instructions, requiresApproval, allowsIteration := stepInfo(st, tr.Next)
+	child, err := startSubWorkflow(st, 0)
+	if err != nil {
+		return "", err
 	}
 
 	// Reset iteration tracking for new step
-	state.WaitingForApproval = false
-	state.IterationCount = 0
-	state.IterationFeedback = []string{}
-	state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	saveState()
+	st.WaitingForApproval = false
+	st.IterationCount = 0
+	st.IterationFeedback = []string{}
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "step_complete",
-		WorkflowID: state.ID,
-		Step:       previousStep,
+		WorkflowID: st.ID,
+		Step:       tr.Previous,
 		NextStep:   nextStep,
 		Status:     "in_progress",
+		Message:    tr.message(),
 		Timestamp:  time.Now().UTC().Format(time.RFC3339),
 	}
 
-	output, _ := json.MarshalIndent(map[string]any{
-		"previous_step":        previousStep,
-		"current_step":         state.CurrentStep,
-		"waiting_for_approval": state.WaitingForApproval,
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	result := groupResult(st, transitionResult(tr, map[string]any{
+		"previous_step":        tr.Previous,
+		"current_step":         st.CurrentStep,
+		"waiting_for_approval": st.WaitingForApproval,
 		"requires_approval":    requiresApproval,
 		"allows_iteration":     allowsIteration,
 		"instructions":         instructions,
 		"event":                event,
-	}, "", "  ")
-	return string(output)
+	}))
+	if err := subWorkflowResult(st, child, result); err != nil {
+		return "", err
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
 }
 
-func workflowApprove() string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
+// stepInfo returns what the caller needs to start working on step name
+// (empty values once the workflow is done).
+func stepInfo(st *WorkflowState, name string) (nextStep, instructions string, requiresApproval, allowsIteration bool) {
+	idx := stepIndex(st, name)
+	if idx < 0 {
+		return "", "", false, false
 	}
+	step := st.Steps[idx]
+	if step.Metadata != nil {
+		requiresApproval = step.Metadata.RequiresApproval
+		allowsIteration = step.Metadata.AllowsIteration
+	}
+	return step.Name, step.Instructions, requiresApproval, allowsIteration
+}
 
+// transitionResult adds branching details to a next/approve response.
+func transitionResult(tr stepTransition, result map[string]any) map[string]any {
+	if tr.Via != "sequential" {
+		result["transition"] = tr.Via
+	}
+	if len(tr.Skipped) > 0 {
+		result["skipped_steps"] = tr.Skipped
+	}
+	if len(tr.Reset) > 0 {
+		result["reset_steps"] = tr.Reset
+	}
+	return result
+}
+
+func workflowApprove(st *WorkflowState, code string) (string, error) {
+	return approveStep(st, code, "")
+}
+
+// approveStep approves the current step. via says where it was approved
+// (e.g. "cli"; "" for the agent). human_token steps need the approval code
+// or a signed token whatever the caller: an agent with a shell can run the
+// CLI too.
+func approveStep(st *WorkflowState, code, via string) (string, error) {
 	// Find current step
 	var currentStepIdx int = -1
 	var currentStep *WorkflowStep
-	for i, s := range state.Steps {
-		if s.Name == state.CurrentStep {
+	for i, s := range st.Steps {
+		if s.Name == st.CurrentStep {
 			currentStepIdx = i
-			currentStep = &state.Steps[i]
+			currentStep = &st.Steps[i]
 			break
 		}
 	}
 
 	if currentStep == nil {
-		return `{"error": "current step not found"}`
+		return "", toolError("current step not found").With("current_step", st.CurrentStep)
 	}
 
 	if currentStep.Status != "awaiting_approval" {
-		return `{"error": "step is not awaiting approval", "hint": "call workflow_next first to request approval", "current_status": "` + currentStep.Status + `"}`
+		return "", (&ToolError{
+			Message: "step is not awaiting approval",
+			Hint:    "call workflow_next first to request approval",
+		}).With("current_status", currentStep.Status)
 	}
 
-	// Mark current step as completed and move to next
-	previousStep := currentStep.Name
-	state.Steps[currentStepIdx].Status = "completed"
+	// Criteria may have been marked failing since approval was requested
+	if err := checkOutcomeGate(st, currentStepIdx, currentStep.Outcome); err != nil {
+		return "", err
+	}
 
-	var nextStep string
-	var instructions string
-	var requiresApproval bool
-	var allowsIteration bool
-
-	if currentStepIdx+1 < len(state.Steps) {
-		nextStep = state.Steps[currentStepIdx+1].Name
-		state.Steps[currentStepIdx+1].Status = "in_progress"
-		state.CurrentStep = nextStep
-		instructions = state.Steps[currentStepIdx+1].Instructions
-		if state.Steps[currentStepIdx+1].Metadata != nil {
-			requiresApproval = state.Steps[currentStepIdx+1].Metadata.RequiresApproval
-			allowsIteration = state.Steps[currentStepIdx+1].Metadata.AllowsIteration
+	approvedWith := via
+	if currentStep.ApprovalMode == approvalModeHumanToken {
+		var ok bool
+		if approvedWith, ok = verifyApproval(st, currentStep, code); !ok {
+			return "", rejectApproval(st, currentStep, code)
 		}
-	} else {
-		state.CurrentStep = "done"
+	}
+	currentStep.Approval = nil
+	approver := approvedWith
+	if approver == "" {
+		approver = "agent"
+	}
+	currentAttempt(currentStep).ApprovedBy = approver
+
+	// Mark current step as completed and move to next, using the outcome
+	// reported when approval was requested
+	outcome := currentStep.Outcome
+	if outcome == "" {
+		outcome = outcomeSuccess
+	}
+	tr, err := completeStep(st, currentStepIdx, outcome)
+	if err != nil {
+		return "", err
+	}
+	nextStep, instructions, requiresApproval, allowsIteration := stepInfo(st, tr.Next)
+	child, err := startSubWorkflow(st, 0)
+	if err != nil {
+		return "", err
 	}
 
 	// Reset iteration tracking
-	state.WaitingForApproval = false
-	state.IterationCount = 0
-	state.IterationFeedback = []string{}
-	state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	saveState()
+	st.WaitingForApproval = false
+	st.IterationCount = 0
+	st.IterationFeedback = []string{}
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "approved",
-		WorkflowID: state.ID,
-		Step:       previousStep,
+		WorkflowID: st.ID,
+		Step:       tr.Previous,
 		NextStep:   nextStep,
 		Status:     "approved",
+		Message:    joinMessages(approvalMessage(approvedWith), tr.message()),
 		Timestamp:  time.Now().UTC().Format(time.RFC3339),
 	}
 
-	output, _ := json.MarshalIndent(map[string]any{
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	result := groupResult(st, transitionResult(tr, map[string]any{
 		"approved":             true,
-		"previous_step":        previousStep,
-		"current_step":         state.CurrentStep,
+		"previous_step":        tr.Previous,
+		"current_step":         st.CurrentStep,
 		"waiting_for_approval": false,
 		"requires_approval":    requiresApproval,
 		"allows_iteration":     allowsIteration,
 		"instructions":         instructions,
 		"event":                event,
-	}, "", "  ")
-	return string(output)
-}
-
-func workflowIterate(feedback string) string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
+	}))
+	if err := subWorkflowResult(st, child, result); err != nil {
+		return "", err
 	}
 
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+func workflowIterate(st *WorkflowState, feedback string) (string, error) {
 	// Find current step
 	var currentStepIdx int = -1
 	var currentStep *WorkflowStep
-	for i, s := range state.Steps {
-		if s.Name == state.CurrentStep {
+	for i, s := range st.Steps {
+		if s.Name == st.CurrentStep {
 			currentStepIdx = i
-			currentStep = &state.Steps[i]
+			currentStep = &st.Steps[i]
 			break
 		}
 	}
 
 	if currentStep == nil {
-		return `{"error": "current step not found"}`
+		return "", toolError("current step not found").With("current_step", st.CurrentStep)
 	}
 
 	// Check if iteration is allowed
@@ -857,25 +1415,28 @@ func workflowIterate(feedback string) string {
 	}
 
 	if !allowsIteration {
-		return `{"error": "iteration not allowed on this step", "step": "` + currentStep.Name + `"}`
+		return "", toolError("iteration not allowed on this step").With("step", currentStep.Name)
 	}
 
 	// Increment iteration count and store feedback
-	state.IterationCount++
+	st.IterationCount++
 	if feedback != "" {
-		state.IterationFeedback = append(state.IterationFeedback, feedback)
+		st.IterationFeedback = append(st.IterationFeedback, feedback)
 	}
 
 	// Set status back to in_progress
-	state.Steps[currentStepIdx].Status = "in_progress"
-	state.WaitingForApproval = false
-	state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
-	saveState()
+	st.Steps[currentStepIdx].Status = "in_progress"
+	st.Steps[currentStepIdx].Approval = nil
+	attempt := currentAttempt(&st.Steps[currentStepIdx])
+	attempt.Iterations = append(attempt.Iterations, Iteration{Feedback: feedback, Timestamp: time.Now().UTC().Format(time.RFC3339)})
+	attempt.AwaitingApprovalAt = ""
+	st.WaitingForApproval = false
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "iteration",
-		WorkflowID: state.ID,
+		WorkflowID: st.ID,
 		Step:       currentStep.Name,
 		Status:     "in_progress",
 		Message:    feedback,
@@ -883,83 +1444,75 @@ func workflowIterate(feedback string) string {
 		Timestamp:  time.Now().UTC().Format(time.RFC3339),
 	}
 
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
 	output, _ := json.MarshalIndent(map[string]any{
-		"iterated":           true,
-		"step":               currentStep.Name,
-		"iteration_count":    state.IterationCount,
-		"feedback":           feedback,
-		"all_feedback":       state.IterationFeedback,
-		"instructions":       currentStep.Instructions,
-		"message":            "Revise your work based on the feedback, then call workflow_next when ready for approval",
-		"event":              event,
+		"iterated":        true,
+		"step":            currentStep.Name,
+		"iteration_count": st.IterationCount,
+		"feedback":        feedback,
+		"all_feedback":    st.IterationFeedback,
+		"instructions":    currentStep.Instructions,
+		"message":         "Revise your work based on the feedback, then call workflow_next when ready for approval",
+		"event":           event,
 	}, "", "  ")
-	return string(output)
+	return string(output), nil
 }
 
-func workflowSetCriteria(criteria []string) string {
+func workflowSetCriteria(st *WorkflowState, criteria []any) (string, error) {
+	if criteria == nil {
+		criteria = []any{}
+	}
 	// Legacy function - now uses artifacts internally
-	return workflowSetArtifact("criteria", criteria)
+	return workflowSetArtifact(st, "criteria", criteria)
 }
 
-func workflowSetPlan(plan string) string {
+func workflowSetPlan(st *WorkflowState, plan string) (string, error) {
 	// Legacy function - now uses artifacts internally
-	return workflowSetArtifact("plan", plan)
+	return workflowSetArtifact(st, "plan", plan)
 }
 
-func workflowSetArtifact(artifactType string, content any) string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
+func workflowSetArtifact(st *WorkflowState, artifactType string, content any) (string, error) {
+	if artifactType == "criteria" {
+		content = normalizeCriteria(st, content)
 	}
-
-	if state.Artifacts == nil {
-		state.Artifacts = make(map[string]Artifact)
-	}
-
-	now := time.Now().UTC().Format(time.RFC3339)
-	artifact := Artifact{
-		Type:      artifactType,
-		Content:   content,
-		Step:      state.CurrentStep,
-		CreatedAt: now,
-		UpdatedAt: now,
-	}
-
-	// If artifact already exists, preserve CreatedAt
-	if existing, ok := state.Artifacts[artifactType]; ok {
-		artifact.CreatedAt = existing.CreatedAt
-	}
-
-	state.Artifacts[artifactType] = artifact
-	state.UpdatedAt = now
-	saveState()
+	artifact, added := putArtifact(st, artifactType, content)
+	now := artifact.UpdatedAt
+	st.UpdatedAt = now
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "artifact_set",
-		WorkflowID: state.ID,
-		Step:       state.CurrentStep,
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
 		Message:    fmt.Sprintf("Artifact '%s' has been set", artifactType),
 		Timestamp:  now,
 	}
 
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+	artifactUpdated(st, artifactType, added)
+
 	output, _ := json.MarshalIndent(map[string]any{
 		"artifact_set": true,
 		"type":         artifactType,
-		"step":         state.CurrentStep,
+		"step":         st.CurrentStep,
+		"revision":     artifact.Revision,
 		"event":        event,
 	}, "", "  ")
-	return string(output)
+	return string(output), nil
 }
 
-func workflowSetPR(prNumber int, prURL string, branch string) string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
-	}
-
-	state.PRNumber = prNumber
-	state.LastCommentCheck = time.Now().UTC().Format(time.RFC3339)
-	state.LastCommentCount = 0
-	state.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+func workflowSetPR(st *WorkflowState, prNumber int, prURL string, branch string) (string, error) {
+	st.PRNumber = prNumber
+	st.LastCommentCheck = time.Now().UTC().Format(time.RFC3339)
+	st.LastCommentActivity = st.LastCommentCheck
+	st.LastCommentCount = 0
+	st.ReviewEscalatedAt = ""
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
 
 	// Also store as artifact
 	prArtifact := map[string]any{
@@ -967,27 +1520,22 @@ func workflowSetPR(prNumber int, prURL string, branch string) string {
 		"url":    prURL,
 		"branch": branch,
 	}
-	if state.Artifacts == nil {
-		state.Artifacts = make(map[string]Artifact)
-	}
-	state.Artifacts["pr"] = Artifact{
-		Type:      "pr",
-		Content:   prArtifact,
-		Step:      state.CurrentStep,
-		CreatedAt: state.UpdatedAt,
-	}
-
-	saveState()
+	_, added := putArtifact(st, "pr", prArtifact)
 
 	event := WorkflowEvent{
 		Event:      "workflow",
 		Type:       "pr_set",
-		WorkflowID: state.ID,
-		Step:       state.CurrentStep,
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
 		Message:    fmt.Sprintf("PR #%d set for tracking", prNumber),
-		Timestamp:  state.UpdatedAt,
+		Timestamp:  st.UpdatedAt,
 	}
 
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+	artifactUpdated(st, "pr", added)
+
 	output, _ := json.MarshalIndent(map[string]any{
 		"pr_set":    true,
 		"pr_number": prNumber,
@@ -995,93 +1543,5 @@ func workflowSetPR(prNumber int, prURL string, branch string) string {
 		"branch":    branch,
 		"event":     event,
 	}, "", "  ")
-	return string(output)
-}
-
-func workflowCheckPR(commentCount int) string {
-	if state == nil {
-		return `{"error": "no workflow initialized"}`
-	}
-
-	if state.PRNumber == 0 {
-		return `{"error": "no PR set", "hint": "call workflow_set_pr first"}`
-	}
-
-	now := time.Now().UTC()
-	lastCheck, _ := time.Parse(time.RFC3339, state.LastCommentCheck)
-	timeSinceLastCheck := now.Sub(lastCheck)
-
-	hasNewComments := commentCount > state.LastCommentCount
-	humanReviewTimeout := 5 * time.Minute // Move to human review after 5 mins quiet
-
-	// Update tracking
-	previousCount := state.LastCommentCount
-	state.LastCommentCheck = now.Format(time.RFC3339)
-
-	// Reset quiet timer if new comments
-	if hasNewComments {
-		state.LastCommentCount = commentCount
-	}
-
-	state.UpdatedAt = now.Format(time.RFC3339)
-	saveState()
-
-	var action string
-	var message string
-
-	if hasNewComments {
-		newCount := commentCount - previousCount
-		action = "address_comments"
-		message = fmt.Sprintf("Found %d new comment(s). Address the feedback, then check again.", newCount)
-	} else if timeSinceLastCheck >= humanReviewTimeout {
-		// No new comments for 5 mins - ready for human review
-		action = "ready_for_human_review"
-		message = "No new comments for 5 minutes. Ready for human review - call workflow_next()."
-	} else {
-		// Still within timeout window, keep waiting
-		waitSeconds := 60 // Check every minute
-		minsRemaining := int((humanReviewTimeout - timeSinceLastCheck).Minutes())
-		action = "wait"
-		message = fmt.Sprintf("No new comments. ~%d min(s) until human review. Wait %d seconds then check again.", minsRemaining, waitSeconds)
-	}
-
-	event := WorkflowEvent{
-		Event:      "workflow",
-		Type:       "pr_check",
-		WorkflowID: state.ID,
-		Step:       state.CurrentStep,
-		Message:    message,
-		Timestamp:  now.Format(time.RFC3339),
-	}
-
-	output, _ := json.MarshalIndent(map[string]any{
-		"pr_number":           state.PRNumber,
-		"comment_count":       commentCount,
-		"previous_count":      previousCount,
-		"has_new_comments":    hasNewComments,
-		"seconds_since_check": int(timeSinceLastCheck.Seconds()),
-		"mins_until_human_review": int((humanReviewTimeout - timeSinceLastCheck).Minutes()),
-		"action":              action,
-		"message":             message,
-		"event":               event,
-	}, "", "  ")
-	return string(output)
-}
-
-func saveState() {
-	if state == nil {
-		return
-	}
-	os.MkdirAll(filepath.Dir(stateFile), 0755)
-	data, _ := json.MarshalIndent(state, "", "  ")
-	os.WriteFile(stateFile, data, 0644)
-}
-
-func loadState() {
-	data, err := os.ReadFile(stateFile)
-	if err != nil {
-		return
-	}
-	state = &WorkflowState{}
-	json.Unmarshal(data, state)
+	return string(output), nil
 }
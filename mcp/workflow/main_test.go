@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testServer points the server at a fresh state directory and project
+// directory, as main does, with workflow.yaml holding yaml (none for "", so
+// the built-in workflow runs). files are name, content pairs written to the
+// project directory first. The globals are restored when t ends.
+func testServer(t *testing.T, yaml string, files ...string) string {
+	t.Helper()
+	savedStore, savedConfig, savedFile, savedStamp := store, config, configFile, configStamp
+	savedSource, savedIssues, savedOutbox, savedIndex := configSource, configIssues, outbox, deadlineIndex
+	t.Cleanup(func() {
+		store, config, configFile, configStamp = savedStore, savedConfig, savedFile, savedStamp
+		configSource, configIssues, outbox, deadlineIndex = savedSource, savedIssues, savedOutbox, savedIndex
+	})
+
+	dir := t.TempDir()
+	store = newStore(filepath.Join(dir, "state"))
+	outbox = nil
+	deadlineIndex = map[string]deadlineEntry{}
+	config = nil
+	configFile = filepath.Join(dir, "workflow.yaml")
+	if yaml != "" {
+		files = append(files, "workflow.yaml", yaml)
+	}
+	for i := 0; i+1 < len(files); i += 2 {
+		if err := os.WriteFile(filepath.Join(dir, files[i]), []byte(files[i+1]), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	configStamp = statConfig()
+	loadConfig()
+	if len(configIssues.Errors) > 0 {
+		t.Fatalf("invalid test config: %v", issueStrings(configIssues.Errors))
+	}
+	return dir
+}
+
+// callTool runs a tool call as tools/call does and decodes its result.
+func callTool(t *testing.T, name, args string) (map[string]any, error) {
+	t.Helper()
+	parsed := map[string]any{}
+	if args != "" {
+		if err := json.Unmarshal([]byte(args), &parsed); err != nil {
+			t.Fatalf("%s: bad test arguments %s: %v", name, args, err)
+		}
+	}
+	output, err := handleToolCall(name, parsed)
+	if err != nil {
+		return nil, err
+	}
+	result := map[string]any{}
+	if err := json.Unmarshal([]byte(output), &result); err != nil {
+		t.Fatalf("%s: result isn't a JSON object: %s", name, output)
+	}
+	return result, nil
+}
+
+// toolCall is one call of a scripted session: the tool, its JSON
+// arguments, and either a substring of the error it must fail with or
+// fields its result must have (compared in their %v form). A field can be
+// a dotted path into nested objects, e.g. "parent.current_step".
+type toolCall struct {
+	tool    string
+	args    string
+	wantErr string
+	want    map[string]any
+}
+
+// runCalls makes calls in order, stopping at the first that doesn't go as
+// expected.
+func runCalls(t *testing.T, calls []toolCall) {
+	t.Helper()
+	for i, c := range calls {
+		result, err := callTool(t, c.tool, c.args)
+		where := fmt.Sprintf("call %d (%s %s)", i+1, c.tool, c.args)
+		if c.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), c.wantErr) {
+				t.Fatalf("%s: error = %v, want it to mention %q", where, err, c.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: error = %v", where, err)
+		}
+		for k, want := range c.want {
+			if got := fmt.Sprint(resultField(result, k)); got != fmt.Sprint(want) {
+				t.Fatalf("%s: %s = %s, want %v", where, k, got, want)
+			}
+		}
+	}
+}
+
+// resultField looks up a dotted path in a decoded tool result, or returns
+// nil.
+func resultField(result map[string]any, path string) any {
+	var v any = result
+	for _, key := range strings.Split(path, ".") {
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return nil
+		}
+		v = obj[key]
+	}
+	return v
+}
+
+// activeState loads the active workflow.
+func activeState(t *testing.T) *WorkflowState {
+	t.Helper()
+	st, err := store.Load(store.ActiveID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+// stepStatuses lists st's steps as name=status.
+func stepStatuses(st *WorkflowState) string {
+	parts := make([]string, len(st.Steps))
+	for i, s := range st.Steps {
+		parts[i] = s.Name + "=" + s.Status
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config reloading and migration. workflow.yaml is re-read whenever it
+// changes (checked before every tool call), and each workflow records the
+// version of the config it was built from. Workflows started earlier keep
+// their copy of the steps until workflow_migrate moves them onto the new
+// step list.
+
+// fileStamp identifies a version of the config file on disk.
+type fileStamp struct {
+	exists  bool
+	size    int64
+	modTime time.Time
+}
+
+// equal reports whether a and b are the same version of a file.
+func (a fileStamp) equal(b fileStamp) bool {
+	return a.exists == b.exists && a.size == b.size && a.modTime.Equal(b.modTime)
+}
+
+var configStamp fileStamp
+
+func statConfig() fileStamp {
+	info, err := os.Stat(configFile)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{exists: true, size: info.Size(), modTime: info.ModTime()}
+}
+
+// reloadConfigIfChanged reloads workflow.yaml if it changed since it was
+// last loaded.
+func reloadConfigIfChanged() {
+	stamp := statConfig()
+	if stamp.equal(configStamp) {
+		return
+	}
+	configStamp = stamp
+
+	before := configVersion(config)
+	loadConfig()
+	if after := configVersion(config); after != before {
+		fmt.Fprintf(os.Stderr, "workflow-mcp: reloaded %s (config version %s)\n", configFile, after)
+		broadcast("notifications/prompts/list_changed", nil) // prompts are generated from the steps
+	}
+}
+
+// configVersion is a short hash of a workflow's name and steps. Webhooks and
+// named sub-workflows don't affect it.
+func configVersion(cfg *WorkflowConfig) string {
+	data, _ := json.Marshal(struct {
+		Name  string       `json:"name"`
+		Steps []StepConfig `json:"steps"`
+	}{cfg.Name, cfg.Steps})
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:6])
+}
+
+// workflowConfigFor returns the current config st should follow: the main
+// config, or for a sub-workflow whatever its parent step's `uses:` names.
+func workflowConfigFor(st *WorkflowState) (*WorkflowConfig, error) {
+	if st.ParentID == "" {
+		return config, nil
+	}
+	parent, err := store.Load(st.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	idx := stepIndex(parent, st.ParentStep)
+	if idx < 0 || parent.Steps[idx].Uses == "" {
+		return nil, toolError("parent step %s of %s no longer runs a sub-workflow", st.ParentStep, st.ParentID)
+	}
+	return loadSubWorkflow(parent.Steps[idx].Uses)
+}
+
+// configOutdated reports whether st was built from a different version of
+// its config than the one now loaded.
+func configOutdated(st *WorkflowState) bool {
+	cfg, err := workflowConfigFor(st)
+	if err != nil {
+		return false
+	}
+	return st.ConfigVersion != configVersion(cfg)
+}
+
+// stepDefinition strips the runtime fields from a step, leaving what came
+// from the config.
+func stepDefinition(s WorkflowStep) WorkflowStep {
+	s.Status, s.Outcome, s.ChildID = "", "", ""
+	s.Attempts = nil
+	branches := make([]WorkflowStep, len(s.Parallel))
+	for i, b := range s.Parallel {
+		branches[i] = stepDefinition(b)
+	}
+	s.Parallel = branches
+	return s
+}
+
+type migrationReport struct {
+	Added   []string          `json:"added"`
+	Removed []string          `json:"removed"`
+	Renamed map[string]string `json:"renamed"`
+	Changed []string          `json:"changed"`
+}
+
+func (r migrationReport) empty() bool {
+	return len(r.Added)+len(r.Removed)+len(r.Renamed)+len(r.Changed) == 0
+}
+
+func (r migrationReport) summary() string {
+	parts := []string{}
+	if len(r.Added) > 0 {
+		parts = append(parts, "added "+strings.Join(r.Added, ", "))
+	}
+	if len(r.Removed) > 0 {
+		parts = append(parts, "removed "+strings.Join(r.Removed, ", "))
+	}
+	if len(r.Renamed) > 0 {
+		renames := []string{}
+		for from, to := range r.Renamed {
+			renames = append(renames, from+" -> "+to)
+		}
+		sort.Strings(renames)
+		parts = append(parts, "renamed "+strings.Join(renames, ", "))
+	}
+	if len(r.Changed) > 0 {
+		parts = append(parts, "changed "+strings.Join(r.Changed, ", "))
+	}
+	if len(parts) == 0 {
+		return "no step changes"
+	}
+	return strings.Join(parts, "; ")
+}
+
+// migrateSteps maps st's steps onto cfg's. Steps are matched by name, then
+// by renames, then an unmatched old step and an unmatched new step at the
+// same position are taken to be a rename. Matched steps keep their status.
+func migrateSteps(st *WorkflowState, cfg *WorkflowConfig, renames map[string]string, resumeAt string) ([]WorkflowStep, string, migrationReport, error) {
+	report := migrationReport{Added: []string{}, Removed: []string{}, Renamed: map[string]string{}, Changed: []string{}}
+
+	newIdx := map[string]int{}
+	for i, sc := range cfg.Steps {
+		newIdx[sc.Name] = i
+	}
+	for from, to := range renames {
+		if stepIndex(st, from) < 0 {
+			return nil, "", report, toolError("renames: %s is not a step of workflow %s", from, st.ID)
+		}
+		if _, ok := newIdx[to]; !ok {
+			return nil, "", report, toolError("renames: %s is not a step in the new config", to)
+		}
+	}
+
+	// source[j] is the index of the old step new step j continues, or -1
+	source := make([]int, len(cfg.Steps))
+	used := make([]bool, len(st.Steps))
+	for j, sc := range cfg.Steps {
+		source[j] = -1
+		for from, to := range renames {
+			if to == sc.Name {
+				source[j] = stepIndex(st, from)
+			}
+		}
+		if source[j] < 0 {
+			if i := stepIndex(st, sc.Name); i >= 0 && renames[sc.Name] == "" {
+				source[j] = i
+			}
+		}
+		if source[j] >= 0 {
+			used[source[j]] = true
+		}
+	}
+	for j, sc := range cfg.Steps {
+		if source[j] < 0 && j < len(st.Steps) && !used[j] {
+			if _, kept := newIdx[st.Steps[j].Name]; !kept {
+				source[j] = j
+				used[j] = true
+			}
+		}
+		if source[j] < 0 {
+			report.Added = append(report.Added, sc.Name)
+		} else if old := st.Steps[source[j]].Name; old != sc.Name {
+			report.Renamed[old] = sc.Name
+		}
+	}
+	for i, s := range st.Steps {
+		if !used[i] {
+			report.Removed = append(report.Removed, s.Name)
+		}
+	}
+
+	// Work out where the migrated workflow continues
+	current := st.CurrentStep
+	if current != doneStep {
+		current = ""
+		for j := range cfg.Steps {
+			if source[j] >= 0 && st.Steps[source[j]].Name == st.CurrentStep {
+				current = cfg.Steps[j].Name
+			}
+		}
+		switch {
+		case current == "" && resumeAt == "":
+			return nil, "", report, (&ToolError{
+				Message: fmt.Sprintf("current step %s was removed from the config", st.CurrentStep),
+				Hint:    "pass resume_at with the step to continue from, or renames if it was renamed",
+			}).With("removed", report.Removed).With("added", report.Added)
+		case current != "" && resumeAt != "":
+			return nil, "", report, toolError("current step %s still exists as %s; resume_at is only used when it was removed", st.CurrentStep, current)
+		case current == "":
+			if _, ok := newIdx[resumeAt]; !ok {
+				return nil, "", report, toolError("resume_at: %s is not a step in the new config", resumeAt)
+			}
+			current = resumeAt
+		}
+	}
+	currentIdx := len(cfg.Steps)
+	if i, ok := newIdx[current]; ok {
+		currentIdx = i
+	}
+
+	if err := checkMigratedGates(st, cfg, source, currentIdx); err != nil {
+		return nil, "", report, err
+	}
+
+	steps := make([]WorkflowStep, len(cfg.Steps))
+	for j, sc := range cfg.Steps {
+		step := newWorkflowStep(sc)
+		if source[j] < 0 {
+			if j < currentIdx {
+				step.Status = "skipped" // added before the point the workflow has reached
+			}
+			if j == currentIdx {
+				startStep(&step)
+			}
+			steps[j] = step
+			continue
+		}
+
+		old := st.Steps[source[j]]
+		if !reflect.DeepEqual(stepDefinition(old), stepDefinition(step)) && old.Name == sc.Name {
+			report.Changed = append(report.Changed, sc.Name)
+		}
+		step.Status = old.Status
+		step.Outcome = old.Outcome
+		step.Attempts = old.Attempts
+		if old.Uses == step.Uses {
+			step.ChildID = old.ChildID
+		}
+		for k := range step.Parallel {
+			for _, ob := range old.Parallel {
+				if ob.Name == step.Parallel[k].Name {
+					step.Parallel[k].Status = ob.Status
+					step.Parallel[k].Outcome = ob.Outcome
+					step.Parallel[k].Attempts = ob.Attempts
+				}
+			}
+			if step.Parallel[k].Status == "pending" && step.Status == "in_progress" {
+				step.Parallel[k].Status = "in_progress" // new branch of the running group
+			}
+		}
+		if j == currentIdx && step.Status == "awaiting_approval" && !step.NeedsApproval {
+			step.Status = "in_progress" // the approval gate was removed
+		}
+		if j == currentIdx && step.Status == "pending" {
+			startStep(&step)
+		}
+		steps[j] = step
+	}
+	return steps, current, report, nil
+}
+
+// checkMigratedGates refuses a migration that would get the workflow past a
+// human_token gate nobody has approved: one awaiting approval, or one at or
+// before the step the workflow continues from. Such a gate has to stay in
+// the new config, with approval_mode: human_token, and not behind the point
+// the workflow resumes at. source is migrateSteps' mapping of new steps to
+// old ones, and currentIdx is where the migrated workflow continues.
+func checkMigratedGates(st *WorkflowState, cfg *WorkflowConfig, source []int, currentIdx int) error {
+	// Where the workflow continues, as an index into the old steps: the
+	// step the new current step continues, or else the first later one that
+	// continues an old step
+	resume := len(st.Steps)
+	for j := currentIdx; j < len(cfg.Steps); j++ {
+		if source[j] >= 0 {
+			resume = source[j]
+			break
+		}
+	}
+
+	for i, old := range st.Steps {
+		if !old.NeedsApproval || old.ApprovalMode != approvalModeHumanToken || old.Status == "completed" || old.Status == "skipped" {
+			continue
+		}
+		if old.Status != "awaiting_approval" && i > resume {
+			continue
+		}
+		j := -1
+		for k := range source {
+			if source[k] == i {
+				j = k
+			}
+		}
+		var problem string
+		switch {
+		case j < 0:
+			problem = "removes it"
+		case !cfg.Steps[j].NeedsApproval || cfg.Steps[j].ApprovalMode != approvalModeHumanToken:
+			problem = "changes its approval mode"
+		case j < currentIdx:
+			problem = "continues past it"
+		default:
+			continue
+		}
+		return (&ToolError{
+			Message: fmt.Sprintf("step %s is a human_token approval gate that hasn't been approved, and the migration %s", old.Name, problem),
+			Hint:    "approve the step first with its approval code, or keep it in the config as a human_token step the workflow hasn't got past",
+		}).With("step", old.Name).With("status", old.Status)
+	}
+	return nil
+}
+
+func workflowMigrate(st *WorkflowState, renames map[string]string, resumeAt string, dryRun bool) (string, error) {
+	if len(configIssues.Errors) > 0 && st.ParentID == "" {
+		return "", (&ToolError{
+			Message: fmt.Sprintf("%s is invalid", configFile),
+			Hint:    "fix the config before migrating workflows onto it",
+		}).With("errors", issueStrings(configIssues.Errors))
+	}
+	cfg, err := workflowConfigFor(st)
+	if err != nil {
+		return "", err
+	}
+	fromVersion, toVersion := st.ConfigVersion, configVersion(cfg)
+
+	steps, current, report, err := migrateSteps(st, cfg, renames, resumeAt)
+	if err != nil {
+		return "", err
+	}
+
+	result := map[string]any{
+		"workflow_id":  st.ID,
+		"dry_run":      dryRun,
+		"from_version": fromVersion,
+		"to_version":   toVersion,
+		"added":        report.Added,
+		"removed":      report.Removed,
+		"renamed":      report.Renamed,
+		"changed":      report.Changed,
+		"current_step": current,
+	}
+	if fromVersion == toVersion && report.empty() {
+		result["up_to_date"] = true
+		output, _ := json.MarshalIndent(result, "", "  ")
+		return string(output), nil
+	}
+	if dryRun {
+		output, _ := json.MarshalIndent(result, "", "  ")
+		return string(output), nil
+	}
+
+	st.Steps = steps
+	st.CurrentStep = current
+	st.Workflow = cfg.Name
+	st.ConfigVersion = toVersion
+	if idx := stepIndex(st, current); idx >= 0 {
+		st.WaitingForApproval = st.Steps[idx].Status == "awaiting_approval"
+	}
+	syncActiveSteps(st)
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "migrated",
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
+		Message:    fmt.Sprintf("config %s -> %s: %s", fromVersion, toVersion, report.summary()),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	result["steps"] = st.Steps
+	result["event"] = event
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
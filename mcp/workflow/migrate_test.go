@@ -0,0 +1,283 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// stepConfigs builds a config with a step per name; a trailing "!" marks a
+// step with needs_approval, and "!!" one with approval_mode: human_token too.
+func stepConfigs(names ...string) *WorkflowConfig {
+	cfg := &WorkflowConfig{Name: "test"}
+	for _, name := range names {
+		sc := StepConfig{Name: strings.TrimRight(name, "!"), Instructions: "do " + name}
+		sc.NeedsApproval = strings.HasSuffix(name, "!")
+		if strings.HasSuffix(name, "!!") {
+			sc.ApprovalMode = approvalModeHumanToken
+		}
+		cfg.Steps = append(cfg.Steps, sc)
+	}
+	return cfg
+}
+
+func TestMigrateSteps(t *testing.T) {
+	tests := []struct {
+		name     string
+		old      []string // step names, see stepConfigs
+		statuses []string
+		current  string
+		new      []string
+		renames  map[string]string
+		resumeAt string
+
+		want        []string // name=status of each migrated step
+		wantCurrent string
+		wantReport  migrationReport
+		wantErr     string
+	}{
+		{
+			name:     "unchanged",
+			old:      []string{"a", "b", "c"},
+			statuses: []string{"completed", "in_progress", "pending"},
+			current:  "b",
+			new:      []string{"a", "b", "c"},
+			want:     []string{"a=completed", "b=in_progress", "c=pending"},
+		},
+		{
+			name:       "step added before the current one is skipped",
+			old:        []string{"a", "b", "c"},
+			statuses:   []string{"completed", "in_progress", "pending"},
+			current:    "b",
+			new:        []string{"a", "x", "b", "c"},
+			want:       []string{"a=completed", "x=skipped", "b=in_progress", "c=pending"},
+			wantReport: migrationReport{Added: []string{"x"}},
+		},
+		{
+			name:       "step added after the current one is pending",
+			old:        []string{"a", "b", "c"},
+			statuses:   []string{"completed", "in_progress", "pending"},
+			current:    "b",
+			new:        []string{"a", "b", "c", "d"},
+			want:       []string{"a=completed", "b=in_progress", "c=pending", "d=pending"},
+			wantReport: migrationReport{Added: []string{"d"}},
+		},
+		{
+			name:       "later step removed",
+			old:        []string{"a", "b", "c"},
+			statuses:   []string{"completed", "in_progress", "pending"},
+			current:    "b",
+			new:        []string{"a", "b"},
+			want:       []string{"a=completed", "b=in_progress"},
+			wantReport: migrationReport{Removed: []string{"c"}},
+		},
+		{
+			name:        "step at the same position is a rename",
+			old:         []string{"a", "b", "c"},
+			statuses:    []string{"completed", "in_progress", "pending"},
+			current:     "b",
+			new:         []string{"a", "build", "c"},
+			want:        []string{"a=completed", "build=in_progress", "c=pending"},
+			wantCurrent: "build",
+			wantReport:  migrationReport{Renamed: map[string]string{"b": "build"}},
+		},
+		{
+			name:        "explicit rename",
+			old:         []string{"a", "b", "c"},
+			statuses:    []string{"completed", "completed", "in_progress"},
+			current:     "c",
+			new:         []string{"x", "a", "b", "check"},
+			renames:     map[string]string{"c": "check"},
+			want:        []string{"x=skipped", "a=completed", "b=completed", "check=in_progress"},
+			wantCurrent: "check",
+			wantReport:  migrationReport{Added: []string{"x"}, Renamed: map[string]string{"c": "check"}},
+		},
+		{
+			name:     "current step removed",
+			old:      []string{"a", "b", "c"},
+			statuses: []string{"completed", "in_progress", "pending"},
+			current:  "b",
+			new:      []string{"a", "c", "x"},
+			wantErr:  "current step b was removed",
+		},
+		{
+			name:        "current step removed, resuming at another",
+			old:         []string{"a", "b", "c"},
+			statuses:    []string{"completed", "in_progress", "pending"},
+			current:     "b",
+			new:         []string{"a", "c", "x"},
+			resumeAt:    "c",
+			want:        []string{"a=completed", "c=in_progress", "x=pending"},
+			wantCurrent: "c",
+			wantReport:  migrationReport{Added: []string{"x"}, Removed: []string{"b"}},
+		},
+		{
+			name:     "resume_at while the current step exists",
+			old:      []string{"a", "b"},
+			statuses: []string{"completed", "in_progress"},
+			current:  "b",
+			new:      []string{"a", "b"},
+			resumeAt: "a",
+			wantErr:  "resume_at is only used when it was removed",
+		},
+		{
+			name:     "resume_at names no new step",
+			old:      []string{"a", "b"},
+			statuses: []string{"completed", "in_progress"},
+			current:  "b",
+			new:      []string{"c", "a"},
+			resumeAt: "z",
+			wantErr:  "resume_at: z is not a step in the new config",
+		},
+		{
+			name:     "rename from an unknown step",
+			old:      []string{"a", "b"},
+			statuses: []string{"completed", "in_progress"},
+			current:  "b",
+			new:      []string{"a", "b"},
+			renames:  map[string]string{"z": "b"},
+			wantErr:  "renames: z is not a step of workflow",
+		},
+		{
+			name:     "rename to an unknown step",
+			old:      []string{"a", "b"},
+			statuses: []string{"completed", "in_progress"},
+			current:  "b",
+			new:      []string{"a", "b"},
+			renames:  map[string]string{"a": "z"},
+			wantErr:  "renames: z is not a step in the new config",
+		},
+		{
+			name:       "approval gate removed from the waiting step",
+			old:        []string{"a", "b!"},
+			statuses:   []string{"completed", "awaiting_approval"},
+			current:    "b",
+			new:        []string{"a", "b"},
+			want:       []string{"a=completed", "b=in_progress"},
+			wantReport: migrationReport{Changed: []string{"b"}},
+		},
+		{
+			name:     "human_token gate removed from the waiting step",
+			old:      []string{"a", "b!!", "c"},
+			statuses: []string{"completed", "awaiting_approval", "pending"},
+			current:  "b",
+			new:      []string{"a", "b", "c"},
+			wantErr:  "step b is a human_token approval gate that hasn't been approved, and the migration changes its approval mode",
+		},
+		{
+			name:     "human_token gate turned into an agent gate",
+			old:      []string{"a", "b!!", "c"},
+			statuses: []string{"completed", "awaiting_approval", "pending"},
+			current:  "b",
+			new:      []string{"a", "b!", "c"},
+			wantErr:  "changes its approval mode",
+		},
+		{
+			name:     "waiting human_token gate dropped, resuming past it",
+			old:      []string{"a", "b!!", "c"},
+			statuses: []string{"completed", "awaiting_approval", "pending"},
+			current:  "b",
+			new:      []string{"a", "c"},
+			resumeAt: "c",
+			wantErr:  "step b is a human_token approval gate that hasn't been approved, and the migration removes it",
+		},
+		{
+			name:     "resume_at past a pending human_token gate",
+			old:      []string{"a", "b", "gate!!", "c"},
+			statuses: []string{"completed", "in_progress", "pending", "pending"},
+			current:  "b",
+			new:      []string{"a", "gate!!", "c"},
+			resumeAt: "c",
+			wantErr:  "step gate is a human_token approval gate that hasn't been approved, and the migration continues past it",
+		},
+		{
+			name:     "resume_at past a removed human_token gate",
+			old:      []string{"a", "b", "gate!!", "c"},
+			statuses: []string{"completed", "in_progress", "pending", "pending"},
+			current:  "b",
+			new:      []string{"a", "c"},
+			resumeAt: "c",
+			wantErr:  "step gate is a human_token approval gate that hasn't been approved, and the migration removes it",
+		},
+		{
+			name:       "human_token gate after the current step removed",
+			old:        []string{"a", "b", "gate!!"},
+			statuses:   []string{"completed", "in_progress", "pending"},
+			current:    "b",
+			new:        []string{"a", "b"},
+			want:       []string{"a=completed", "b=in_progress"},
+			wantReport: migrationReport{Removed: []string{"gate"}},
+		},
+		{
+			name:       "waiting human_token gate kept",
+			old:        []string{"a", "b!!"},
+			statuses:   []string{"completed", "awaiting_approval"},
+			current:    "b",
+			new:        []string{"x", "a", "b!!"},
+			want:       []string{"x=skipped", "a=completed", "b=awaiting_approval"},
+			wantReport: migrationReport{Added: []string{"x"}},
+		},
+		{
+			name:        "finished workflow",
+			old:         []string{"a", "b"},
+			statuses:    []string{"completed", "completed"},
+			current:     doneStep,
+			new:         []string{"a", "b", "c"},
+			want:        []string{"a=completed", "b=completed", "c=skipped"},
+			wantCurrent: doneStep,
+			wantReport:  migrationReport{Added: []string{"c"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			st := newWorkflowState(stepConfigs(tt.old...), "migrate")
+			for i, status := range tt.statuses {
+				st.Steps[i].Status = status
+			}
+			st.CurrentStep = tt.current
+
+			steps, current, report, err := migrateSteps(st, stepConfigs(tt.new...), tt.renames, tt.resumeAt)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("migrateSteps() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("migrateSteps() error = %v", err)
+			}
+
+			got := make([]string, len(steps))
+			for i, s := range steps {
+				got[i] = s.Name + "=" + s.Status
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("steps = %v, want %v", got, tt.want)
+			}
+			wantCurrent := tt.wantCurrent
+			if wantCurrent == "" {
+				wantCurrent = tt.current
+			}
+			if current != wantCurrent {
+				t.Errorf("current = %s, want %s", current, wantCurrent)
+			}
+
+			want := migrationReport{Added: []string{}, Removed: []string{}, Renamed: map[string]string{}, Changed: []string{}}
+			if tt.wantReport.Added != nil {
+				want.Added = tt.wantReport.Added
+			}
+			if tt.wantReport.Removed != nil {
+				want.Removed = tt.wantReport.Removed
+			}
+			if tt.wantReport.Renamed != nil {
+				want.Renamed = tt.wantReport.Renamed
+			}
+			if tt.wantReport.Changed != nil {
+				want.Changed = tt.wantReport.Changed
+			}
+			if !reflect.DeepEqual(report, want) {
+				t.Errorf("report = %+v, want %+v", report, want)
+			}
+		})
+	}
+}
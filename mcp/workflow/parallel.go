@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Parallel groups: a step with `parallel:` has branches that are all in
+// progress at once. CurrentStep stays the group's name and ActiveSteps lists
+// the branches still open. workflow_step completes branches one by one, and
+// once the quorum (all branches by default) has completed the group joins
+// and the workflow moves on as if workflow_next had been called on it.
+
+// startStep puts step, and every branch if it is a parallel group, in
+// progress, starting a new attempt of each.
+func startStep(step *WorkflowStep) {
+	step.Status = "in_progress"
+	step.Outcome = ""
+	beginAttempt(step)
+	for i := range step.Parallel {
+		step.Parallel[i].Status = "in_progress"
+		step.Parallel[i].Outcome = ""
+		beginAttempt(&step.Parallel[i])
+	}
+}
+
+// resetBranches puts a group's branches back to pending, for a step reset
+// by a backward transition.
+func resetBranches(step *WorkflowStep) {
+	for i := range step.Parallel {
+		step.Parallel[i].Status = "pending"
+		step.Parallel[i].Outcome = ""
+	}
+}
+
+// joinBranches closes a completing group: branches that didn't finish
+// before the quorum was reached are skipped.
+func joinBranches(step *WorkflowStep) []string {
+	var skipped []string
+	for i := range step.Parallel {
+		if step.Parallel[i].Status != "completed" {
+			endAttempt(&step.Parallel[i], "skipped")
+			step.Parallel[i].Status = "skipped"
+			skipped = append(skipped, step.Parallel[i].Name)
+		}
+	}
+	return skipped
+}
+
+// syncActiveSteps recomputes ActiveSteps after the current step changed.
+func syncActiveSteps(st *WorkflowState) {
+	st.ActiveSteps = nil
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return
+	}
+	for _, b := range st.Steps[idx].Parallel {
+		if b.Status == "in_progress" || b.Status == "blocked" {
+			st.ActiveSteps = append(st.ActiveSteps, b.Name)
+		}
+	}
+}
+
+// groupProgress returns how many of a group's branches have completed and
+// how many must complete for it to join.
+func groupProgress(step WorkflowStep) (completed, needed int) {
+	for _, b := range step.Parallel {
+		if b.Status == "completed" {
+			completed++
+		}
+	}
+	needed = len(step.Parallel)
+	if step.Quorum > 0 && step.Quorum < needed {
+		needed = step.Quorum
+	}
+	return completed, needed
+}
+
+// findBranch looks up a branch of the current step, if it is a parallel
+// group.
+func findBranch(st *WorkflowState, name string) (group, branch *WorkflowStep) {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return nil, nil
+	}
+	group = &st.Steps[idx]
+	for i := range group.Parallel {
+		if group.Parallel[i].Name == name {
+			return group, &group.Parallel[i]
+		}
+	}
+	return nil, nil
+}
+
+// workflowBranchStep is workflow_step for a branch of the current parallel
+// group. Completing the branch that reaches the quorum joins the group.
+func workflowBranchStep(st *WorkflowState, group, branch *WorkflowStep, status string) (string, error) {
+	if group.Status != "in_progress" {
+		return "", toolError("parallel group %s is not in progress", group.Name).With("group_status", group.Status)
+	}
+	if status == "completed" {
+		if err := checkCriteriaGate(st, branch); err != nil {
+			return "", err
+		}
+	}
+	branch.Status = status
+	switch status {
+	case "completed":
+		branch.Outcome = outcomeSuccess
+		endAttempt(branch, status)
+	case "in_progress":
+		branch.Outcome = ""
+		beginAttempt(branch)
+	default:
+		branch.Outcome = ""
+	}
+	syncActiveSteps(st)
+	st.UpdatedAt = time.Now().UTC().Format(time.RFC3339)
+
+	completed, needed := groupProgress(*group)
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "step_update",
+		WorkflowID: st.ID,
+		Step:       branch.Name,
+		Status:     status,
+		Message:    fmt.Sprintf("parallel group %s: %d/%d complete", group.Name, completed, needed),
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	result := map[string]any{
+		"updated":      true,
+		"group":        group.Name,
+		"step":         branch.Name,
+		"completed":    completed,
+		"needed":       needed,
+		"current_step": st.CurrentStep,
+		"active_steps": st.ActiveSteps,
+		"event":        event,
+	}
+	if completed >= needed {
+		// The branch is committed whatever happens next, so a group that
+		// can't move on yet (e.g. its criteria gate) is reported, not failed
+		joined, err := workflowNext(st, outcomeSuccess)
+		if err != nil {
+			result["warning"] = fmt.Sprintf("branch %s is completed, but group %s couldn't move on: %v", branch.Name, group.Name, err)
+			var te *ToolError
+			if errors.As(err, &te) && te.Hint != "" {
+				result["hint"] = te.Hint
+			}
+			output, _ := json.MarshalIndent(result, "", "  ")
+			return string(output), nil
+		}
+		result["joined"] = json.RawMessage(joined)
+		result["current_step"] = st.CurrentStep
+		delete(result, "active_steps")
+		groupResult(st, result) // in case the next step is a group too
+	}
+
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
+
+// groupResult adds the open branches to a response whose current step is
+// a parallel group.
+func groupResult(st *WorkflowState, result map[string]any) map[string]any {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 || len(st.Steps[idx].Parallel) == 0 {
+		return result
+	}
+	group := st.Steps[idx]
+	branches := []map[string]any{}
+	for _, b := range group.Parallel {
+		branches = append(branches, map[string]any{
+			"name":         b.Name,
+			"status":       b.Status,
+			"instructions": b.Instructions,
+		})
+	}
+	completed, needed := groupProgress(group)
+	result["active_steps"] = st.ActiveSteps
+	result["parallel"] = branches
+	result["quorum"] = fmt.Sprintf("%d/%d", completed, needed)
+	return result
+}
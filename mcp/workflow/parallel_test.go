@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const parallelTestConfig = `name: fanout
+steps:
+  - name: criteria
+    instructions: Set criteria.
+  - name: checks
+    quorum: 2%s
+    parallel:
+      - name: unit
+        instructions: Run the unit tests.
+      - name: lint
+        instructions: Run the linter.
+      - name: docs
+        instructions: Check the docs.
+  - name: ship
+    instructions: Ship it.
+`
+
+// branchStatuses lists the branches of st's step group as name=status.
+func branchStatuses(st *WorkflowState, group string) string {
+	var parts []string
+	for _, b := range st.Steps[stepIndex(st, group)].Parallel {
+		parts = append(parts, b.Name+"="+b.Status)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParallelGroups(t *testing.T) {
+	tests := []struct {
+		name         string
+		gated        bool // checks has requires_criteria_pass
+		calls        []toolCall
+		want         string // step statuses afterwards, see stepStatuses
+		wantBranches string // checks' branch statuses afterwards
+	}{
+		{
+			name: "quorum not reached",
+			calls: []toolCall{
+				{tool: "workflow_step", args: `{"step":"unit","status":"completed"}`, want: map[string]any{"completed": 1, "needed": 2, "current_step": "checks", "active_steps": "[lint docs]"}},
+				{tool: "workflow_next", wantErr: "parallel group checks has 1 of 2 required branches completed"},
+			},
+			want:         "criteria=completed checks=in_progress ship=pending",
+			wantBranches: "unit=completed lint=in_progress docs=in_progress",
+		},
+		{
+			name: "quorum joins the group",
+			calls: []toolCall{
+				{tool: "workflow_step", args: `{"step":"unit","status":"completed"}`},
+				{tool: "workflow_step", args: `{"step":"docs","status":"completed"}`, want: map[string]any{"completed": 2, "current_step": "ship"}},
+			},
+			want:         "criteria=completed checks=completed ship=in_progress",
+			wantBranches: "unit=completed lint=skipped docs=completed",
+		},
+		{
+			name: "branch of a group that has joined",
+			calls: []toolCall{
+				{tool: "workflow_step", args: `{"step":"unit","status":"completed"}`},
+				{tool: "workflow_step", args: `{"step":"lint","status":"completed"}`},
+				{tool: "workflow_step", args: `{"step":"docs","status":"completed"}`, wantErr: "step docs not found"},
+			},
+			want:         "criteria=completed checks=completed ship=in_progress",
+			wantBranches: "unit=completed lint=completed docs=skipped",
+		},
+		{
+			name:  "quorum reached with the group's criteria open",
+			gated: true,
+			calls: []toolCall{
+				{tool: "workflow_step", args: `{"step":"unit","status":"completed"}`},
+				{tool: "workflow_step", args: `{"step":"lint","status":"completed"}`, want: map[string]any{
+					"updated":      true,
+					"current_step": "checks",
+					"warning":      "branch lint is completed, but group checks couldn't move on: step checks requires all criteria to pass: 1 of 1 are pending or failing",
+				}},
+			},
+			want:         "criteria=completed checks=in_progress ship=pending",
+			wantBranches: "unit=completed lint=completed docs=in_progress",
+		},
+		{
+			name:  "group moves on once its criteria pass",
+			gated: true,
+			calls: []toolCall{
+				{tool: "workflow_step", args: `{"step":"unit","status":"completed"}`},
+				{tool: "workflow_step", args: `{"step":"lint","status":"completed"}`},
+				{tool: "workflow_update_criterion", args: `{"id":"c1","status":"pass","evidence":"all green"}`},
+				{tool: "workflow_next", want: map[string]any{"current_step": "ship"}},
+			},
+			want:         "criteria=completed checks=completed ship=in_progress",
+			wantBranches: "unit=completed lint=completed docs=skipped",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gate := ""
+			if tt.gated {
+				gate = "\n    requires_criteria_pass: true"
+			}
+			testServer(t, strings.Replace(parallelTestConfig, "%s", gate, 1))
+			runCalls(t, append([]toolCall{
+				{tool: "workflow_init", args: `{"task":"fan out"}`},
+				{tool: "workflow_set_criteria", args: `{"criteria":["it works"]}`},
+				{tool: "workflow_next", want: map[string]any{"current_step": "checks", "active_steps": "[unit lint docs]"}},
+			}, tt.calls...))
+			st := activeState(t)
+			if got := stepStatuses(st); got != tt.want {
+				t.Errorf("steps = %s, want %s", got, tt.want)
+			}
+			if got := branchStatuses(st, "checks"); got != tt.wantBranches {
+				t.Errorf("branches = %s, want %s", got, tt.wantBranches)
+			}
+		})
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// MCP prompts. The slash commands (start, status, next, approve, iterate,
+// reject, blocked) and one prompt per step are rendered from templates in
+// prompts/ with the loaded config, so they always describe the workflow
+// actually in use. `workflow-mcp gen-skills <dir>` writes the same text as
+// Claude Code command files, with $ARGUMENTS in place of the arguments.
+
+//go:embed prompts/*.md
+var promptFiles embed.FS
+
+type promptArgument struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Required    bool   `json:"required"`
+}
+
+type commandPrompt struct {
+	Name        string
+	Description string
+	Template    string
+	Arguments   []promptArgument
+}
+
+var commandPrompts = []commandPrompt{
+	{
+		Name:        "workflow-start",
+		Description: "Start a workflow for a task and begin its first step",
+		Template:    "start.md",
+		Arguments:   []promptArgument{{Name: "task", Description: "What to do", Required: true}},
+	},
+	{
+		Name:        "workflow-status",
+		Description: "Show the current workflow's progress and step",
+		Template:    "status.md",
+	},
+	{
+		Name:        "workflow-next",
+		Description: "Complete the current step and move to the next one",
+		Template:    "next.md",
+	},
+	{
+		Name:        "workflow-approve",
+		Description: "Approve the step awaiting approval and continue",
+		Template:    "approve.md",
+		Arguments:   []promptArgument{{Name: "approval_code", Description: "One-time code or token, for human_token steps"}},
+	},
+	{
+		Name:        "workflow-iterate",
+		Description: "Send the step awaiting approval back with feedback",
+		Template:    "iterate.md",
+		Arguments:   []promptArgument{{Name: "feedback", Description: "What to change", Required: true}},
+	},
+	{
+		Name:        "workflow-reject",
+		Description: "Send the workflow back to an earlier step because the problem lies there",
+		Template:    "reject.md",
+		Arguments:   []promptArgument{{Name: "reason", Description: "What was wrong, optionally starting with the step to go back to", Required: true}},
+	},
+	{
+		Name:        "workflow-blocked",
+		Description: "Mark the current step blocked on an external dependency",
+		Template:    "blocked.md",
+		Arguments:   []promptArgument{{Name: "reason", Description: "What the step is waiting for", Required: true}},
+	},
+}
+
+const stepPromptPrefix = "workflow-step-"
+
+// promptData is what the templates render from.
+type promptData struct {
+	Workflow *WorkflowConfig
+	Steps    []StepConfig
+	Step     *StepConfig // step prompts only
+}
+
+// renderPrompt renders a template. arg supplies argument values: the
+// client's for prompts/get, $ARGUMENTS for gen-skills.
+func renderPrompt(name string, data promptData, arg func(string) string) (string, error) {
+	funcs := template.FuncMap{
+		"arg": arg,
+		"inc": func(i int) int { return i + 1 },
+		"first": func() string {
+			if len(data.Steps) == 0 {
+				return ""
+			}
+			return data.Steps[0].Name
+		},
+		"hasStep": func(step string) bool {
+			for _, s := range data.Steps {
+				if s.Name == step {
+					return true
+				}
+			}
+			return false
+		},
+		"flags":   stepFlags,
+		"summary": stepSummary,
+		"quote":   func(s string) string { return strings.ReplaceAll(strings.TrimSpace(s), "\n", "\n> ") },
+		"trim":    strings.TrimSpace,
+	}
+	tmpl, err := template.New(name).Funcs(funcs).ParseFS(promptFiles, "prompts/"+name)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// stepFlags describes a step's gates, e.g. " (requires approval, allows
+// iteration)".
+func stepFlags(s StepConfig) string {
+	var flags []string
+	if s.NeedsApproval {
+		if s.ApprovalMode == approvalModeHumanToken {
+			flags = append(flags, "requires approval with a code")
+		} else {
+			flags = append(flags, "requires approval")
+		}
+	}
+	if s.AllowsIteration {
+		flags = append(flags, "allows iteration")
+	}
+	if s.RequiresCriteriaPass {
+		flags = append(flags, "criteria must pass")
+	}
+	if s.Uses != "" {
+		flags = append(flags, "runs "+s.Uses)
+	}
+	if len(s.Parallel) > 0 {
+		flags = append(flags, fmt.Sprintf("%d parallel branches", len(s.Parallel)))
+	}
+	if len(flags) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(flags, ", ") + ")"
+}
+
+// stepSummary is the first line of a step's instructions, skipping bold
+// headings and list markers.
+func stepSummary(s StepConfig) string {
+	for _, line := range strings.Split(s.Instructions, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || (strings.HasPrefix(line, "**") && strings.HasSuffix(line, "**")) {
+			continue
+		}
+		line = strings.TrimLeft(line, "-*0123456789. ")
+		return strings.TrimSuffix(line, ":")
+	}
+	return "No instructions"
+}
+
+func promptDataFor(cfg *WorkflowConfig) promptData {
+	return promptData{Workflow: cfg, Steps: cfg.Steps}
+}
+
+// listPrompts lists the command prompts and a prompt per step of cfg.
+func listPrompts(cfg *WorkflowConfig) []map[string]any {
+	prompts := []map[string]any{}
+	for _, p := range commandPrompts {
+		entry := map[string]any{"name": p.Name, "description": p.Description}
+		if len(p.Arguments) > 0 {
+			entry["arguments"] = p.Arguments
+		}
+		prompts = append(prompts, entry)
+	}
+	for _, s := range cfg.Steps {
+		prompts = append(prompts, map[string]any{
+			"name":        stepPromptPrefix + s.Name,
+			"description": fmt.Sprintf("Instructions for the %s step: %s", s.Name, stepSummary(s)),
+		})
+	}
+	return prompts
+}
+
+// getPrompt renders prompt name with the client's arguments.
+func getPrompt(cfg *WorkflowConfig, name string, args map[string]string) (map[string]any, error) {
+	data := promptDataFor(cfg)
+	arg := func(key string) string { return args[key] }
+
+	text, description := "", ""
+	if step, ok := strings.CutPrefix(name, stepPromptPrefix); ok {
+		for i := range cfg.Steps {
+			if cfg.Steps[i].Name == step {
+				data.Step = &cfg.Steps[i]
+			}
+		}
+		if data.Step == nil {
+			return nil, rpcError(codeInvalidParams, "unknown prompt: %s", name)
+		}
+		description = "Instructions for the " + step + " step"
+		var err error
+		if text, err = renderPrompt("step.md", data, arg); err != nil {
+			return nil, err
+		}
+	} else {
+		var p *commandPrompt
+		for i := range commandPrompts {
+			if commandPrompts[i].Name == name {
+				p = &commandPrompts[i]
+			}
+		}
+		if p == nil {
+			return nil, rpcError(codeInvalidParams, "unknown prompt: %s", name)
+		}
+		for _, a := range p.Arguments {
+			if a.Required && strings.TrimSpace(args[a.Name]) == "" {
+				return nil, rpcError(codeInvalidParams, "prompt %s: missing required argument %s", name, a.Name)
+			}
+		}
+		description = p.Description
+		var err error
+		if text, err = renderPrompt(p.Template, data, arg); err != nil {
+			return nil, err
+		}
+	}
+
+	return map[string]any{
+		"description": description,
+		"messages": []map[string]any{
+			{"role": "user", "content": map[string]any{"type": "text", "text": text}},
+		},
+	}, nil
+}
+
+// generatedHeader marks files written by gen-skills.
+const generatedHeader = "<!-- Generated by `workflow-mcp gen-skills` from workflow.yaml. Edit the config and regenerate instead of editing this file. -->\n\n"
+
+// genSkills writes the command prompts and step prompts for cfg to dir as
+// Claude Code command files, and returns the paths written.
+func genSkills(cfg *WorkflowConfig, dir string) ([]string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	data := promptDataFor(cfg)
+	arguments := func(string) string { return "$ARGUMENTS" }
+
+	var written []string
+	write := func(name, text string) error {
+		path := filepath.Join(dir, name+".md")
+		if err := writeFileAtomic(path, []byte(generatedHeader+text), 0644); err != nil {
+			return err
+		}
+		written = append(written, path)
+		return nil
+	}
+	for _, p := range commandPrompts {
+		text, err := renderPrompt(p.Template, data, arguments)
+		if err != nil {
+			return written, err
+		}
+		if err := write(p.Name, text); err != nil {
+			return written, err
+		}
+	}
+	for i := range cfg.Steps {
+		data.Step = &cfg.Steps[i]
+		text, err := renderPrompt("step.md", data, arguments)
+		if err != nil {
+			return written, err
+		}
+		if err := write(stepPromptPrefix+cfg.Steps[i].Name, text); err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// MCP resources. Each workflow's status and artifacts can be read (and
+// attached to a conversation) without a tool call:
+//
+//	workflow://{id}/status            workflow_status output, JSON
+//	workflow://{id}/artifacts/{type}  an artifact's content: text/markdown
+//	                                  for strings, JSON otherwise
+//
+// {id} may be "current": the active workflow for status, and for artifacts
+// the workflow whose steps are being worked on (see activeLeaf), falling
+// back to the active workflow. Clients that subscribe to a URI get
+// notifications/resources/updated when it changes in this server process.
+
+const resourceScheme = "workflow://"
+
+type resourceRef struct {
+	id           string // workflow ID or "current"
+	artifactType string // empty for status
+}
+
+func (r resourceRef) uri() string {
+	if r.artifactType == "" {
+		return resourceScheme + r.id + "/status"
+	}
+	return resourceScheme + r.id + "/artifacts/" + r.artifactType
+}
+
+func parseResourceURI(uri string) (resourceRef, bool) {
+	rest, ok := strings.CutPrefix(uri, resourceScheme)
+	if !ok {
+		return resourceRef{}, false
+	}
+	parts := strings.Split(rest, "/")
+	switch {
+	case len(parts) == 2 && parts[1] == "status":
+		return resourceRef{id: parts[0]}, parts[0] != ""
+	case len(parts) == 3 && parts[1] == "artifacts" && parts[2] != "":
+		return resourceRef{id: parts[0], artifactType: parts[2]}, parts[0] != ""
+	}
+	return resourceRef{}, false
+}
+
+func artifactMimeType(a Artifact) string {
+	if _, ok := a.Content.(string); ok {
+		return "text/markdown"
+	}
+	return "application/json"
+}
+
+// listResources lists the status of every workflow and each artifact it
+// has, plus the current workflow's.
+func listResources() ([]map[string]any, error) {
+	resources := []map[string]any{}
+	add := func(st *WorkflowState, id string) {
+		resources = append(resources, map[string]any{
+			"uri":         resourceRef{id: id}.uri(),
+			"name":        fmt.Sprintf("%s status", id),
+			"description": fmt.Sprintf("Status of workflow %s: %s", st.ID, st.Task),
+			"mimeType":    "application/json",
+		})
+		types := make([]string, 0, len(st.Artifacts))
+		for t := range st.Artifacts {
+			types = append(types, t)
+		}
+		sort.Strings(types)
+		for _, t := range types {
+			resources = append(resources, map[string]any{
+				"uri":         resourceRef{id: id, artifactType: t}.uri(),
+				"name":        fmt.Sprintf("%s %s", id, t),
+				"description": fmt.Sprintf("The %s artifact of workflow %s (set in step %s)", t, st.ID, st.Artifacts[t].Step),
+				"mimeType":    artifactMimeType(st.Artifacts[t]),
+			})
+		}
+	}
+
+	if current, err := resolveWorkflow(""); err == nil {
+		add(current, "current")
+	}
+	all, err := store.List(false)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range all {
+		add(st, st.ID)
+	}
+	return resources, nil
+}
+
+var resourceTemplates = []map[string]any{
+	{
+		"uriTemplate": "workflow://{workflow_id}/status",
+		"name":        "Workflow status",
+		"description": "Current step, progress, steps and artifacts of a workflow (\"current\" for the active one)",
+		"mimeType":    "application/json",
+	},
+	{
+		"uriTemplate": "workflow://{workflow_id}/artifacts/{type}",
+		"name":        "Workflow artifact",
+		"description": "An artifact such as plan (markdown) or criteria (JSON)",
+	},
+}
+
+// readResource returns the contents of a resource URI.
+func readResource(uri string) (map[string]any, error) {
+	ref, ok := parseResourceURI(uri)
+	if !ok {
+		return nil, rpcError(codeResourceNotFound, "unknown resource %s", uri)
+	}
+
+	st, err := resolveResource(ref)
+	if err != nil {
+		return nil, rpcError(codeResourceNotFound, "resource %s: %v", uri, err)
+	}
+	if ref.artifactType == "" {
+		text, err := workflowStatus(st)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]any{"uri": uri, "mimeType": "application/json", "text": text}, nil
+	}
+
+	artifact := st.Artifacts[ref.artifactType]
+	if text, ok := artifact.Content.(string); ok {
+		return map[string]any{"uri": uri, "mimeType": "text/markdown", "text": text}, nil
+	}
+	data, _ := json.MarshalIndent(artifact.Content, "", "  ")
+	return map[string]any{"uri": uri, "mimeType": "application/json", "text": string(data)}, nil
+}
+
+// resolveResource loads the workflow a resource belongs to, checking that
+// an artifact resource exists.
+func resolveResource(ref resourceRef) (*WorkflowState, error) {
+	id := ref.id
+	if id == "current" {
+		id = ""
+	}
+	st, err := resolveWorkflow(id)
+	if err != nil {
+		return nil, err
+	}
+	if ref.artifactType == "" {
+		return st, nil
+	}
+	if ref.id == "current" {
+		if leaf, err := activeLeaf(st); err == nil {
+			if _, ok := leaf.Artifacts[ref.artifactType]; ok {
+				return leaf, nil
+			}
+		}
+	}
+	if _, ok := st.Artifacts[ref.artifactType]; !ok {
+		return nil, toolError("workflow %s has no %s artifact", st.ID, ref.artifactType)
+	}
+	return st, nil
+}
+
+func (s *session) subscribe(uri string, on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.subscriptions == nil {
+		s.subscriptions = map[string]bool{}
+	}
+	if on {
+		s.subscriptions[uri] = true
+	} else {
+		delete(s.subscriptions, uri)
+	}
+}
+
+// notifyResourcesUpdated tells the sessions subscribed to any of uris that
+// the resource changed.
+func notifyResourcesUpdated(uris ...string) {
+	sessions.Lock()
+	all := make([]*session, 0, len(sessions.byID))
+	for _, s := range sessions.byID {
+		all = append(all, s)
+	}
+	sessions.Unlock()
+
+	for _, s := range all {
+		s.mu.Lock()
+		var matched []string
+		for _, uri := range uris {
+			if s.subscriptions[uri] {
+				matched = append(matched, uri)
+			}
+		}
+		s.mu.Unlock()
+		for _, uri := range matched {
+			s.notify("notifications/resources/updated", map[string]any{"uri": uri})
+		}
+	}
+}
+
+// resourceIDs returns the IDs st's resources are reachable under: its own,
+// and "current" if it is the active workflow or runs under it.
+func resourceIDs(st *WorkflowState) []string {
+	ids := []string{st.ID}
+	active := store.ActiveID()
+	for depth, ancestor := 0, st; ancestor != nil && depth <= maxSubWorkflowDepth; depth++ {
+		if ancestor.ID == active {
+			return append(ids, "current")
+		}
+		if ancestor.ParentID == "" {
+			break
+		}
+		parent, err := store.Load(ancestor.ParentID)
+		if err != nil {
+			break
+		}
+		ancestor = parent
+	}
+	return ids
+}
+
+// artifactUpdated is called after an artifact is committed. A new artifact
+// type also changes the resource list.
+func artifactUpdated(st *WorkflowState, artifactType string, added bool) {
+	if added {
+		broadcast("notifications/resources/list_changed", nil)
+	}
+	var uris []string
+	for _, id := range resourceIDs(st) {
+		uris = append(uris, resourceRef{id: id, artifactType: artifactType}.uri())
+	}
+	notifyResourcesUpdated(uris...)
+}
+
+// statusResourceSink is an event sink that reports status resources as
+// updated whenever their workflow commits an event.
+func statusResourceSink(ev WorkflowEvent) {
+	switch ev.Type {
+	case "init", "archived", "switched":
+		broadcast("notifications/resources/list_changed", nil)
+	}
+	if !hasSubscriptions() {
+		return
+	}
+	ids := []string{ev.WorkflowID}
+	if st, err := store.Load(ev.WorkflowID); err == nil {
+		ids = resourceIDs(st)
+	}
+	if ev.Type == "switched" && !containsString(ids, "current") {
+		ids = append(ids, "current")
+	}
+	var uris []string
+	for _, id := range ids {
+		uris = append(uris, resourceRef{id: id}.uri())
+	}
+	notifyResourcesUpdated(uris...)
+}
+
+func hasSubscriptions() bool {
+	sessions.Lock()
+	defer sessions.Unlock()
+	for _, s := range sessions.byID {
+		s.mu.Lock()
+		n := len(s.subscriptions)
+		s.mu.Unlock()
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// PR review. While a step watches a PR, the agent reports its comment count
+// to workflow_check_pr every poll_interval. New comments are to be
+// addressed; once none have arrived for quiet_period the PR is ready for
+// human review. The quiet period runs from the last new comments (or from
+// workflow_set_pr), not from the last check, so checking often doesn't
+// hold it off. If the review is still going after max_wait, it is handed
+// to a human anyway with a review_escalated event.
+
+// ReviewConfig is a step's `review:` block. Durations such as "5m"; unset
+// ones take the defaults below, and without max_wait the review never
+// escalates.
+type ReviewConfig struct {
+	QuietPeriod  string `yaml:"quiet_period" json:"quiet_period,omitempty"`
+	PollInterval string `yaml:"poll_interval" json:"poll_interval,omitempty"`
+	MaxWait      string `yaml:"max_wait" json:"max_wait,omitempty"`
+}
+
+const (
+	defaultQuietPeriod  = 5 * time.Minute
+	defaultPollInterval = time.Minute
+)
+
+// reviewLimits is a ReviewConfig parsed, with defaults applied.
+type reviewLimits struct {
+	quietPeriod, pollInterval, maxWait time.Duration
+}
+
+func parseReview(r *ReviewConfig) (reviewLimits, error) {
+	limits := reviewLimits{quietPeriod: defaultQuietPeriod, pollInterval: defaultPollInterval}
+	if r == nil {
+		return limits, nil
+	}
+	for _, f := range []struct {
+		value string
+		dst   *time.Duration
+	}{
+		{r.QuietPeriod, &limits.quietPeriod},
+		{r.PollInterval, &limits.pollInterval},
+		{r.MaxWait, &limits.maxWait},
+	} {
+		d, err := parseDuration(f.value)
+		if err != nil {
+			return limits, err
+		}
+		if d > 0 {
+			*f.dst = d
+		}
+	}
+	return limits, nil
+}
+
+// reviewStep returns the step whose review settings apply to st: the
+// current step, or in a parallel group the first running branch with a
+// `review:` block.
+func reviewStep(st *WorkflowState) *WorkflowStep {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return nil
+	}
+	group := &st.Steps[idx]
+	for i := range group.Parallel {
+		branch := &group.Parallel[i]
+		if branch.Review != nil && containsString(st.ActiveSteps, branch.Name) {
+			return branch
+		}
+	}
+	return group
+}
+
+func workflowCheckPR(st *WorkflowState, commentCount int) (string, error) {
+	if st.PRNumber == 0 {
+		return "", &ToolError{Message: "no PR set", Hint: "call workflow_set_pr first"}
+	}
+
+	var review *ReviewConfig
+	var attempt *StepAttempt
+	if step := reviewStep(st); step != nil {
+		review = step.Review
+		attempt = openAttempt(step)
+	}
+	limits, err := parseReview(review)
+	if err != nil {
+		return "", toolError("invalid review settings for step %s: %v", st.CurrentStep, err)
+	}
+
+	now := time.Now().UTC()
+	stamp := now.Format(time.RFC3339)
+	sinceCheck := now.Sub(parseTime(st.LastCommentCheck))
+
+	// Workflows from before last_comment_activity was kept fall back to
+	// the last check
+	lastActivity := st.LastCommentActivity
+	if lastActivity == "" {
+		lastActivity = st.LastCommentCheck
+	}
+
+	previousCount := st.LastCommentCount
+	hasNewComments := commentCount > previousCount
+	if hasNewComments {
+		lastActivity = stamp
+	}
+	st.LastCommentCheck = stamp
+	st.LastCommentActivity = lastActivity
+	st.LastCommentCount = commentCount
+	st.UpdatedAt = stamp
+
+	quietFor := now.Sub(parseTime(lastActivity))
+	untilReady := max(limits.quietPeriod-quietFor, 0)
+
+	// max_wait runs from when this attempt at the step started, so sending
+	// it back for another round starts the clock again
+	var reviewingFor time.Duration
+	if attempt != nil {
+		reviewingFor = now.Sub(parseTime(attempt.StartedAt))
+	}
+	escalate := limits.maxWait > 0 && attempt != nil && reviewingFor >= limits.maxWait
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "pr_check",
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
+		Timestamp:  stamp,
+	}
+
+	var action string
+	switch {
+	case escalate:
+		action = "escalate"
+		event.Message = fmt.Sprintf("Review has run for %s without a quiet period of %s (max_wait %s). Call workflow_next() to hand the PR to a human.",
+			formatDuration(reviewingFor), formatDuration(limits.quietPeriod), formatDuration(limits.maxWait))
+		// Announce it once per attempt; later checks are plain pr_check events
+		if parseTime(st.ReviewEscalatedAt).Before(parseTime(attempt.StartedAt)) {
+			st.ReviewEscalatedAt = stamp
+			event.Type = "review_escalated"
+			event.Status = "escalated"
+		}
+	case hasNewComments:
+		action = "address_comments"
+		event.Message = fmt.Sprintf("Found %d new comment(s). Address the feedback, then check again.", commentCount-previousCount)
+	case untilReady == 0:
+		action = "ready_for_human_review"
+		event.Message = fmt.Sprintf("No new comments for %s. Ready for human review - call workflow_next().", formatDuration(quietFor))
+	default:
+		action = "wait"
+		event.Message = fmt.Sprintf("No new comments for %s; %s until human review. Wait %d seconds then check again.",
+			formatDuration(quietFor), formatDuration(untilReady), int(limits.pollInterval.Seconds()))
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+
+	result := map[string]any{
+		"pr_number":               st.PRNumber,
+		"comment_count":           commentCount,
+		"previous_count":          previousCount,
+		"has_new_comments":        hasNewComments,
+		"seconds_since_check":     int(sinceCheck.Seconds()),
+		"quiet_for":               formatDuration(quietFor),
+		"quiet_period":            formatDuration(limits.quietPeriod),
+		"mins_until_human_review": int(untilReady.Minutes()),
+		"wait_seconds":            int(limits.pollInterval.Seconds()),
+		"action":                  action,
+		"message":                 event.Message,
+		"event":                   event,
+	}
+	if limits.maxWait > 0 {
+		result["max_wait"] = formatDuration(limits.maxWait)
+		result["reviewing_for"] = formatDuration(reviewingFor)
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Rollback: workflow_reject sends the workflow back to an earlier step when
+// a reviewer finds the problem lies upstream ("the plan was wrong"), where
+// workflow_iterate would only revise the current step. The target and
+// every later step go back to pending, artifacts produced by those steps
+// are kept but marked stale, and the reason is recorded in Rollbacks.
+
+// Rollback records one workflow_reject.
+type Rollback struct {
+	From      string   `json:"from"`
+	To        string   `json:"to"`
+	Reason    string   `json:"reason"`
+	Stale     []string `json:"stale_artifacts,omitempty"`
+	Timestamp string   `json:"timestamp"`
+}
+
+// restartFrom makes step idx current again, with it and every later step
+// back to pending first (ending their open attempts with why), and starts
+// its sub-workflow if it has one. The caller saves st.
+func restartFrom(st *WorkflowState, idx int, why string) (*WorkflowState, error) {
+	for i := idx; i < len(st.Steps); i++ {
+		step := &st.Steps[i]
+		endAttempt(step, why)
+		for j := range step.Parallel {
+			endAttempt(&step.Parallel[j], why)
+		}
+		step.Status = "pending"
+		step.Outcome = ""
+		step.ChildID = ""
+		step.Approval = nil
+		resetBranches(step)
+	}
+	startStep(&st.Steps[idx])
+	st.CurrentStep = st.Steps[idx].Name
+	st.WaitingForApproval = false
+	st.IterationCount = 0
+	st.IterationFeedback = []string{}
+	syncActiveSteps(st)
+	return startSubWorkflow(st, 0)
+}
+
+// previousStep returns the name of the last completed step before the
+// current one, the default target of workflow_reject.
+func previousStep(st *WorkflowState) string {
+	for i := stepIndex(st, st.CurrentStep) - 1; i >= 0; i-- {
+		if st.Steps[i].Status == "completed" {
+			return st.Steps[i].Name
+		}
+	}
+	return ""
+}
+
+// markStale flags the artifacts set by step idx or any later step (or one
+// of their branches) as stale, and returns their types.
+func markStale(st *WorkflowState, idx int) []string {
+	affected := map[string]bool{}
+	for i := idx; i < len(st.Steps); i++ {
+		affected[st.Steps[i].Name] = true
+		for _, b := range st.Steps[i].Parallel {
+			affected[b.Name] = true
+		}
+	}
+	var stale []string
+	for t, a := range st.Artifacts {
+		if affected[a.Step] && !a.Stale {
+			a.Stale = true
+			st.Artifacts[t] = a
+			stale = append(stale, t)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+// workflowReject moves st back to step to (by default the last completed
+// step) because of reason. A step of an enclosing workflow may be named
+// when st is a sub-workflow; that workflow is rolled back instead.
+func workflowReject(st *WorkflowState, to, reason string) (string, error) {
+	if reason == "" {
+		return "", (&ToolError{
+			Message: "a reason is required",
+			Hint:    "say what was wrong with the earlier step, so it can be redone with that in mind",
+		}).With("step", st.CurrentStep)
+	}
+	if to == "" {
+		if to = previousStep(st); to == "" {
+			return "", toolError("no completed step before %s to go back to", st.CurrentStep).With("step", st.CurrentStep)
+		}
+	}
+
+	// Look for the target in enclosing workflows too
+	for depth := 0; stepIndex(st, to) < 0 && st.ParentID != "" && depth < maxSubWorkflowDepth; depth++ {
+		parent, err := store.Load(st.ParentID)
+		if err != nil {
+			return "", err
+		}
+		st = parent
+	}
+	idx := stepIndex(st, to)
+	if idx < 0 {
+		return "", toolError("step %s not found", to).With("workflow_id", st.ID)
+	}
+	current := stepIndex(st, st.CurrentStep)
+	if current >= 0 && idx >= current || current < 0 && st.CurrentStep != doneStep {
+		return "", (&ToolError{
+			Message: fmt.Sprintf("step %s is not before the current step %s", to, st.CurrentStep),
+			Hint:    "workflow_reject only goes back; use workflow_iterate to revise the current step",
+		}).With("workflow_id", st.ID)
+	}
+
+	previous := st.CurrentStep
+	stale := markStale(st, idx)
+	child, err := restartFrom(st, idx, "rolled_back")
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	st.Rollbacks = append(st.Rollbacks, Rollback{From: previous, To: to, Reason: reason, Stale: stale, Timestamp: now})
+	st.UpdatedAt = now
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "rolled_back",
+		WorkflowID: st.ID,
+		Step:       previous,
+		NextStep:   to,
+		Status:     "in_progress",
+		Message:    reason,
+		Timestamp:  now,
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+	for _, t := range stale {
+		artifactUpdated(st, t, false)
+	}
+
+	result := groupResult(st, map[string]any{
+		"rolled_back":     true,
+		"previous_step":   previous,
+		"current_step":    st.CurrentStep,
+		"reason":          reason,
+		"stale_artifacts": stale,
+		"instructions":    st.Steps[idx].Instructions,
+		"message":         fmt.Sprintf("Redo %s taking the reason into account. Stale artifacts are kept for reference; set them again when they are redone.", to),
+		"event":           event,
+	})
+	if child != nil {
+		result["sub_workflow"] = subWorkflowSummary(child)
+	}
+	output, _ := json.MarshalIndent(result, "", "  ")
+	return string(output), nil
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+const rollbackTestConfig = `name: reviewed
+steps:
+  - name: plan
+    needs_approval: true
+    instructions: Plan it.
+  - name: execute
+    instructions: Do it.
+  - name: review
+    needs_approval: true
+    instructions: Review it.
+  - name: qa
+    uses: checks
+workflows:
+  checks:
+    steps:
+      - name: signoff
+        needs_approval: true
+        instructions: Sign it off.
+`
+
+// staleArtifacts lists the types of st's stale artifacts.
+func staleArtifacts(st *WorkflowState) []string {
+	stale := []string{}
+	for t, a := range st.Artifacts {
+		if a.Stale {
+			stale = append(stale, t)
+		}
+	}
+	sort.Strings(stale)
+	return stale
+}
+
+func TestWorkflowReject(t *testing.T) {
+	// Up to review awaiting approval, with an artifact from plan and one
+	// from execute
+	toReview := []toolCall{
+		{tool: "workflow_set_plan", args: `{"plan":"1. do it"}`},
+		{tool: "workflow_next"},
+		{tool: "workflow_approve"},
+		{tool: "workflow_set_artifact", args: `{"type":"summary","content":"did it"}`},
+		{tool: "workflow_next", want: map[string]any{"current_step": "review"}},
+		{tool: "workflow_next", want: map[string]any{"status": "awaiting_approval"}},
+	}
+
+	tests := []struct {
+		name      string
+		calls     []toolCall
+		want      string // step statuses afterwards, see stepStatuses
+		wantStale []string
+		wantFrom  string // the recorded rollback, if any
+		wantTo    string
+	}{
+		{
+			name: "back to the plan",
+			calls: []toolCall{{tool: "workflow_reject", args: `{"to":"plan","reason":"wrong approach"}`, want: map[string]any{
+				"rolled_back":     true,
+				"previous_step":   "review",
+				"current_step":    "plan",
+				"stale_artifacts": "[plan summary]",
+			}}},
+			want:      "plan=in_progress execute=pending review=pending qa=pending",
+			wantStale: []string{"plan", "summary"},
+			wantFrom:  "review",
+			wantTo:    "plan",
+		},
+		{
+			name: "back to the last completed step by default",
+			calls: []toolCall{{tool: "workflow_reject", args: `{"reason":"missed a case"}`, want: map[string]any{
+				"current_step":    "execute",
+				"stale_artifacts": "[summary]",
+			}}},
+			want:      "plan=completed execute=in_progress review=pending qa=pending",
+			wantStale: []string{"summary"},
+			wantFrom:  "review",
+			wantTo:    "execute",
+		},
+		{
+			name:      "without a reason",
+			calls:     []toolCall{{tool: "workflow_reject", args: `{"to":"plan"}`, wantErr: "a reason is required"}},
+			want:      "plan=completed execute=completed review=awaiting_approval qa=pending",
+			wantStale: []string{},
+		},
+		{
+			name:      "to the current step",
+			calls:     []toolCall{{tool: "workflow_reject", args: `{"to":"review","reason":"redo"}`, wantErr: "step review is not before the current step review"}},
+			want:      "plan=completed execute=completed review=awaiting_approval qa=pending",
+			wantStale: []string{},
+		},
+		{
+			name:      "to a step that doesn't exist",
+			calls:     []toolCall{{tool: "workflow_reject", args: `{"to":"design","reason":"redo"}`, wantErr: "step design not found"}},
+			want:      "plan=completed execute=completed review=awaiting_approval qa=pending",
+			wantStale: []string{},
+		},
+		{
+			name: "from a sub-workflow to a step of its parent",
+			calls: []toolCall{
+				{tool: "workflow_approve", want: map[string]any{"current_step": "qa", "sub_workflow.current_step": "signoff"}},
+				{tool: "workflow_next", want: map[string]any{"status": "awaiting_approval"}},
+				{tool: "workflow_reject", args: `{"to":"execute","reason":"tests are flaky"}`, want: map[string]any{"previous_step": "qa", "current_step": "execute"}},
+				{tool: "workflow_status", want: map[string]any{"current_step": "execute", "sub_workflow": nil}},
+			},
+			want:      "plan=completed execute=in_progress review=pending qa=pending",
+			wantStale: []string{"summary"},
+			wantFrom:  "qa",
+			wantTo:    "execute",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer(t, rollbackTestConfig)
+			runCalls(t, append([]toolCall{{tool: "workflow_init", args: `{"task":"reviewed"}`}}, toReview...))
+			runCalls(t, tt.calls)
+
+			st := activeState(t)
+			if got := stepStatuses(st); got != tt.want {
+				t.Errorf("steps = %s, want %s", got, tt.want)
+			}
+			if got := staleArtifacts(st); !reflect.DeepEqual(got, tt.wantStale) {
+				t.Errorf("stale artifacts = %v, want %v", got, tt.wantStale)
+			}
+			if tt.wantTo == "" {
+				if len(st.Rollbacks) != 0 {
+					t.Errorf("rollbacks = %+v, want none", st.Rollbacks)
+				}
+				return
+			}
+			if n := len(st.Rollbacks); n != 1 || st.Rollbacks[0].From != tt.wantFrom || st.Rollbacks[0].To != tt.wantTo {
+				t.Fatalf("rollbacks = %+v, want one from %s to %s", st.Rollbacks, tt.wantFrom, tt.wantTo)
+			}
+			// The steps sent back keep their earlier attempts, all ended but
+			// the new one of the step that runs again
+			for _, step := range st.Steps[stepIndex(st, tt.wantTo):] {
+				ended := step.Attempts
+				if step.Status == "in_progress" {
+					ended = ended[:len(ended)-1]
+				}
+				for _, a := range ended {
+					if a.CompletedAt == "" {
+						t.Errorf("step %s (%s) has an earlier attempt still open", step.Name, step.Status)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Store keeps one state file per workflow under dir, plus a pointer to the
+// active workflow. Tools that are called without a workflow_id operate on
+// the active workflow, which preserves the original single-workflow behavior.
+//
+// Several workflow-mcp processes may share a store (e.g. two Claude sessions
+// in one workspace), so callers hold Lock for the whole load-modify-save
+// cycle and every file is replaced atomically.
+type Store struct {
+	dir        string // ~/state/workflows
+	legacyFile string // ~/state/workflow_state.json, mirrors the active workflow
+}
+
+var validWorkflowID = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*$`)
+
+func newStore(stateDir string) *Store {
+	return &Store{
+		dir:        filepath.Join(stateDir, "workflows"),
+		legacyFile: filepath.Join(stateDir, "workflow_state.json"),
+	}
+}
+
+func (s *Store) path(id string) string {
+	return filepath.Join(s.dir, id+".json")
+}
+
+func (s *Store) archivePath(id string) string {
+	return filepath.Join(s.dir, "archive", id+".json")
+}
+
+func (s *Store) activeFile() string {
+	return filepath.Join(s.dir, "active")
+}
+
+func checkWorkflowID(id string) error {
+	if !validWorkflowID.MatchString(id) {
+		return toolError("invalid workflow_id %q", id)
+	}
+	return nil
+}
+
+// Lock takes the store-wide advisory lock. It blocks until no other
+// process (or goroutine) holds it.
+func (s *Store) Lock() (func(), error) {
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return nil, fmt.Errorf("create state directory: %w", err)
+	}
+	unlock, err := lockFile(filepath.Join(s.dir, ".lock"))
+	if err != nil {
+		return nil, fmt.Errorf("lock state directory: %w", err)
+	}
+	return unlock, nil
+}
+
+// withLock runs fn under the store lock, with the config reloaded if it
+// changed, like a tool call.
+func withLock[T any](fn func() (T, error)) (T, error) {
+	unlock, err := store.Lock()
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	defer unlock()
+	reloadConfigIfChanged()
+	return fn()
+}
+
+// Load reads a workflow by ID. Archived workflows are not loadable.
+func (s *Store) Load(id string) (*WorkflowState, error) {
+	if err := checkWorkflowID(id); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(s.path(id))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, (&ToolError{
+			Message: fmt.Sprintf("workflow %s not found", id),
+			Hint:    "call workflow_list to see available workflows",
+		}).With("workflow_id", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read workflow %s: %w", id, err)
+	}
+	st := &WorkflowState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return nil, fmt.Errorf("workflow %s: corrupt state file %s: %w", id, s.path(id), err)
+	}
+	st.loadedData = data
+	return st, nil
+}
+
+// Commit atomically writes st's state file, mirroring it to the legacy
+// single-workflow file when it is the active workflow, and appends ev to
+// the workflow's event journal, setting ev.Seq. The journal entry is
+// written first so that it is never missing an event whose effect is
+// visible in the state file. It refuses to overwrite a file that changed
+// on disk since st was loaded.
+func (s *Store) Commit(st *WorkflowState, ev *WorkflowEvent) error {
+	if err := s.checkUnchanged(st); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode workflow %s: %w", st.ID, err)
+	}
+	patch, exact, err := mergeDiff(st.loadedData, data)
+	if err != nil {
+		return fmt.Errorf("diff workflow %s: %w", st.ID, err)
+	}
+	var state json.RawMessage
+	if !exact {
+		patch, state = nil, data
+	}
+	if err := s.appendJournal(st.ID, ev, patch, state); err != nil {
+		return fmt.Errorf("journal workflow %s: %w", st.ID, err)
+	}
+	if err := s.write(st, data); err != nil {
+		return err
+	}
+	publishEvent(*ev)
+	return nil
+}
+
+func (s *Store) checkUnchanged(st *WorkflowState) error {
+	current, err := os.ReadFile(s.path(st.ID))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		if st.loadedData != nil {
+			return fmt.Errorf("workflow %s was removed while it was being updated", st.ID)
+		}
+	case err != nil:
+		return fmt.Errorf("read workflow %s: %w", st.ID, err)
+	case !bytes.Equal(current, st.loadedData):
+		return (&ToolError{
+			Message: fmt.Sprintf("workflow %s was modified externally since it was loaded", st.ID),
+			Hint:    "retry the call to operate on the latest state",
+		}).With("workflow_id", st.ID)
+	}
+	return nil
+}
+
+func (s *Store) write(st *WorkflowState, data []byte) error {
+	if err := writeFileAtomic(s.path(st.ID), data, 0644); err != nil {
+		return fmt.Errorf("save workflow %s: %w", st.ID, err)
+	}
+	st.loadedData = data
+
+	if s.ActiveID() == st.ID {
+		if err := writeFileAtomic(s.legacyFile, data, 0644); err != nil {
+			return fmt.Errorf("save %s: %w", s.legacyFile, err)
+		}
+	}
+	return nil
+}
+
+// List returns all non-archived workflows, most recently updated first.
+// Unreadable state files are reported on stderr and skipped.
+func (s *Store) List(includeArchived bool) ([]*WorkflowState, error) {
+	var workflows []*WorkflowState
+	dirs := []string{s.dir}
+	if includeArchived {
+		dirs = append(dirs, filepath.Join(s.dir, "archive"))
+	}
+	for _, dir := range dirs {
+		entries, err := os.ReadDir(dir)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), ".json") {
+				continue
+			}
+			path := filepath.Join(dir, e.Name())
+			data, err := os.ReadFile(path)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "workflow-mcp: skipping %s: %v\n", path, err)
+				continue
+			}
+			st := &WorkflowState{}
+			if err := json.Unmarshal(data, st); err != nil {
+				fmt.Fprintf(os.Stderr, "workflow-mcp: skipping corrupt %s: %v\n", path, err)
+				continue
+			}
+			workflows = append(workflows, st)
+		}
+	}
+	sort.Slice(workflows, func(i, j int) bool {
+		return workflows[i].UpdatedAt > workflows[j].UpdatedAt
+	})
+	return workflows, nil
+}
+
+// Stamps returns the fileStamp of every workflow that isn't archived, by
+// ID, without reading the files.
+func (s *Store) Stamps() (map[string]fileStamp, error) {
+	entries, err := os.ReadDir(s.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	stamps := map[string]fileStamp{}
+	for _, e := range entries {
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if e.IsDir() || !ok {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue // removed since ReadDir
+		}
+		stamps[id] = fileStamp{exists: true, size: info.Size(), modTime: info.ModTime()}
+	}
+	return stamps, nil
+}
+
+// ActiveID returns the active workflow ID, or "" if none is active.
+func (s *Store) ActiveID() string {
+	data, err := os.ReadFile(s.activeFile())
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// SetActive points the active workflow at id ("" clears it) and refreshes
+// the legacy state file to match.
+func (s *Store) SetActive(id string) error {
+	if id == "" {
+		for _, path := range []string{s.activeFile(), s.legacyFile} {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := writeFileAtomic(s.activeFile(), []byte(id+"\n"), 0644); err != nil {
+		return fmt.Errorf("set active workflow: %w", err)
+	}
+	data, err := os.ReadFile(s.path(id))
+	if err != nil {
+		return fmt.Errorf("read workflow %s: %w", id, err)
+	}
+	return writeFileAtomic(s.legacyFile, data, 0644)
+}
+
+// Archive moves a workflow out of the active set. If it was the active
+// workflow, no workflow is active afterwards.
+func (s *Store) Archive(st *WorkflowState) error {
+	wasActive := s.ActiveID() == st.ID
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode workflow %s: %w", st.ID, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(s.archivePath(st.ID)), 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.archivePath(st.ID), data, 0644); err != nil {
+		return fmt.Errorf("archive workflow %s: %w", st.ID, err)
+	}
+	if err := os.Remove(s.path(st.ID)); err != nil {
+		return fmt.Errorf("archive workflow %s: %w", st.ID, err)
+	}
+	if wasActive {
+		return s.SetActive("")
+	}
+	return nil
+}
+
+// migrateLegacy imports a pre-registry workflow_state.json as the active
+// workflow the first time the registry directory is created.
+func (s *Store) migrateLegacy() error {
+	if _, err := os.Stat(s.dir); err == nil {
+		return nil
+	}
+	data, err := os.ReadFile(s.legacyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	st := &WorkflowState{}
+	if err := json.Unmarshal(data, st); err != nil {
+		return fmt.Errorf("corrupt legacy state file %s: %w", s.legacyFile, err)
+	}
+	if err := checkWorkflowID(st.ID); err != nil {
+		return fmt.Errorf("legacy state file %s: %w", s.legacyFile, err)
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path(st.ID), data, 0644); err != nil {
+		return err
+	}
+	return s.SetActive(st.ID)
+}
+
+// writeFileAtomic replaces path with data so that readers (and a crash at
+// any point) see either the old or the new content, never a partial file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op after a successful rename
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// resolveWorkflow loads the workflow a tool call targets: the given ID, or
+// the active workflow when id is empty.
+func resolveWorkflow(id string) (*WorkflowState, error) {
+	if id == "" {
+		id = store.ActiveID()
+		if id == "" {
+			return nil, errNoWorkflow()
+		}
+	}
+	return store.Load(id)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Sub-workflows: a step with `uses:` runs another workflow. When the step
+// starts, a child workflow is created in the registry with ParentID and
+// ParentStep pointing back at it; step-level tools called on the parent
+// descend into the child; and when the child reaches done, the parent step
+// completes as if workflow_next had been called on it.
+
+const maxSubWorkflowDepth = 8
+
+// loadSubWorkflow resolves a `uses:` reference: a path ending in .yaml/.yml
+// (relative to the main config file), a name from the config's
+// `workflows:` section, or workflows/<name>.yaml next to the config file.
+func loadSubWorkflow(uses string) (*WorkflowConfig, error) {
+	baseDir := filepath.Dir(configFile)
+	path := ""
+	if strings.HasSuffix(uses, ".yaml") || strings.HasSuffix(uses, ".yml") {
+		path = uses
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(baseDir, path)
+		}
+	} else if cfg, ok := config.Workflows[uses]; ok && cfg != nil {
+		if cfg.Name == "" {
+			cfg.Name = uses
+		}
+		return cfg, nil
+	} else {
+		path = filepath.Join(baseDir, "workflows", uses+".yaml")
+	}
+
+	cfg, report, err := readConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("uses %q: %w", uses, err)
+	}
+	if len(report.Errors) > 0 {
+		return nil, fmt.Errorf("uses %q: %s", uses, report.Errors[0])
+	}
+	if cfg.Name == "" {
+		cfg.Name = uses
+	}
+	return cfg, nil
+}
+
+// startSubWorkflow creates and saves the child workflow for st's current
+// step if that step has `uses:` and no child yet. The caller saves st,
+// which now records the child's ID. It returns the new child, or nil.
+func startSubWorkflow(st *WorkflowState, depth int) (*WorkflowState, error) {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 || st.Steps[idx].Uses == "" || st.Steps[idx].ChildID != "" {
+		return nil, nil
+	}
+	step := &st.Steps[idx]
+	if depth >= maxSubWorkflowDepth {
+		return nil, toolError("step %s: sub-workflows nested more than %d deep", step.Name, maxSubWorkflowDepth)
+	}
+
+	cfg, err := loadSubWorkflow(step.Uses)
+	if err != nil {
+		return nil, toolError("step %s: %v", step.Name, err)
+	}
+	child := newWorkflowState(cfg, fmt.Sprintf("%s [%s]", st.Task, step.Name))
+	child.ParentID = st.ID
+	child.ParentStep = step.Name
+
+	// The child's own first step may run a sub-workflow too
+	if _, err := startSubWorkflow(child, depth+1); err != nil {
+		return nil, err
+	}
+
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "init",
+		WorkflowID: child.ID,
+		Step:       child.CurrentStep,
+		Status:     "in_progress",
+		Message:    fmt.Sprintf("Sub-workflow %s started for step %s of %s", cfg.Name, step.Name, st.ID),
+		CanIterate: cfg.Steps[0].AllowsIteration,
+		Timestamp:  time.Now().UTC().Format(time.RFC3339),
+	}
+	if err := store.Commit(child, &event); err != nil {
+		return nil, err
+	}
+	step.ChildID = child.ID
+	return child, nil
+}
+
+// activeLeaf follows running sub-workflows down from st to the workflow
+// whose steps are actually being worked on.
+func activeLeaf(st *WorkflowState) (*WorkflowState, error) {
+	for depth := 0; depth < maxSubWorkflowDepth; depth++ {
+		idx := stepIndex(st, st.CurrentStep)
+		if idx < 0 || st.Steps[idx].ChildID == "" {
+			return st, nil
+		}
+		child, err := store.Load(st.Steps[idx].ChildID)
+		if err != nil {
+			return nil, err
+		}
+		if child.CurrentStep == doneStep {
+			return st, nil
+		}
+		st = child
+	}
+	return st, nil
+}
+
+// finishSubWorkflow completes the parent's step once child has reached
+// done, by running workflow_next on the parent. It returns the parent's
+// response, or nil if child is not a finished sub-workflow.
+func finishSubWorkflow(child *WorkflowState) (json.RawMessage, error) {
+	if child.CurrentStep != doneStep || child.ParentID == "" {
+		return nil, nil
+	}
+	parent, err := store.Load(child.ParentID)
+	if err != nil {
+		return nil, err
+	}
+	idx := stepIndex(parent, child.ParentStep)
+	if idx < 0 || parent.Steps[idx].ChildID != child.ID || parent.CurrentStep != child.ParentStep {
+		return nil, nil // the parent has moved on, e.g. after a rollback
+	}
+
+	outcome := outcomeSuccess
+	for _, s := range child.Steps {
+		if s.Outcome != "" {
+			outcome = s.Outcome // the last step that reported one
+		}
+	}
+	output, err := workflowNext(parent, outcome)
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(output), nil
+}
+
+// subWorkflowResult adds sub-workflow details to a next/approve response
+// once st has been committed: the child started for the new step, or the
+// parent's response if st was a sub-workflow that just finished.
+func subWorkflowResult(st, child *WorkflowState, result map[string]any) error {
+	if child != nil {
+		result["sub_workflow"] = subWorkflowSummary(child)
+		result["message"] = fmt.Sprintf("Step %s runs the %s workflow; its steps are now current", st.CurrentStep, child.Workflow)
+	}
+	parent, err := finishSubWorkflow(st)
+	if err != nil {
+		return err
+	}
+	if parent != nil {
+		result["parent"] = parent
+		result["message"] = fmt.Sprintf("Sub-workflow done; step %s of %s completed", st.ParentStep, st.ParentID)
+	}
+	return nil
+}
+
+// subWorkflowSummary is how a child workflow is shown in its parent's
+// responses.
+func subWorkflowSummary(child *WorkflowState) map[string]any {
+	_, instructions, requiresApproval, allowsIteration := stepInfo(child, child.CurrentStep)
+	return map[string]any{
+		"workflow_id":       child.ID,
+		"workflow":          child.Workflow,
+		"current_step":      child.CurrentStep,
+		"progress":          fmt.Sprintf("%.0f%%", rolledUpProgress(child)),
+		"requires_approval": requiresApproval,
+		"allows_iteration":  allowsIteration,
+		"instructions":      instructions,
+	}
+}
+
+// rolledUpProgress is workflowProgress with a running sub-workflow's
+// progress counted as a fraction of its parent step.
+func rolledUpProgress(st *WorkflowState) float64 {
+	progress := workflowProgress(st)
+	if len(st.Steps) == 0 {
+		return progress
+	}
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 || st.Steps[idx].ChildID == "" {
+		return progress
+	}
+	child, err := store.Load(st.Steps[idx].ChildID)
+	if err != nil {
+		return progress
+	}
+	return progress + rolledUpProgress(child)/float64(len(st.Steps))
+}
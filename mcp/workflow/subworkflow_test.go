@@ -0,0 +1,113 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+const subWorkflowTestConfig = `name: release
+steps:
+  - name: plan
+    instructions: Plan it.
+  - name: qa
+    uses: %s
+    on_failure: plan
+  - name: ship
+    instructions: Ship it.
+workflows:
+  feature:
+    steps:
+      - name: implement
+        instructions: Implement it.
+      - name: test
+        instructions: Test it.
+`
+
+const securityWorkflow = `name: security
+steps:
+  - name: scan
+    instructions: Scan it.
+`
+
+func TestSubWorkflows(t *testing.T) {
+	tests := []struct {
+		name      string
+		uses      string
+		calls     []toolCall
+		want      string // parent's step statuses afterwards, see stepStatuses
+		wantChild string // the qa child's step statuses afterwards
+	}{
+		{
+			name: "child steps are current",
+			uses: "feature",
+			calls: []toolCall{
+				{tool: "workflow_status", want: map[string]any{"current_step": "qa", "sub_workflow.workflow": "feature", "sub_workflow.current_step": "implement"}},
+				{tool: "workflow_next", want: map[string]any{"current_step": "test", "previous_step": "implement"}},
+			},
+			want:      "plan=completed qa=in_progress ship=pending",
+			wantChild: "implement=completed test=in_progress",
+		},
+		{
+			name: "finished child completes the parent step",
+			uses: "feature",
+			calls: []toolCall{
+				{tool: "workflow_next"},
+				{tool: "workflow_next", want: map[string]any{"current_step": doneStep, "parent.previous_step": "qa", "parent.current_step": "ship"}},
+				{tool: "workflow_status", want: map[string]any{"current_step": "ship", "sub_workflow": nil}},
+			},
+			want:      "plan=completed qa=completed ship=in_progress",
+			wantChild: "implement=completed test=completed",
+		},
+		{
+			name: "child failure follows the parent step's on_failure",
+			uses: "feature",
+			calls: []toolCall{
+				{tool: "workflow_next"},
+				{tool: "workflow_next", args: `{"outcome":"failure"}`, want: map[string]any{"parent.current_step": "plan"}},
+			},
+			want:      "plan=in_progress qa=pending ship=pending",
+			wantChild: "implement=completed test=completed",
+		},
+		{
+			name: "sub-workflow from a file",
+			uses: "security.yaml",
+			calls: []toolCall{
+				{tool: "workflow_status", want: map[string]any{"sub_workflow.workflow": "security", "sub_workflow.current_step": "scan"}},
+				{tool: "workflow_next", want: map[string]any{"parent.current_step": "ship"}},
+			},
+			want:      "plan=completed qa=completed ship=in_progress",
+			wantChild: "scan=completed",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testServer(t, strings.Replace(subWorkflowTestConfig, "%s", tt.uses, 1), "security.yaml", securityWorkflow)
+			runCalls(t, append([]toolCall{
+				{tool: "workflow_init", args: `{"task":"release"}`},
+				{tool: "workflow_next", want: map[string]any{"current_step": "qa"}},
+			}, tt.calls...))
+
+			parent := activeState(t)
+			if got := stepStatuses(parent); got != tt.want {
+				t.Errorf("parent steps = %s, want %s", got, tt.want)
+			}
+			// A step that goes back forgets its child, so look it up by parent
+			workflows, err := store.List(false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var child *WorkflowState
+			for _, w := range workflows {
+				if w.ParentID == parent.ID && w.ParentStep == "qa" {
+					child = w
+				}
+			}
+			if child == nil {
+				t.Fatal("no sub-workflow for step qa")
+			}
+			if got := stepStatuses(child); got != tt.wantChild {
+				t.Errorf("child steps = %s, want %s", got, tt.wantChild)
+			}
+		})
+	}
+}
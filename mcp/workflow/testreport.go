@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Test reports. workflow_ingest_test_report reads the output of a test
+// runner (go test -json, JUnit XML or TAP) and stores it as the
+// test_results artifact in one shape, TestReport, whatever produced it;
+// workflow_run_checks stores its results the same way. Transitions can
+// then test artifacts.test_results.content.failed, and the dashboard can
+// show the failures.
+
+const (
+	testPassed  = "passed"
+	testFailed  = "failed"
+	testSkipped = "skipped"
+)
+
+var testReportFormats = []string{"go_test_json", "junit", "tap"}
+
+// testMessageLimit is how much of a failure message is kept per case.
+const testMessageLimit = 2048
+
+// TestReport is the content of the test_results artifact.
+type TestReport struct {
+	Format     string      `json:"format"`           // go_test_json, junit, tap, or checks for workflow_run_checks
+	Source     string      `json:"source,omitempty"` // file it was read from
+	Total      int         `json:"total"`
+	Passed     int         `json:"passed"`
+	Failed     int         `json:"failed"`
+	Skipped    int         `json:"skipped"`
+	DurationMS int64       `json:"duration_ms"`
+	Suites     []TestSuite `json:"suites"`
+}
+
+// TestSuite is a group of test cases: a Go package, a JUnit <testsuite>,
+// or a TAP stream.
+type TestSuite struct {
+	Name       string     `json:"name"`
+	Total      int        `json:"total"`
+	Passed     int        `json:"passed"`
+	Failed     int        `json:"failed"`
+	Skipped    int        `json:"skipped"`
+	DurationMS int64      `json:"duration_ms"`
+	Cases      []TestCase `json:"cases"`
+}
+
+// TestCase is one test and how it ended.
+type TestCase struct {
+	Name       string `json:"name"`
+	Classname  string `json:"classname,omitempty"`
+	Status     string `json:"status"` // passed, failed or skipped
+	DurationMS int64  `json:"duration_ms"`
+	Message    string `json:"message,omitempty"` // why it failed or was skipped
+}
+
+// count fills in the totals of r and its suites from their cases. A
+// suite's duration is the sum of its cases' if the report didn't give one.
+func (r *TestReport) count() {
+	r.Total, r.Passed, r.Failed, r.Skipped = 0, 0, 0, 0
+	if r.Suites == nil {
+		r.Suites = []TestSuite{}
+	}
+	sumDurations := r.DurationMS == 0
+	for i := range r.Suites {
+		s := &r.Suites[i]
+		s.Total, s.Passed, s.Failed, s.Skipped = len(s.Cases), 0, 0, 0
+		var sum int64
+		for _, c := range s.Cases {
+			switch c.Status {
+			case testPassed:
+				s.Passed++
+			case testFailed:
+				s.Failed++
+			case testSkipped:
+				s.Skipped++
+			}
+			sum += c.DurationMS
+		}
+		if s.DurationMS == 0 {
+			s.DurationMS = sum
+		}
+		r.Total += s.Total
+		r.Passed += s.Passed
+		r.Failed += s.Failed
+		r.Skipped += s.Skipped
+		if sumDurations {
+			r.DurationMS += s.DurationMS
+		}
+	}
+}
+
+// summary describes r in one line, e.g. "junit: 40 passed, 2 failed,
+// 1 skipped (43 tests in 12.3s)".
+func (r *TestReport) summary() string {
+	took := time.Duration(r.DurationMS) * time.Millisecond
+	if took >= time.Second {
+		took = took.Round(100 * time.Millisecond)
+	}
+	return fmt.Sprintf("%s: %d passed, %d failed, %d skipped (%d tests in %s)", r.Format, r.Passed, r.Failed, r.Skipped, r.Total, took)
+}
+
+// failures lists the failed cases of r, at most limit of them.
+func (r *TestReport) failures(limit int) []map[string]any {
+	out := []map[string]any{}
+	for _, s := range r.Suites {
+		for _, c := range s.Cases {
+			if c.Status == testFailed && len(out) < limit {
+				out = append(out, map[string]any{"suite": s.Name, "name": c.Name, "message": c.Message})
+			}
+		}
+	}
+	return out
+}
+
+func secondsToMS(s float64) int64 {
+	return int64(s*1000 + 0.5)
+}
+
+// truncateMessage keeps the start of a long failure message.
+func truncateMessage(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) <= testMessageLimit {
+		return s
+	}
+	return strings.ToValidUTF8(s[:testMessageLimit], "") + "\n[...]"
+}
+
+// parseTestReport parses data in format.
+func parseTestReport(format string, data []byte) (*TestReport, error) {
+	var report *TestReport
+	var err error
+	switch format {
+	case "go_test_json":
+		report, err = parseGoTestJSON(data)
+	case "junit":
+		report, err = parseJUnit(data)
+	case "tap":
+		report, err = parseTAP(data)
+	default:
+		return nil, (&ToolError{
+			Message: fmt.Sprintf("unknown test report format %q", format),
+			Hint:    "use " + strings.Join(testReportFormats, ", "),
+		}).With("formats", testReportFormats)
+	}
+	if err != nil {
+		return nil, err
+	}
+	report.Format = format
+	report.count()
+	return report, nil
+}
+
+// goTestEvent is a line of `go test -json` output (see `go doc
+// test2json`).
+type goTestEvent struct {
+	Action      string
+	Package     string
+	Test        string
+	Elapsed     float64
+	Output      string
+	ImportPath  string // build-output events
+	FailedBuild string // set on a package's fail event if it didn't build
+}
+
+// parseGoTestJSON reads `go test -json` output: a suite per package, a case
+// per test (subtests included). A package that failed outside any test,
+// e.g. didn't build, gets a failed case of its own. Lines that aren't
+// JSON, such as build errors printed by older Go versions, are ignored.
+func parseGoTestJSON(data []byte) (*TestReport, error) {
+	type testState struct {
+		c      TestCase
+		output *tailBuffer
+	}
+	type pkgState struct {
+		suite  TestSuite
+		tests  []*testState
+		byName map[string]*testState
+		output *tailBuffer
+		failed bool
+	}
+	var packages []*pkgState
+	byPkg := map[string]*pkgState{}
+	buildOutput := map[string]*tailBuffer{}
+	events := 0
+
+	scanner := bufio.NewScanner(strings.NewReader(string(data)))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(line, "{") {
+			continue
+		}
+		var ev goTestEvent
+		if json.Unmarshal([]byte(line), &ev) != nil || ev.Action == "" {
+			continue
+		}
+		events++
+
+		if ev.Action == "build-output" || ev.Action == "build-fail" {
+			if buildOutput[ev.ImportPath] == nil {
+				buildOutput[ev.ImportPath] = &tailBuffer{limit: testMessageLimit}
+			}
+			buildOutput[ev.ImportPath].Write([]byte(ev.Output))
+			continue
+		}
+
+		pkg := byPkg[ev.Package]
+		if pkg == nil {
+			pkg = &pkgState{suite: TestSuite{Name: ev.Package}, byName: map[string]*testState{}, output: &tailBuffer{limit: testMessageLimit}}
+			byPkg[ev.Package] = pkg
+			packages = append(packages, pkg)
+		}
+		if ev.Test == "" {
+			switch ev.Action {
+			case "output":
+				pkg.output.Write([]byte(ev.Output))
+			case "pass", "fail", "skip":
+				pkg.suite.DurationMS = secondsToMS(ev.Elapsed)
+				pkg.failed = ev.Action == "fail"
+				if out := buildOutput[ev.FailedBuild]; ev.FailedBuild != "" && out != nil {
+					pkg.output = out
+				}
+			}
+			continue
+		}
+
+		test := pkg.byName[ev.Test]
+		if test == nil {
+			test = &testState{c: TestCase{Name: ev.Test}, output: &tailBuffer{limit: testMessageLimit}}
+			pkg.byName[ev.Test] = test
+			pkg.tests = append(pkg.tests, test)
+		}
+		switch ev.Action {
+		case "output":
+			test.output.Write([]byte(ev.Output))
+		case "pass":
+			test.c.Status = testPassed
+		case "fail":
+			test.c.Status = testFailed
+		case "skip":
+			test.c.Status = testSkipped
+		}
+		if ev.Action == "pass" || ev.Action == "fail" || ev.Action == "skip" {
+			test.c.DurationMS = secondsToMS(ev.Elapsed)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, toolError("can't read go test -json output: %v", err)
+	}
+	if events == 0 {
+		return nil, &ToolError{
+			Message: "no go test -json events found",
+			Hint:    "run the tests with `go test -json ./...` and pass its output",
+		}
+	}
+
+	report := &TestReport{}
+	for _, pkg := range packages {
+		anyFailed := false
+		for _, t := range pkg.tests {
+			if t.c.Status == "" {
+				// The test binary died before reporting this test
+				t.c.Status = testFailed
+			}
+			if t.c.Status != testPassed {
+				t.c.Message = truncateMessage(t.output.String())
+			}
+			anyFailed = anyFailed || t.c.Status == testFailed
+			pkg.suite.Cases = append(pkg.suite.Cases, t.c)
+		}
+		if pkg.failed && !anyFailed {
+			// A build failure, or a failure outside any test
+			pkg.suite.Cases = append(pkg.suite.Cases, TestCase{
+				Name:       pkg.suite.Name,
+				Status:     testFailed,
+				DurationMS: pkg.suite.DurationMS,
+				Message:    truncateMessage(pkg.output.String()),
+			})
+		}
+		if len(pkg.suite.Cases) > 0 {
+			report.Suites = append(report.Suites, pkg.suite)
+		}
+	}
+	return report, nil
+}
+
+type junitSuite struct {
+	Name   string       `xml:"name,attr"`
+	Time   string       `xml:"time,attr"`
+	Cases  []junitCase  `xml:"testcase"`
+	Suites []junitSuite `xml:"testsuite"`
+}
+
+type junitCase struct {
+	Name      string        `xml:"name,attr"`
+	Classname string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure"`
+	Error     *junitMessage `xml:"error"`
+	Skipped   *junitMessage `xml:"skipped"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+func (m *junitMessage) String() string {
+	msg, text := strings.TrimSpace(m.Message), strings.TrimSpace(m.Text)
+	switch {
+	case text == "" || text == msg:
+		return truncateMessage(msg)
+	case msg == "":
+		return truncateMessage(text)
+	}
+	return truncateMessage(msg + "\n" + text)
+}
+
+// junitSeconds parses a JUnit time attribute, which some tools write with
+// thousands separators.
+func junitSeconds(s string) int64 {
+	f, _ := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(s), ",", ""), 64)
+	return secondsToMS(f)
+}
+
+// parseJUnit reads JUnit XML: a <testsuites> root or a single <testsuite>.
+// Nested suites are flattened; <error> counts as a failure.
+func parseJUnit(data []byte) (*TestReport, error) {
+	var root struct {
+		XMLName xml.Name
+		junitSuite
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, (&ToolError{
+			Message: fmt.Sprintf("can't parse JUnit XML: %v", err),
+			Hint:    "pass the XML report written by the test runner",
+		}).With("format", "junit")
+	}
+
+	report := &TestReport{}
+	var add func(s junitSuite)
+	add = func(s junitSuite) {
+		if len(s.Cases) > 0 {
+			suite := TestSuite{Name: s.Name, DurationMS: junitSeconds(s.Time)}
+			for _, jc := range s.Cases {
+				c := TestCase{Name: jc.Name, Classname: jc.Classname, Status: testPassed, DurationMS: junitSeconds(jc.Time)}
+				switch {
+				case jc.Failure != nil:
+					c.Status, c.Message = testFailed, jc.Failure.String()
+				case jc.Error != nil:
+					c.Status, c.Message = testFailed, jc.Error.String()
+				case jc.Skipped != nil:
+					c.Status, c.Message = testSkipped, jc.Skipped.String()
+				}
+				suite.Cases = append(suite.Cases, c)
+			}
+			report.Suites = append(report.Suites, suite)
+		}
+		for _, nested := range s.Suites {
+			add(nested)
+		}
+	}
+	switch root.XMLName.Local {
+	case "testsuites":
+		report.DurationMS = junitSeconds(root.Time)
+		add(root.junitSuite)
+	case "testsuite":
+		add(root.junitSuite)
+	default:
+		return nil, (&ToolError{
+			Message: fmt.Sprintf("can't parse JUnit XML: root element is <%s>", root.XMLName.Local),
+			Hint:    "a JUnit report starts with <testsuites> or <testsuite>",
+		}).With("format", "junit")
+	}
+	return report, nil
+}
+
+var (
+	tapTestLine  = regexp.MustCompile(`^(not )?ok\b\s*(\d+)?\s*(?:-\s*)?(.*)$`)
+	tapDirective = regexp.MustCompile(`(?i)\s#\s*(skip|todo)\S*\s*(.*)$`)
+	tapPlan      = regexp.MustCompile(`^1\.\.(\d+)`)
+	tapBailOut   = regexp.MustCompile(`^Bail out!\s*(.*)$`)
+)
+
+// parseTAP reads a TAP stream as one suite. Only top-level test lines are
+// cases; indented subtests, and their diagnostics, are left to the test
+// that contains them. A YAML diagnostic block after a test, indented
+// deeper than the test line, supplies its failure message and, if it has
+// duration_ms (as node --test writes), its duration.
+func parseTAP(data []byte) (*TestReport, error) {
+	lines := strings.Split(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	suite := TestSuite{Name: "tap"}
+	planned := -1
+	// last is the top-level case that a diagnostic block may follow, and
+	// lastIndent the indentation of the latest test line at any depth
+	var last *TestCase
+	lastIndent := 0
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		if m := tapPlan.FindStringSubmatch(line); m != nil {
+			planned, _ = strconv.Atoi(m[1])
+			continue
+		}
+		if m := tapBailOut.FindStringSubmatch(line); m != nil {
+			suite.Cases = append(suite.Cases, TestCase{Name: "Bail out!", Status: testFailed, Message: m[1]})
+			last = nil
+			break
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+		if strings.TrimSpace(line) == "---" {
+			var block []string
+			for i++; i < len(lines) && strings.TrimSpace(lines[i]) != "..."; i++ {
+				l := lines[i]
+				if len(l) >= indent {
+					l = l[indent:]
+				}
+				block = append(block, l)
+			}
+			// A block belongs to the test line just above it, which must
+			// be a top-level one
+			if last != nil && lastIndent == 0 && indent > 0 {
+				applyTAPDiagnostics(last, block)
+			}
+			continue
+		}
+		m := tapTestLine.FindStringSubmatch(line[indent:])
+		if m == nil {
+			continue
+		}
+		lastIndent = indent
+		if indent > 0 {
+			continue
+		}
+
+		c := TestCase{Name: strings.TrimSpace(m[3]), Status: testPassed}
+		if m[1] != "" {
+			c.Status = testFailed
+		}
+		if d := tapDirective.FindStringSubmatchIndex(c.Name); d != nil {
+			directive := strings.ToLower(c.Name[d[2]:d[3]])
+			reason := strings.TrimSpace(c.Name[d[4]:d[5]])
+			c.Name = strings.TrimSpace(c.Name[:d[0]])
+			switch {
+			case directive == "skip":
+				c.Status, c.Message = testSkipped, reason
+			case c.Status == testFailed:
+				// A failing TODO test is expected to fail
+				c.Status, c.Message = testSkipped, strings.TrimSpace("TODO "+reason)
+			}
+		}
+		if c.Name == "" {
+			c.Name = "test " + m[2]
+		}
+		suite.Cases = append(suite.Cases, c)
+		last = &suite.Cases[len(suite.Cases)-1]
+	}
+
+	if len(suite.Cases) == 0 {
+		return nil, &ToolError{
+			Message: "no TAP test lines found",
+			Hint:    "pass TAP output: lines such as \"ok 1 - description\" and \"not ok 2 - description\"",
+		}
+	}
+	if planned > len(suite.Cases) {
+		suite.Cases = append(suite.Cases, TestCase{
+			Name:    "plan",
+			Status:  testFailed,
+			Message: fmt.Sprintf("planned %d tests, but only %d ran", planned, len(suite.Cases)),
+		})
+	}
+	return &TestReport{Suites: []TestSuite{suite}}, nil
+}
+
+// applyTAPDiagnostics takes the duration and failure message of c from the
+// lines of its YAML diagnostic block.
+func applyTAPDiagnostics(c *TestCase, block []string) {
+	message := ""
+	for _, l := range block {
+		key, value, ok := strings.Cut(strings.TrimSpace(l), ":")
+		if !ok || strings.HasPrefix(l, " ") {
+			continue
+		}
+		value = strings.Trim(strings.TrimSpace(value), `'"`)
+		switch key {
+		case "duration_ms":
+			if f, err := strconv.ParseFloat(value, 64); err == nil {
+				c.DurationMS = int64(f + 0.5)
+			}
+		case "message", "error":
+			if message == "" && value != "" && value != "|-" && value != "|" {
+				message = value
+			}
+		}
+	}
+	if c.Status == testFailed {
+		if message == "" {
+			message = strings.Join(block, "\n")
+		}
+		c.Message = truncateMessage(message)
+	}
+}
+
+// workflowIngestTestReport parses a test runner's report, from the file at
+// path (relative to the project directory) or from data, and stores it as
+// st's test_results artifact.
+func workflowIngestTestReport(st *WorkflowState, format, path, data string) (string, error) {
+	if (path == "") == (data == "") {
+		return "", &ToolError{
+			Message: "give either path or data",
+			Hint:    "path names a report file (relative to the project directory); data is the report itself",
+		}
+	}
+	raw := []byte(data)
+	if path != "" {
+		file := path
+		if !filepath.IsAbs(file) {
+			file = filepath.Join(projectDir(), file)
+		}
+		var err error
+		if raw, err = os.ReadFile(file); err != nil {
+			return "", toolError("can't read test report: %v", err).With("path", file)
+		}
+	}
+
+	report, err := parseTestReport(format, raw)
+	if err != nil {
+		return "", err
+	}
+	report.Source = path
+
+	artifact, added := putArtifact(st, "test_results", report)
+	now := artifact.UpdatedAt
+	st.UpdatedAt = now
+
+	status := testPassed
+	if report.Failed > 0 {
+		status = testFailed
+	}
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "test_report",
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
+		Status:     status,
+		Message:    report.summary(),
+		Timestamp:  now,
+	}
+
+	if err := store.Commit(st, &event); err != nil {
+		return "", err
+	}
+	artifactUpdated(st, "test_results", added)
+
+	suites := []map[string]any{}
+	for _, s := range report.Suites {
+		suites = append(suites, map[string]any{
+			"name": s.Name, "total": s.Total, "passed": s.Passed, "failed": s.Failed, "skipped": s.Skipped, "duration_ms": s.DurationMS,
+		})
+	}
+	output, _ := json.MarshalIndent(map[string]any{
+		"ingested":    true,
+		"format":      format,
+		"total":       report.Total,
+		"passed":      report.Passed,
+		"failed":      report.Failed,
+		"skipped":     report.Skipped,
+		"duration_ms": report.DurationMS,
+		"suites":      suites,
+		"failures":    report.failures(20),
+		"revision":    artifact.Revision,
+		"event":       event,
+	}, "", "  ")
+	return string(output), nil
+}
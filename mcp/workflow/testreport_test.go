@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// reportCases lists r's cases as "suite|name|status|duration_ms|message".
+func reportCases(r *TestReport) []string {
+	var out []string
+	for _, s := range r.Suites {
+		for _, c := range s.Cases {
+			out = append(out, fmt.Sprintf("%s|%s|%s|%d|%s", s.Name, c.Name, c.Status, c.DurationMS, c.Message))
+		}
+	}
+	return out
+}
+
+func TestParseTestReport(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		data   string
+
+		want       []string // see reportCases
+		wantTotals [4]int   // total, passed, failed, skipped
+		wantMS     int64
+		wantErr    string
+	}{
+		{
+			name:   "go test -json",
+			format: "go_test_json",
+			data: `{"Action":"start","Package":"example.com/a"}
+{"Action":"run","Package":"example.com/a","Test":"TestOK"}
+{"Action":"output","Package":"example.com/a","Test":"TestOK","Output":"=== RUN   TestOK\n"}
+{"Action":"pass","Package":"example.com/a","Test":"TestOK","Elapsed":0.01}
+{"Action":"run","Package":"example.com/a","Test":"TestBad"}
+{"Action":"run","Package":"example.com/a","Test":"TestBad/sub"}
+{"Action":"output","Package":"example.com/a","Test":"TestBad/sub","Output":"    a_test.go:9: got 1, want 2\n"}
+{"Action":"fail","Package":"example.com/a","Test":"TestBad/sub","Elapsed":0.002}
+{"Action":"fail","Package":"example.com/a","Test":"TestBad","Elapsed":0.003}
+{"Action":"skip","Package":"example.com/a","Test":"TestSkip","Elapsed":0}
+{"Action":"fail","Package":"example.com/a","Elapsed":0.5}
+not json at all
+`,
+			want: []string{
+				"example.com/a|TestOK|passed|10|",
+				"example.com/a|TestBad|failed|3|",
+				"example.com/a|TestBad/sub|failed|2|a_test.go:9: got 1, want 2",
+				"example.com/a|TestSkip|skipped|0|",
+			},
+			wantTotals: [4]int{4, 1, 2, 1},
+			wantMS:     500,
+		},
+		{
+			name:   "go test -json build failure",
+			format: "go_test_json",
+			data: `{"ImportPath":"example.com/b [example.com/b.test]","Action":"build-output","Output":"b.go:3:1: syntax error\n"}
+{"ImportPath":"example.com/b [example.com/b.test]","Action":"build-fail"}
+{"Action":"start","Package":"example.com/b"}
+{"Action":"output","Package":"example.com/b","Output":"FAIL\texample.com/b [build failed]\n"}
+{"Action":"fail","Package":"example.com/b","Elapsed":0,"FailedBuild":"example.com/b [example.com/b.test]"}
+`,
+			want:       []string{"example.com/b|example.com/b|failed|0|b.go:3:1: syntax error"},
+			wantTotals: [4]int{1, 0, 1, 0},
+		},
+		{
+			name:   "go test -json test binary died",
+			format: "go_test_json",
+			data: `{"Action":"run","Package":"example.com/c","Test":"TestPanics"}
+{"Action":"output","Package":"example.com/c","Test":"TestPanics","Output":"panic: boom\n"}
+{"Action":"fail","Package":"example.com/c","Elapsed":0.1}
+`,
+			want:       []string{"example.com/c|TestPanics|failed|0|panic: boom"},
+			wantTotals: [4]int{1, 0, 1, 0},
+			wantMS:     100,
+		},
+		{
+			name:    "go test -json without events",
+			format:  "go_test_json",
+			data:    "ok  \texample.com/a\t0.01s\n",
+			wantErr: "no go test -json events found",
+		},
+		{
+			name:   "junit",
+			format: "junit",
+			data: `<?xml version="1.0"?>
+<testsuites time="1,234.5">
+  <testsuite name="outer" time="2">
+    <testcase name="ok" classname="pkg.Outer" time="0.5"/>
+    <testcase name="fails" classname="pkg.Outer" time="1.5">
+      <failure message="expected 2">at Outer.java:10</failure>
+    </testcase>
+    <testsuite name="inner">
+      <testcase name="errors" time="0.25"><error message="NullPointerException"/></testcase>
+      <testcase name="skips"><skipped message="not on CI"/></testcase>
+    </testsuite>
+  </testsuite>
+</testsuites>`,
+			want: []string{
+				"outer|ok|passed|500|",
+				"outer|fails|failed|1500|expected 2\nat Outer.java:10",
+				"inner|errors|failed|250|NullPointerException",
+				"inner|skips|skipped|0|not on CI",
+			},
+			wantTotals: [4]int{4, 1, 2, 1},
+			wantMS:     1234500,
+		},
+		{
+			name:   "junit single suite",
+			format: "junit",
+			data: `<testsuite name="only">
+  <testcase name="a" time="0.1"/>
+  <testcase name="b" time="0.2"><failure>same</failure></testcase>
+</testsuite>`,
+			want:       []string{"only|a|passed|100|", "only|b|failed|200|same"},
+			wantTotals: [4]int{2, 1, 1, 0},
+			wantMS:     300,
+		},
+		{
+			name:    "junit with another root",
+			format:  "junit",
+			data:    `<report/>`,
+			wantErr: "root element is <report>",
+		},
+		{
+			name:    "junit that isn't XML",
+			format:  "junit",
+			data:    `{"tests": []}`,
+			wantErr: "can't parse JUnit XML",
+		},
+		{
+			name:   "tap",
+			format: "tap",
+			data: `TAP version 13
+1..6
+ok 1 - adds numbers
+not ok 2 - divides by zero
+  ---
+  message: 'division by zero'
+  duration_ms: 4.6
+  ...
+ok 3 - windows paths # SKIP not on linux
+not ok 4 - flaky thing # TODO fix later
+ok 5
+# a comment
+not ok 6 - crashes
+  ---
+  stack: |
+    at crash.js:1
+  ...
+`,
+			want: []string{
+				"tap|adds numbers|passed|0|",
+				"tap|divides by zero|failed|5|division by zero",
+				"tap|windows paths|skipped|0|not on linux",
+				"tap|flaky thing|skipped|0|TODO fix later",
+				"tap|test 5|passed|0|",
+				"tap|crashes|failed|0|stack: |\n  at crash.js:1",
+			},
+			wantTotals: [4]int{6, 2, 2, 2},
+			wantMS:     5,
+		},
+		{
+			name:   "tap subtests",
+			format: "tap",
+			data: `TAP version 13
+# Subtest: parent
+    # Subtest: child
+    not ok 1 - child
+      ---
+      duration_ms: 7
+      error: 'child broke'
+      ...
+    1..1
+not ok 1 - parent
+  ---
+  duration_ms: 12
+  error: '1 subtest failed'
+  ...
+ok 2 - other
+    # Subtest: late
+    ok 1 - late
+      ---
+      duration_ms: 99
+      ...
+1..2
+`,
+			want: []string{
+				"tap|parent|failed|12|1 subtest failed",
+				"tap|other|passed|0|",
+			},
+			wantTotals: [4]int{2, 1, 1, 0},
+			wantMS:     12,
+		},
+		{
+			name:   "tap with fewer tests than planned",
+			format: "tap",
+			data:   "1..3\nok 1 - one\n",
+			want: []string{
+				"tap|one|passed|0|",
+				"tap|plan|failed|0|planned 3 tests, but only 1 ran",
+			},
+			wantTotals: [4]int{2, 1, 1, 0},
+		},
+		{
+			name:   "tap bail out",
+			format: "tap",
+			data:   "1..3\nok 1 - one\nBail out! database is down\nok 2 - two\n",
+			want: []string{
+				"tap|one|passed|0|",
+				"tap|Bail out!|failed|0|database is down",
+				"tap|plan|failed|0|planned 3 tests, but only 2 ran",
+			},
+			wantTotals: [4]int{3, 1, 2, 0},
+		},
+		{
+			name:    "tap without test lines",
+			format:  "tap",
+			data:    "1..0\n# nothing\n",
+			wantErr: "no TAP test lines found",
+		},
+		{
+			name:    "unknown format",
+			format:  "xunit",
+			data:    "",
+			wantErr: `unknown test report format "xunit"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			report, err := parseTestReport(tt.format, []byte(tt.data))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("parseTestReport() error = %v, want it to mention %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseTestReport() error = %v", err)
+			}
+			if report.Format != tt.format {
+				t.Errorf("format = %s, want %s", report.Format, tt.format)
+			}
+			if got := reportCases(report); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cases =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+			if got := [4]int{report.Total, report.Passed, report.Failed, report.Skipped}; got != tt.wantTotals {
+				t.Errorf("totals = %v, want %v", got, tt.wantTotals)
+			}
+			if report.DurationMS != tt.wantMS {
+				t.Errorf("duration_ms = %d, want %d", report.DurationMS, tt.wantMS)
+			}
+		})
+	}
+}
+
+func TestTruncateMessage(t *testing.T) {
+	long := strings.Repeat("é", testMessageLimit) // two bytes each
+	got := truncateMessage(long)
+	if !strings.HasSuffix(got, "\n[...]") {
+		t.Errorf("truncated message doesn't end in [...]")
+	}
+	if body := strings.TrimSuffix(got, "\n[...]"); len(body) > testMessageLimit || !strings.HasPrefix(long, body) {
+		t.Errorf("truncated message keeps %d bytes that aren't a prefix of the original", len(body))
+	}
+	if got := truncateMessage("  short  "); got != "short" {
+		t.Errorf("truncateMessage(short) = %q", got)
+	}
+}
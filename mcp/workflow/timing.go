@@ -0,0 +1,360 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// Timing. A step's attempts record when it started, when it began waiting
+// for approval and when it ended, so workflow_status can say how long the
+// workflow and its current step have taken. A step may set warn_after and
+// timeout, measured from when it started: while a server runs, a watcher
+// emits a step_overdue event when either passes (once per attempt), and
+// with on_timeout: block marks the step blocked at the timeout. stale_after
+// in the config flags workflows nobody has touched for that long, with a
+// workflow_stale event.
+
+// onTimeoutBlock marks a step blocked when its timeout passes.
+const onTimeoutBlock = "block"
+
+// deadlinePoll is how often the watcher looks for overdue steps.
+var deadlinePoll = time.Minute
+
+// parseDuration parses a warn_after, timeout or stale_after setting; ""
+// is no limit.
+func parseDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q: use e.g. 45m, 2h or 72h", s)
+	}
+	return d, nil
+}
+
+// parseTime parses a timestamp from the state; the zero time if unset.
+func parseTime(s string) time.Time {
+	t, _ := time.Parse(time.RFC3339, s)
+	return t
+}
+
+// formatDuration rounds d to the second for display.
+func formatDuration(d time.Duration) string {
+	return d.Round(time.Second).String()
+}
+
+// openAttempt returns step's attempt in progress, or nil.
+func openAttempt(step *WorkflowStep) *StepAttempt {
+	n := len(step.Attempts)
+	if n == 0 || step.Attempts[n-1].CompletedAt != "" || step.Attempts[n-1].StartedAt == "" {
+		return nil
+	}
+	return &step.Attempts[n-1]
+}
+
+// workflowElapsed is how long st has been running, or took if it is done.
+func workflowElapsed(st *WorkflowState, now time.Time) time.Duration {
+	end := now
+	if st.CurrentStep == doneStep {
+		end = parseTime(st.UpdatedAt)
+	}
+	return end.Sub(parseTime(st.CreatedAt))
+}
+
+// stepTiming describes how long step's current attempt has been running
+// against its limits.
+func stepTiming(step *WorkflowStep, now time.Time) map[string]any {
+	a := openAttempt(step)
+	if a == nil {
+		return nil
+	}
+	started := parseTime(a.StartedAt)
+	elapsed := now.Sub(started)
+	timing := map[string]any{
+		"step":       step.Name,
+		"started_at": a.StartedAt,
+		"elapsed":    formatDuration(elapsed),
+		"overdue":    false,
+	}
+	if a.AwaitingApprovalAt != "" {
+		timing["awaiting_approval_since"] = a.AwaitingApprovalAt
+		timing["awaiting_approval_for"] = formatDuration(now.Sub(parseTime(a.AwaitingApprovalAt)))
+	}
+	if warnAfter, _ := parseDuration(step.WarnAfter); warnAfter > 0 {
+		timing["warn_after"] = step.WarnAfter
+		timing["warning"] = elapsed >= warnAfter
+	}
+	if timeout, _ := parseDuration(step.Timeout); timeout > 0 {
+		timing["timeout"] = step.Timeout
+		timing["overdue"] = elapsed >= timeout
+		if elapsed < timeout {
+			timing["remaining"] = formatDuration(timeout - elapsed)
+		}
+	}
+	return timing
+}
+
+// currentStepTimings returns the timing of st's current step and, for a
+// parallel group, of its running branches.
+func currentStepTimings(st *WorkflowState, now time.Time) []map[string]any {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return nil
+	}
+	var timings []map[string]any
+	if t := stepTiming(&st.Steps[idx], now); t != nil {
+		timings = append(timings, t)
+	}
+	for i := range st.Steps[idx].Parallel {
+		if t := stepTiming(&st.Steps[idx].Parallel[i], now); t != nil {
+			timings = append(timings, t)
+		}
+	}
+	return timings
+}
+
+// isOverdue reports whether st's current step (or a running branch) is past
+// its timeout.
+func isOverdue(st *WorkflowState, now time.Time) bool {
+	for _, t := range currentStepTimings(st, now) {
+		if t["overdue"] == true {
+			return true
+		}
+	}
+	return false
+}
+
+// lastActivity is when st, or the sub-workflow it is running, last changed.
+func lastActivity(st *WorkflowState) time.Time {
+	last := parseTime(st.UpdatedAt)
+	if leaf, err := activeLeaf(st); err == nil {
+		if t := parseTime(leaf.UpdatedAt); t.After(last) {
+			last = t
+		}
+	}
+	return last
+}
+
+// staleFor returns how long st has been idle if that is longer than the
+// config's stale_after, or 0. Finished workflows and sub-workflows (whose
+// parent is checked instead) are never stale.
+func staleFor(st *WorkflowState, now time.Time) time.Duration {
+	staleAfter, _ := parseDuration(config.StaleAfter)
+	if staleAfter == 0 || st.ParentID != "" || st.CurrentStep == doneStep || st.ArchivedAt != "" {
+		return 0
+	}
+	if idle := now.Sub(lastActivity(st)); idle >= staleAfter {
+		return idle
+	}
+	return 0
+}
+
+// watchDeadlines checks workflows for overdue steps and stale workflows
+// until the process exits, loading only those with a deadline due (see
+// deadlineIndex). Several servers may share the state directory; the store
+// lock and the times recorded on each attempt keep them from reporting the
+// same deadline twice.
+func watchDeadlines() {
+	ticker := time.NewTicker(deadlinePoll)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := withLock(func() (struct{}, error) { return struct{}{}, checkDeadlines(time.Now()) }); err != nil {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: checking deadlines: %v\n", err)
+		}
+	}
+}
+
+// deadlineIndex remembers when each workflow next has a deadline to check,
+// so a tick only loads the workflows with one due. An entry holds as long as
+// the workflow's file and the config's stale_after are unchanged; any
+// commit, by this server or another, changes the file.
+var deadlineIndex = map[string]deadlineEntry{}
+
+type deadlineEntry struct {
+	stamp      fileStamp
+	staleAfter string
+	due        time.Time // zero: nothing comes due until the workflow changes
+}
+
+// checkDeadlines emits the step_overdue and workflow_stale events due at
+// now, logging the workflows it can't update. The caller holds the store
+// lock.
+func checkDeadlines(now time.Time) error {
+	stamps, err := store.Stamps()
+	if err != nil {
+		return err
+	}
+	for id := range deadlineIndex {
+		if _, ok := stamps[id]; !ok {
+			delete(deadlineIndex, id)
+		}
+	}
+	for id, stamp := range stamps {
+		if e, ok := deadlineIndex[id]; ok && e.stamp.equal(stamp) && e.staleAfter == config.StaleAfter && (e.due.IsZero() || now.Before(e.due)) {
+			continue
+		}
+		delete(deadlineIndex, id)
+		st, err := store.Load(id)
+		if err != nil {
+			continue
+		}
+		// A workflow whose events can't be committed mustn't hold up the
+		// deadlines of the others
+		if err := checkStepDeadlines(st, now); err != nil {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: checking deadlines of %s: %v\n", st.ID, err)
+			continue
+		}
+		if err := checkStale(st, now); err != nil {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: checking deadlines of %s: %v\n", st.ID, err)
+			continue
+		}
+		if stamp, ok := statWorkflow(id); ok {
+			deadlineIndex[id] = deadlineEntry{stamp: stamp, staleAfter: config.StaleAfter, due: nextDeadline(st, now)}
+		}
+	}
+	return nil
+}
+
+// statWorkflow returns the fileStamp of workflow id's file.
+func statWorkflow(id string) (fileStamp, bool) {
+	info, err := os.Stat(store.path(id))
+	if err != nil {
+		return fileStamp{}, false
+	}
+	return fileStamp{exists: true, size: info.Size(), modTime: info.ModTime()}, true
+}
+
+// nextDeadline returns the earliest time after now at which checkDeadlines
+// could have something to report for st, or the zero time if nothing comes
+// due until st changes.
+func nextDeadline(st *WorkflowState, now time.Time) time.Time {
+	var due time.Time
+	earliest := func(t time.Time) {
+		if due.IsZero() || t.Before(due) {
+			due = t
+		}
+	}
+	if idx := stepIndex(st, st.CurrentStep); idx >= 0 {
+		steps := []*WorkflowStep{&st.Steps[idx]}
+		for i := range st.Steps[idx].Parallel {
+			steps = append(steps, &st.Steps[idx].Parallel[i])
+		}
+		for _, step := range steps {
+			a := openAttempt(step)
+			if a == nil || step.Status == "blocked" {
+				continue
+			}
+			started := parseTime(a.StartedAt)
+			if warnAfter, _ := parseDuration(step.WarnAfter); warnAfter > 0 && a.WarnedAt == "" {
+				earliest(started.Add(warnAfter))
+			}
+			if timeout, _ := parseDuration(step.Timeout); timeout > 0 && a.OverdueAt == "" {
+				earliest(started.Add(timeout))
+			}
+		}
+		// Activity in a running sub-workflow counts for its parent without
+		// changing the parent's file, so such a parent is checked each tick
+		if st.Steps[idx].ChildID != "" && config.StaleAfter != "" {
+			earliest(now)
+		}
+	}
+	if staleAfter, _ := parseDuration(config.StaleAfter); staleAfter > 0 && st.ParentID == "" && st.CurrentStep != doneStep && st.ArchivedAt == "" {
+		if last := lastActivity(st); parseTime(st.StaleNotifiedAt).Before(last) {
+			earliest(last.Add(staleAfter))
+		}
+	}
+	return due
+}
+
+// checkStepDeadlines handles warn_after and timeout for st's current step
+// and its running branches.
+func checkStepDeadlines(st *WorkflowState, now time.Time) error {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return nil
+	}
+	steps := []*WorkflowStep{&st.Steps[idx]}
+	for i := range st.Steps[idx].Parallel {
+		steps = append(steps, &st.Steps[idx].Parallel[i])
+	}
+	for _, step := range steps {
+		a := openAttempt(step)
+		if a == nil || step.Status == "blocked" {
+			continue
+		}
+		elapsed := now.Sub(parseTime(a.StartedAt))
+		warnAfter, _ := parseDuration(step.WarnAfter)
+		timeout, _ := parseDuration(step.Timeout)
+		stamp := now.UTC().Format(time.RFC3339)
+
+		event := WorkflowEvent{
+			Event:      "workflow",
+			Type:       "step_overdue",
+			WorkflowID: st.ID,
+			Step:       step.Name,
+			Timestamp:  stamp,
+		}
+		switch {
+		case timeout > 0 && elapsed >= timeout && a.OverdueAt == "":
+			a.OverdueAt = stamp
+			if a.WarnedAt == "" {
+				a.WarnedAt = stamp // no separate warning after the timeout
+			}
+			event.Status = "timeout"
+			event.Message = fmt.Sprintf("step %s has been running for %s, past its timeout of %s", step.Name, formatDuration(elapsed), step.Timeout)
+		case warnAfter > 0 && elapsed >= warnAfter && a.WarnedAt == "":
+			a.WarnedAt = stamp
+			event.Status = "warning"
+			event.Message = fmt.Sprintf("step %s has been running for %s (warn_after %s)", step.Name, formatDuration(elapsed), step.WarnAfter)
+		default:
+			continue
+		}
+		if err := store.Commit(st, &event); err != nil {
+			return err
+		}
+
+		// Only work in progress is blocked; a step waiting for approval
+		// stays approvable
+		if event.Status == "timeout" && step.OnTimeout == onTimeoutBlock && step.Status == "in_progress" {
+			step.Status = "blocked"
+			syncActiveSteps(st)
+			st.UpdatedAt = stamp
+			blocked := WorkflowEvent{
+				Event:      "workflow",
+				Type:       "blocked",
+				WorkflowID: st.ID,
+				Step:       step.Name,
+				Status:     "blocked",
+				Message:    fmt.Sprintf("timed out after %s", step.Timeout),
+				Timestamp:  stamp,
+			}
+			if err := store.Commit(st, &blocked); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkStale emits workflow_stale once per idle period. It doesn't touch
+// UpdatedAt, which would end the idle period it reports.
+func checkStale(st *WorkflowState, now time.Time) error {
+	idle := staleFor(st, now)
+	if idle == 0 || !parseTime(st.StaleNotifiedAt).Before(lastActivity(st)) {
+		return nil
+	}
+	stamp := now.UTC().Format(time.RFC3339)
+	st.StaleNotifiedAt = stamp
+	event := WorkflowEvent{
+		Event:      "workflow",
+		Type:       "workflow_stale",
+		WorkflowID: st.ID,
+		Step:       st.CurrentStep,
+		Status:     "stale",
+		Message:    fmt.Sprintf("no activity for %s (stale_after %s)", formatDuration(idle), config.StaleAfter),
+		Timestamp:  stamp,
+	}
+	return store.Commit(st, &event)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const timingTestConfig = `name: timed
+stale_after: 1h
+steps:
+  - name: build
+    warn_after: 10m
+    timeout: 30m
+    on_timeout: block
+    instructions: Build it.
+  - name: ship
+    instructions: Ship it.
+`
+
+func TestCheckDeadlines(t *testing.T) {
+	testServer(t, timingTestConfig)
+	runCalls(t, []toolCall{{tool: "workflow_init", args: `{"task":"timed"}`}})
+	st := activeState(t)
+	started := parseTime(st.Steps[0].Attempts[0].StartedAt)
+
+	tests := []struct {
+		after      time.Duration // since the step started
+		wantStatus string
+		warned     bool
+		overdue    bool
+		wantDue    time.Time
+	}{
+		{after: time.Minute, wantStatus: "in_progress", wantDue: started.Add(10 * time.Minute)},
+		{after: 5 * time.Minute, wantStatus: "in_progress", wantDue: started.Add(10 * time.Minute)},
+		{after: 11 * time.Minute, wantStatus: "in_progress", warned: true, wantDue: started.Add(30 * time.Minute)},
+		// Blocked at the timeout, so only staleness is left to come due
+		{after: 31 * time.Minute, wantStatus: "blocked", warned: true, overdue: true, wantDue: started.Add(31*time.Minute + time.Hour)},
+	}
+	for _, tt := range tests {
+		now := started.Add(tt.after)
+		if err := checkDeadlines(now); err != nil {
+			t.Fatalf("checkDeadlines(+%s) error = %v", tt.after, err)
+		}
+		st := activeState(t)
+		step := st.Steps[0]
+		a := step.Attempts[len(step.Attempts)-1]
+		if step.Status != tt.wantStatus || (a.WarnedAt != "") != tt.warned || (a.OverdueAt != "") != tt.overdue {
+			t.Errorf("+%s: status %s, warned_at %q, overdue_at %q; want %s, warned %v, overdue %v",
+				tt.after, step.Status, a.WarnedAt, a.OverdueAt, tt.wantStatus, tt.warned, tt.overdue)
+		}
+		e, ok := deadlineIndex[st.ID]
+		if !ok {
+			t.Fatalf("+%s: workflow missing from the deadline index", tt.after)
+		}
+		if !e.due.Equal(tt.wantDue) {
+			t.Errorf("+%s: next deadline %s, want %s", tt.after, e.due.Format(time.RFC3339), tt.wantDue.Format(time.RFC3339))
+		}
+	}
+}
+
+func TestNextDeadlineFinished(t *testing.T) {
+	testServer(t, timingTestConfig)
+	runCalls(t, []toolCall{
+		{tool: "workflow_init", args: `{"task":"timed"}`},
+		{tool: "workflow_next"},
+		{tool: "workflow_next", want: map[string]any{"current_step": doneStep}},
+	})
+	if due := nextDeadline(activeState(t), time.Now()); !due.IsZero() {
+		t.Errorf("finished workflow has a deadline at %s", due.Format(time.RFC3339))
+	}
+}
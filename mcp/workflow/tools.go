@@ -0,0 +1,631 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Tool describes an MCP tool as advertised by tools/list.
+type Tool struct {
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	InputSchema map[string]any `json:"inputSchema"`
+}
+
+var tools = []Tool{
+	{
+		Name:        "workflow_init",
+		Description: "Initialize a new workflow with a task description. Returns workflow config and first step instructions.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"task": map[string]any{
+					"type":        "string",
+					"description": "Description of the task",
+				},
+			},
+			"required": []string{"task"},
+		},
+	},
+	{
+		Name:        "workflow_list",
+		Description: "List all workflows in this workspace with their current step and progress. The active workflow is used when other tools are called without a workflow_id.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"include_archived": map[string]any{
+					"type":        "boolean",
+					"description": "Also list archived workflows",
+				},
+			},
+		},
+	},
+	{
+		Name:        "workflow_config",
+		Description: "Show the loaded workflow.yaml (or the built-in default) with any validation errors and warnings",
+		InputSchema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{},
+		},
+	},
+	{
+		Name:        "workflow_switch",
+		Description: "Make another workflow the active one. Subsequent tool calls without a workflow_id operate on it.",
+		InputSchema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{},
+			"required":   []string{"workflow_id"},
+		},
+	},
+	{
+		Name:        "workflow_archive",
+		Description: "Archive a workflow (defaults to the active one) so it no longer appears in workflow_list.",
+		InputSchema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{},
+		},
+	},
+	{
+		Name:        "workflow_status",
+		Description: "Get current workflow status, progress, and step instructions",
+		InputSchema: map[string]any{
+			"type":       "object",
+			"properties": map[string]any{},
+		},
+	},
+	{
+		Name:        "workflow_step",
+		Description: "Update workflow step status",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"step": map[string]any{
+					"type":        "string",
+					"description": "Step name, or a branch of the current parallel group",
+				},
+				"status": map[string]any{
+					"type":        "string",
+					"description": "New status (in_progress, completed, blocked)",
+					"enum":        []string{"in_progress", "completed", "blocked"},
+				},
+			},
+			"required": []string{"step", "status"},
+		},
+	},
+	{
+		Name:        "workflow_blocked",
+		Description: "Mark workflow as blocked due to external dependencies (not for approval gates)",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"reason": map[string]any{
+					"type":        "string",
+					"description": "Reason for blocking (external dependency)",
+				},
+			},
+			"required": []string{"reason"},
+		},
+	},
+	{
+		Name:        "workflow_next",
+		Description: "Request to move to the next step. If step requires approval, sets status to awaiting_approval. Otherwise moves to next step, following the step's on_success/on_failure/next transitions if configured.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"outcome": map[string]any{
+					"type":        "string",
+					"description": "How the step ended (default success). A failure follows the step's on_failure transition, e.g. verify back to execute.",
+					"enum":        []string{"success", "failure"},
+				},
+			},
+		},
+	},
+	{
+		Name:        "workflow_approve",
+		Description: "Approve the current step and move to the next step. Only works when step is awaiting_approval. Steps with approval_mode human_token also need the approval code the user received out of band.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"approval_code": map[string]any{
+					"type":        "string",
+					"description": "One-time approval code or signed approval token given to you by the user",
+				},
+			},
+		},
+	},
+	{
+		Name:        "workflow_iterate",
+		Description: "Provide feedback and iterate on the current step. Keeps you on the same step to revise based on feedback.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"feedback": map[string]any{
+					"type":        "string",
+					"description": "Feedback for iteration - what needs to change",
+				},
+			},
+			"required": []string{"feedback"},
+		},
+	},
+	{
+		Name:        "workflow_reject",
+		Description: "Send the workflow back to an earlier step when the problem lies there (e.g. the plan was wrong), rather than revising the current step. That step and every later one go back to pending; artifacts they produced are kept but marked stale.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"to": map[string]any{
+					"type":        "string",
+					"description": "Step to go back to (default: the last completed step)",
+				},
+				"reason": map[string]any{
+					"type":        "string",
+					"description": "What was wrong, to guide redoing the step",
+				},
+			},
+			"required": []string{"reason"},
+		},
+	},
+	{
+		Name:        "workflow_set_criteria",
+		Description: "Set verification criteria to be checked in the verify step",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"criteria": map[string]any{
+					"type": "array",
+					"items": map[string]any{
+						"anyOf": []any{
+							map[string]any{"type": "string"},
+							map[string]any{
+								"type": "object",
+								"properties": map[string]any{
+									"text":  map[string]any{"type": "string"},
+									"check": checkSchema,
+								},
+								"required": []string{"text"},
+							},
+						},
+					},
+					"description": "List of verification criteria (tests to run, checks to perform). Give a criterion as {text, check: {command, ...}} to have workflow_run_checks verify it.",
+				},
+			},
+			"required": []string{"criteria"},
+		},
+	},
+	{
+		Name:        "workflow_update_criterion",
+		Description: "Record the result of one verification criterion. Steps with requires_criteria_pass can't complete until every criterion has passed or been waived.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"id": map[string]any{
+					"type":        "string",
+					"description": "Criterion ID (c1, c2, ...; see the criteria artifact)",
+				},
+				"status": map[string]any{
+					"type":        "string",
+					"description": "Result: pass, fail, waived (needs evidence saying why) or pending",
+					"enum":        criterionStatuses,
+				},
+				"evidence": map[string]any{
+					"type":        "string",
+					"description": "What shows the result: test output, a command and its result, a link",
+				},
+			},
+			"required": []string{"id", "status"},
+		},
+	},
+	{
+		Name:        "workflow_run_checks",
+		Description: "Run the current step's checks and the commands attached to criteria in the project directory. Results (exit code, duration, end of stdout/stderr) are stored as the test_results artifact, and the criteria they verify are marked pass or fail.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"name": map[string]any{
+					"type":        "string",
+					"description": "Run only this check (its name, or the ID of the criterion it verifies)",
+				},
+			},
+		},
+	},
+	{
+		Name:        "workflow_ingest_test_report",
+		Description: "Store a test runner's report as the test_results artifact. go test -json, JUnit XML and TAP are read into one schema (suites, cases, status, duration, failure message), and the totals are reported in the event.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"format": map[string]any{
+					"type":        "string",
+					"description": "Report format: go_test_json (go test -json output), junit (JUnit XML) or tap",
+					"enum":        testReportFormats,
+				},
+				"path": map[string]any{
+					"type":        "string",
+					"description": "Report file, relative to the project directory",
+				},
+				"data": map[string]any{
+					"type":        "string",
+					"description": "The report itself, instead of path",
+				},
+			},
+			"required": []string{"format"},
+		},
+	},
+	{
+		Name:        "workflow_set_plan",
+		Description: "Store the implementation plan (markdown). Shorthand for workflow_set_artifact with type 'plan'.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"plan": map[string]any{
+					"type":        "string",
+					"description": "The implementation plan in markdown",
+				},
+			},
+			"required": []string{"plan"},
+		},
+	},
+	{
+		Name:        "workflow_set_artifact",
+		Description: "Store an artifact (plan, criteria, test results, etc.) in the workflow state. Artifacts are keyed by type and can be retrieved by vibe apps.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"type": map[string]any{
+					"type":        "string",
+					"description": "Artifact type (e.g., 'plan', 'criteria', 'pr', 'test_results')",
+				},
+				"content": map[string]any{
+					"description": "The artifact content (string, array, or object)",
+				},
+			},
+			"required": []string{"type", "content"},
+		},
+	},
+	{
+		Name:        "workflow_get_artifact",
+		Description: "Read an artifact, the latest revision or an earlier one. Every workflow_set_artifact call adds a revision; the response lists them all with the step and iteration that produced them.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"type": map[string]any{
+					"type":        "string",
+					"description": "Artifact type (e.g., 'plan', 'criteria')",
+				},
+				"revision": map[string]any{
+					"type":        "integer",
+					"description": "Revision number, from 1 (default: the latest)",
+				},
+			},
+			"required": []string{"type"},
+		},
+	},
+	{
+		Name:        "workflow_diff_artifact",
+		Description: "Show what changed between two revisions of a text or list artifact, as a unified diff",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"type": map[string]any{
+					"type":        "string",
+					"description": "Artifact type (e.g., 'plan', 'criteria')",
+				},
+				"from_revision": map[string]any{
+					"type":        "integer",
+					"description": "Older revision (default: the one before to_revision)",
+				},
+				"to_revision": map[string]any{
+					"type":        "integer",
+					"description": "Newer revision (default: the latest)",
+				},
+			},
+			"required": []string{"type"},
+		},
+	},
+	{
+		Name:        "workflow_set_pr",
+		Description: "Set the PR details for tracking. Used by the review step to monitor comments.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"pr_number": map[string]any{
+					"type":        "integer",
+					"description": "The pull request number",
+				},
+				"pr_url": map[string]any{
+					"type":        "string",
+					"description": "The pull request URL",
+				},
+				"branch": map[string]any{
+					"type":        "string",
+					"description": "The branch name (e.g., feature/todo-app)",
+				},
+			},
+			"required": []string{"pr_number", "pr_url", "branch"},
+		},
+	},
+	{
+		Name:        "workflow_check_pr",
+		Description: "Check if there are new PR comments since last check. Returns comment status and suggests next action: address_comments, wait (check again after wait_seconds), ready_for_human_review once the quiet period passes without new comments, or escalate after the step's max_wait.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"comment_count": map[string]any{
+					"type":        "integer",
+					"description": "Current number of comments on the PR (from gh pr view)",
+				},
+			},
+			"required": []string{"comment_count"},
+		},
+	},
+	{
+		Name:        "workflow_events",
+		Description: "Page through the workflow's event journal. Pass the returned next_since as since to fetch newer events.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"since": map[string]any{
+					"type":        "integer",
+					"description": "Return events with a sequence number greater than this (default 0)",
+				},
+				"limit": map[string]any{
+					"type":        "integer",
+					"description": "Maximum number of events to return (default 50, max 500)",
+				},
+			},
+		},
+	},
+	{
+		Name:        "workflow_history",
+		Description: "Show every attempt of each step: when it started and ended, the iteration feedback it got, who approved it and how it ended. Unlike iteration_count, this survives moving to the next step.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"step": map[string]any{
+					"type":        "string",
+					"description": "Only this step or parallel branch (default: all steps)",
+				},
+			},
+		},
+	},
+	{
+		Name:        "workflow_replay",
+		Description: "Rebuild the workflow state from its event journal for auditing, optionally as of an earlier event.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"until_seq": map[string]any{
+					"type":        "integer",
+					"description": "Stop after this event sequence number (default: replay the whole journal)",
+				},
+			},
+		},
+	},
+	{
+		Name:        "workflow_migrate",
+		Description: "Move an in-flight workflow onto the current workflow.yaml after it changed. Steps are matched by name; the response reports added, removed, renamed and changed steps.",
+		InputSchema: map[string]any{
+			"type": "object",
+			"properties": map[string]any{
+				"renames": map[string]any{
+					"type":        "object",
+					"description": "Old step name -> new step name, for renames that can't be inferred",
+				},
+				"resume_at": map[string]any{
+					"type":        "string",
+					"description": "Step to continue from if the current step was removed",
+				},
+				"dry_run": map[string]any{
+					"type":        "boolean",
+					"description": "Report the changes without applying them",
+				},
+			},
+		},
+	},
+}
+
+// checkSchema describes a Check given with a criterion.
+var checkSchema = map[string]any{
+	"type":        "object",
+	"description": "Command that verifies the criterion, run by workflow_run_checks",
+	"properties": map[string]any{
+		"command":   map[string]any{"type": "string", "description": "Shell command, run in the project directory"},
+		"dir":       map[string]any{"type": "string", "description": "Directory to run it in, relative to the project directory"},
+		"timeout":   map[string]any{"type": "string", "description": "How long it may take, e.g. 90s or 5m (default 10m)"},
+		"exit_code": map[string]any{"type": "integer", "description": "Exit code that means success (default 0)"},
+	},
+	"required": []string{"command"},
+}
+
+// Every tool except workflow_init, workflow_list and workflow_config
+// operates on an existing workflow and accepts an optional workflow_id;
+// without one the active workflow is used.
+func init() {
+	for _, tool := range tools {
+		if tool.Name == "workflow_init" || tool.Name == "workflow_list" || tool.Name == "workflow_config" {
+			continue
+		}
+		tool.InputSchema["properties"].(map[string]any)["workflow_id"] = map[string]any{
+			"type":        "string",
+			"description": "Workflow to operate on (defaults to the active workflow)",
+		}
+	}
+}
+
+func findTool(name string) *Tool {
+	for i := range tools {
+		if tools[i].Name == name {
+			return &tools[i]
+		}
+	}
+	return nil
+}
+
+// validateArgs checks tool arguments against the subset of JSON Schema used
+// by our inputSchemas: required keys, primitive types, enums, array items
+// and anyOf.
+func validateArgs(schema map[string]any, args map[string]any) error {
+	if required, ok := schema["required"].([]string); ok {
+		for _, key := range required {
+			if _, present := args[key]; !present {
+				return fmt.Errorf("missing required argument %q", key)
+			}
+		}
+	}
+
+	properties, _ := schema["properties"].(map[string]any)
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		prop, ok := properties[key].(map[string]any)
+		if !ok {
+			continue // unknown arguments are ignored
+		}
+		if err := validateValue(prop, args[key]); err != nil {
+			return fmt.Errorf("argument %q: %v", key, err)
+		}
+	}
+	return nil
+}
+
+func validateValue(prop map[string]any, value any) error {
+	if typ, ok := prop["type"].(string); ok {
+		if !matchesType(typ, value) {
+			return fmt.Errorf("expected %s, got %s", typ, jsonTypeName(value))
+		}
+	}
+	if enum, ok := prop["enum"].([]string); ok {
+		s, _ := value.(string)
+		found := false
+		for _, allowed := range enum {
+			if s == allowed {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("must be one of %v", enum)
+		}
+	}
+	if alternatives, ok := prop["anyOf"].([]any); ok {
+		var errs []string
+		for _, alt := range alternatives {
+			err := validateValue(alt.(map[string]any), value)
+			if err == nil {
+				errs = nil
+				break
+			}
+			errs = append(errs, err.Error())
+		}
+		if errs != nil {
+			return fmt.Errorf("matches none of the allowed forms (%s)", strings.Join(errs, "; "))
+		}
+	}
+	if object, ok := value.(map[string]any); ok && prop["type"] == "object" {
+		if err := validateArgs(prop, object); err != nil {
+			return err
+		}
+	}
+	if items, ok := prop["items"].(map[string]any); ok {
+		if list, ok := value.([]any); ok {
+			for i, item := range list {
+				if err := validateValue(items, item); err != nil {
+					return fmt.Errorf("item %d: %v", i, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func matchesType(typ string, value any) bool {
+	switch typ {
+	case "string":
+		_, ok := value.(string)
+		return ok
+	case "integer":
+		n, ok := value.(float64)
+		return ok && n == math.Trunc(n)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	case "boolean":
+		_, ok := value.(bool)
+		return ok
+	case "array":
+		_, ok := value.([]any)
+		return ok
+	case "object":
+		_, ok := value.(map[string]any)
+		return ok
+	}
+	return true
+}
+
+func jsonTypeName(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "string"
+	case float64:
+		if v == math.Trunc(v) {
+			return "integer"
+		}
+		return "number"
+	case bool:
+		return "boolean"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// Argument accessors. Arguments are validated against the tool's inputSchema
+// before dispatch, so these only need to handle absent optional values.
+
+func stringArg(args map[string]any, key string) string {
+	s, _ := args[key].(string)
+	return s
+}
+
+func boolArg(args map[string]any, key string) bool {
+	b, _ := args[key].(bool)
+	return b
+}
+
+func intArg(args map[string]any, key string) int {
+	n, _ := args[key].(float64)
+	return int(n)
+}
+
+func stringMapArg(args map[string]any, key string) map[string]string {
+	out := map[string]string{}
+	if m, ok := args[key].(map[string]any); ok {
+		for k, v := range m {
+			if s, ok := v.(string); ok {
+				out[k] = s
+			}
+		}
+	}
+	return out
+}
+
+func stringsArg(args map[string]any, key string) []string {
+	out := []string{}
+	if list, ok := args[key].([]any); ok {
+		for _, item := range list {
+			if s, ok := item.(string); ok {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
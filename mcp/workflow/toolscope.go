@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Step-scoped tools. tools/list shows the workflow management tools at all
+// times, but only the step-level tools that make sense for the current step
+// of the active workflow (or of the sub-workflow it is running):
+//
+//   - workflow_step, workflow_blocked, workflow_next and
+//     workflow_set_artifact on every step
+//   - workflow_approve and workflow_reject on steps with needs_approval
+//   - workflow_iterate on steps with allows_iteration
+//   - workflow_update_criterion, workflow_run_checks and
+//     workflow_ingest_test_report on steps with requires_criteria_pass or
+//     checks
+//   - workflow_check_pr on steps with a review block
+//   - the tools the built-in steps are for on steps with their names:
+//     workflow_set_plan on plan, workflow_set_criteria on criteria,
+//     workflow_set_pr on pr and workflow_check_pr on review
+//
+// A step's `tools:` list replaces these defaults, and calls to step-level
+// tools it doesn't list are refused. Clients get
+// notifications/tools/list_changed when the list changes.
+
+// alwaysStepTools are listed on every step that has no `tools:`.
+var alwaysStepTools = []string{"workflow_step", "workflow_blocked", "workflow_next", "workflow_set_artifact"}
+
+// criteriaStepTools are listed on steps that verify criteria.
+var criteriaStepTools = []string{"workflow_update_criterion", "workflow_run_checks", "workflow_ingest_test_report"}
+
+// namedStepTools are listed on steps named after the built-in steps that
+// use them, unless the capabilities above list them already.
+var namedStepTools = map[string][]string{
+	"plan":     {"workflow_set_plan"},
+	"criteria": {"workflow_set_criteria"},
+	"pr":       {"workflow_set_pr"},
+	"review":   {"workflow_check_pr"},
+}
+
+// stepToolNames returns the step-level tools available on step.
+func stepToolNames(step *WorkflowStep) []string {
+	if len(step.Tools) > 0 {
+		return step.Tools
+	}
+	names := append([]string{}, alwaysStepTools...)
+	if step.NeedsApproval {
+		names = append(names, "workflow_approve", "workflow_reject")
+	}
+	if step.Metadata != nil && step.Metadata.AllowsIteration {
+		names = append(names, "workflow_iterate")
+	}
+	if step.RequiresCriteriaPass || len(step.Checks) > 0 {
+		names = append(names, criteriaStepTools...)
+	}
+	if step.Review != nil {
+		names = append(names, "workflow_check_pr")
+	}
+	for _, name := range namedStepTools[step.Name] {
+		if !containsString(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// currentStepTools returns the step-level tools for st's current step: for
+// a parallel group, those of the group and its running branches.
+func currentStepTools(st *WorkflowState) map[string]bool {
+	allowed := map[string]bool{}
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return allowed
+	}
+	step := &st.Steps[idx]
+	for _, name := range stepToolNames(step) {
+		allowed[name] = true
+	}
+	for i := range step.Parallel {
+		if step.Parallel[i].Status == "in_progress" {
+			for _, name := range stepToolNames(&step.Parallel[i]) {
+				allowed[name] = true
+			}
+		}
+	}
+	return allowed
+}
+
+// visibleTools returns the tools to list right now. The caller holds the
+// store lock.
+func visibleTools() []Tool {
+	var allowed map[string]bool
+	if st, err := resolveWorkflow(""); err == nil {
+		if leaf, err := activeLeaf(st); err == nil && leaf.CurrentStep != doneStep {
+			allowed = currentStepTools(leaf)
+		}
+	}
+
+	visible := []Tool{}
+	for _, tool := range tools {
+		if !stepTools[tool.Name] || allowed[tool.Name] {
+			visible = append(visible, tool)
+		}
+	}
+	return visible
+}
+
+// listTools answers tools/list and remembers what was listed, so that
+// toolListSink can tell when it changes.
+func listTools() []Tool {
+	visible, err := withLock(func() ([]Tool, error) { return visibleTools(), nil })
+	if err != nil {
+		return tools
+	}
+	listedTools.Lock()
+	listedTools.key = toolsKey(visible)
+	listedTools.Unlock()
+	return visible
+}
+
+var listedTools struct {
+	sync.Mutex
+	key string
+}
+
+func toolsKey(list []Tool) string {
+	names := make([]string, len(list))
+	for i, t := range list {
+		names[i] = t.Name
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// toolListSink is an event sink that notifies clients when an event (a
+// step transition, a new or switched workflow) changes the tools listed.
+func toolListSink(WorkflowEvent) {
+	key := toolsKey(visibleTools())
+	listedTools.Lock()
+	changed := listedTools.key != "" && key != listedTools.key
+	if changed {
+		listedTools.key = key
+	}
+	listedTools.Unlock()
+	if changed {
+		broadcast("notifications/tools/list_changed", nil)
+	}
+}
+
+// checkToolAllowed refuses a step-level tool that the current step's
+// `tools:` list leaves out. Steps without a list allow every tool, since
+// their defaults only shape what is listed.
+func checkToolAllowed(st *WorkflowState, name string) error {
+	idx := stepIndex(st, st.CurrentStep)
+	if idx < 0 {
+		return nil
+	}
+	step := &st.Steps[idx]
+	restricted := len(step.Tools) > 0
+	for i := range step.Parallel {
+		restricted = restricted || len(step.Parallel[i].Tools) > 0
+	}
+	if !restricted {
+		return nil
+	}
+	allowed := currentStepTools(st)
+	if allowed[name] {
+		return nil
+	}
+	names := make([]string, 0, len(allowed))
+	for n := range allowed {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return (&ToolError{
+		Message: fmt.Sprintf("%s is not available in step %s", name, st.CurrentStep),
+		Hint:    "this step's tools: list in workflow.yaml allows " + strings.Join(names, ", "),
+	}).With("step", st.CurrentStep).With("tools", names)
+}
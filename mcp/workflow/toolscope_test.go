@@ -0,0 +1,89 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStepToolNamesDefaultWorkflow(t *testing.T) {
+	always := alwaysStepTools
+	tests := []struct {
+		step string
+		want []string
+	}{
+		{"plan", append(append([]string{}, always...), "workflow_approve", "workflow_reject", "workflow_iterate", "workflow_set_plan")},
+		{"criteria", append(append([]string{}, always...), "workflow_approve", "workflow_reject", "workflow_iterate", "workflow_set_criteria")},
+		{"execute", append(append([]string{}, always...), "workflow_iterate")},
+		{"verify", append(append([]string{}, always...), "workflow_iterate", "workflow_update_criterion", "workflow_run_checks", "workflow_ingest_test_report")},
+		{"pr", append(append([]string{}, always...), "workflow_set_pr")},
+		{"review", append(append([]string{}, always...), "workflow_iterate", "workflow_check_pr")},
+		{"human_review", append(append([]string{}, always...), "workflow_approve", "workflow_reject")},
+		{"complete", always},
+	}
+
+	st := newWorkflowState(defaultConfig(), "test")
+	if len(st.Steps) != len(tests) {
+		t.Fatalf("default workflow has %d steps, want %d", len(st.Steps), len(tests))
+	}
+	for i, tt := range tests {
+		step := &st.Steps[i]
+		if step.Name != tt.step {
+			t.Fatalf("step %d is %s, want %s", i, step.Name, tt.step)
+		}
+		if got := stepToolNames(step); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("stepToolNames(%s) = %v, want %v", tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestStepToolNamesCoverInstructions(t *testing.T) {
+	// Every step-level tool a default step tells the agent to call must be
+	// listed while the step runs
+	st := newWorkflowState(defaultConfig(), "test")
+	for i := range st.Steps {
+		step := &st.Steps[i]
+		listed := stepToolNames(step)
+		for name := range stepTools {
+			if strings.Contains(step.Instructions, name) && !containsString(listed, name) {
+				t.Errorf("step %s mentions %s but doesn't list it", step.Name, name)
+			}
+		}
+	}
+}
+
+func TestStepToolNames(t *testing.T) {
+	tests := []struct {
+		name string
+		step WorkflowStep
+		want []string
+	}{
+		{
+			name: "tools list replaces defaults",
+			step: WorkflowStep{Name: "plan", NeedsApproval: true, Tools: []string{"workflow_next"}},
+			want: []string{"workflow_next"},
+		},
+		{
+			name: "instructions don't add tools",
+			step: WorkflowStep{Name: "design", Instructions: "Save it with workflow_set_plan()."},
+			want: alwaysStepTools,
+		},
+		{
+			name: "checks list criteria tools",
+			step: WorkflowStep{Name: "test", Checks: []Check{{Command: "go test ./..."}}},
+			want: append(append([]string{}, alwaysStepTools...), criteriaStepTools...),
+		},
+		{
+			name: "review block lists workflow_check_pr once",
+			step: WorkflowStep{Name: "review", Review: &ReviewConfig{QuietPeriod: "1m"}},
+			want: append(append([]string{}, alwaysStepTools...), "workflow_check_pr"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stepToolNames(&tt.step); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("stepToolNames() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Transition is an entry in a step's `next` list: when the condition holds
+// as the step completes, the workflow jumps to Goto instead of the
+// following step. An empty When always matches.
+type Transition struct {
+	When string `yaml:"when" json:"when,omitempty"`
+	Goto string `yaml:"goto" json:"goto"`
+}
+
+// Outcomes a step can complete with (see workflow_next's outcome argument)
+const (
+	outcomeSuccess = "success"
+	outcomeFailure = "failure"
+)
+
+// doneStep is the reserved transition target that ends the workflow.
+const doneStep = "done"
+
+// stepTransition describes a completed move between steps.
+type stepTransition struct {
+	Previous string   // step that completed
+	Next     string   // step now in progress, or "done"
+	Via      string   // which rule chose Next, for the response and event message
+	Skipped  []string // steps jumped over by a forward transition
+	Reset    []string // steps reset to pending by a backward transition
+}
+
+func stepIndex(st *WorkflowState, name string) int {
+	for i, s := range st.Steps {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// transitionContext is what `when:` expressions are evaluated against: the
+// JSON form of the workflow state (artifacts, iteration_count, pr_number,
+// ...) plus the outcome reported for the completing step.
+func transitionContext(st *WorkflowState, outcome string) map[string]any {
+	ctx := map[string]any{}
+	data, _ := json.Marshal(st)
+	json.Unmarshal(data, &ctx)
+	ctx["outcome"] = outcome
+	return ctx
+}
+
+// resolveNextStep picks the step to run after step idx completes with
+// outcome: the first matching `next` rule, then on_success/on_failure, then
+// the following step. It returns len(st.Steps) when the workflow is done.
+func resolveNextStep(st *WorkflowState, idx int, outcome string) (int, string, error) {
+	step := st.Steps[idx]
+
+	target, via := "", ""
+	if len(step.Next) > 0 {
+		ctx := transitionContext(st, outcome)
+		for _, t := range step.Next {
+			if t.When == "" {
+				target, via = t.Goto, "next"
+				break
+			}
+			ok, err := evalCondition(t.When, ctx)
+			if err != nil {
+				return 0, "", toolError("step %s: invalid condition %q: %v", step.Name, t.When, err)
+			}
+			if ok {
+				target, via = t.Goto, fmt.Sprintf("when: %s", t.When)
+				break
+			}
+		}
+	}
+	if target == "" && outcome == outcomeSuccess && step.OnSuccess != "" {
+		target, via = step.OnSuccess, "on_success"
+	}
+	if target == "" && outcome == outcomeFailure && step.OnFailure != "" {
+		target, via = step.OnFailure, "on_failure"
+	}
+
+	if target == "" {
+		return idx + 1, "sequential", nil
+	}
+	if target == doneStep {
+		return len(st.Steps), via, nil
+	}
+	next := stepIndex(st, target)
+	if next < 0 {
+		return 0, "", toolError("step %s: transition target %q does not exist", step.Name, target)
+	}
+	return next, via, nil
+}
+
+// completeStep marks step idx completed and starts the step chosen by
+// resolveNextStep. Jumping forward marks the steps in between as skipped;
+// jumping back (e.g. verify -> execute) resets every later step to pending
+// so they run again.
+func completeStep(st *WorkflowState, idx int, outcome string) (stepTransition, error) {
+	next, via, err := resolveNextStep(st, idx, outcome)
+	if err != nil {
+		return stepTransition{}, err
+	}
+
+	tr := stepTransition{Previous: st.Steps[idx].Name, Via: via}
+	st.Steps[idx].Status = "completed"
+	st.Steps[idx].Outcome = outcome
+	st.Steps[idx].Approval = nil
+	endAttempt(&st.Steps[idx], "completed")
+	joinBranches(&st.Steps[idx])
+
+	if next > idx {
+		for i := idx + 1; i < next; i++ {
+			if st.Steps[i].Status == "pending" {
+				st.Steps[i].Status = "skipped"
+				tr.Skipped = append(tr.Skipped, st.Steps[i].Name)
+			}
+		}
+	} else {
+		for i := next + 1; i < len(st.Steps); i++ {
+			if st.Steps[i].Status != "pending" {
+				endAttempt(&st.Steps[i], "reset")
+				st.Steps[i].Status = "pending"
+				st.Steps[i].Outcome = ""
+				st.Steps[i].ChildID = ""
+				resetBranches(&st.Steps[i])
+				tr.Reset = append(tr.Reset, st.Steps[i].Name)
+			}
+		}
+	}
+
+	if next < len(st.Steps) {
+		st.Steps[next].ChildID = "" // a step that runs again gets a fresh sub-workflow
+		startStep(&st.Steps[next])
+		st.CurrentStep = st.Steps[next].Name
+	} else {
+		st.CurrentStep = doneStep
+	}
+	syncActiveSteps(st)
+	tr.Next = st.CurrentStep
+	return tr, nil
+}
+
+// message summarizes the transition for the event log.
+func (tr stepTransition) message() string {
+	if tr.Via == "sequential" {
+		return ""
+	}
+	return fmt.Sprintf("%s -> %s (%s)", tr.Previous, tr.Next, tr.Via)
+}
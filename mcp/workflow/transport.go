@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Transports. The server speaks MCP over stdio (one client, newline
+// delimited messages) or Streamable HTTP (any number of clients, each with
+// its own session), so one long-running server can be shared by several
+// Claude sessions. Both hand raw messages to handleMessage; a session is
+// where server-initiated messages for a client go.
+
+// supportedProtocolVersions lists the MCP revisions this server speaks,
+// newest first.
+var supportedProtocolVersions = []string{"2025-03-26", "2024-11-05"}
+
+// negotiateProtocolVersion answers an initialize request: the client's
+// version if it is supported, otherwise the newest one.
+func negotiateProtocolVersion(params json.RawMessage) string {
+	var p struct {
+		ProtocolVersion string `json:"protocolVersion"`
+	}
+	json.Unmarshal(params, &p)
+	if containsString(supportedProtocolVersions, p.ProtocolVersion) {
+		return p.ProtocolVersion
+	}
+	return supportedProtocolVersions[0]
+}
+
+// handleMessage handles one JSON-RPC message or batch and returns the
+// encoded response, or nil if nothing needs to be sent back.
+func handleMessage(sess *session, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(data, &batch); err != nil {
+			return parseErrorResponse(err)
+		}
+		if len(batch) == 0 {
+			output, _ := json.Marshal(&Response{JSONRPC: "2.0", Error: rpcError(codeInvalidRequest, "empty batch")})
+			return output
+		}
+		var responses []json.RawMessage
+		for _, msg := range batch {
+			if resp := handleMessage(sess, msg); resp != nil {
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) == 0 {
+			return nil
+		}
+		output, _ := json.Marshal(responses)
+		return output
+	}
+
+	var req Request
+	if err := json.Unmarshal(data, &req); err != nil {
+		return parseErrorResponse(err)
+	}
+	resp := handleRequest(sess, req)
+	if resp == nil {
+		return nil
+	}
+	output, _ := json.Marshal(resp)
+	return output
+}
+
+func parseErrorResponse(err error) []byte {
+	output, _ := json.Marshal(&Response{
+		JSONRPC: "2.0",
+		Error:   rpcError(codeParseError, "parse error: %v", err),
+	})
+	return output
+}
+
+// session is one connected client.
+type session struct {
+	id            string
+	mu            sync.Mutex
+	send          func([]byte) bool // delivers a server-initiated message; false if it couldn't
+	subscriptions map[string]bool   // resource URIs, see resources/subscribe
+	lastSeen      time.Time
+}
+
+// notify sends a JSON-RPC notification to the client, if it has a way to
+// receive one right now.
+func (s *session) notify(method string, params any) bool {
+	msg := map[string]any{"jsonrpc": "2.0", "method": method}
+	if params != nil {
+		msg["params"] = params
+	}
+	data, _ := json.Marshal(msg)
+	s.mu.Lock()
+	send := s.send
+	s.mu.Unlock()
+	return send != nil && send(data)
+}
+
+// sessions holds the connected clients of this process.
+var sessions = struct {
+	sync.Mutex
+	byID map[string]*session
+}{byID: map[string]*session{}}
+
+func addSession(s *session) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	sessions.byID[s.id] = s
+}
+
+func removeSession(id string) {
+	sessions.Lock()
+	defer sessions.Unlock()
+	delete(sessions.byID, id)
+}
+
+// broadcast sends a notification to every connected client.
+func broadcast(method string, params any) {
+	sessions.Lock()
+	all := make([]*session, 0, len(sessions.byID))
+	for _, s := range sessions.byID {
+		all = append(all, s)
+	}
+	sessions.Unlock()
+	for _, s := range all {
+		s.notify(method, params)
+	}
+}
+
+// serveStdio serves one client over stdin/stdout until stdin is closed.
+// Messages are read a line at a time with no limit on the line length, so
+// large artifacts don't break the session.
+func serveStdio(in io.Reader, out io.Writer) error {
+	var writeMu sync.Mutex
+	write := func(msg []byte) bool {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_, err := out.Write(append(msg, '\n'))
+		return err == nil
+	}
+	sess := &session{id: "stdio", send: write}
+	addSession(sess)
+	defer removeSession(sess.id)
+
+	reader := bufio.NewReader(in)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(bytes.TrimSpace(line)) > 0 {
+			if resp := handleMessage(sess, line); resp != nil {
+				write(resp)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Streamable HTTP (MCP 2025-03-26). Clients POST messages to /mcp and get
+// the response back as JSON; initialize starts a session whose ID the client
+// sends back in the Mcp-Session-Id header. A GET opens an event stream for
+// the session's server-initiated messages, and a DELETE ends the session.
+
+const (
+	sessionHeader = "Mcp-Session-Id"
+	maxMCPBody    = 64 << 20
+	// sessionIdleTimeout is how long a session with no requests is kept.
+	sessionIdleTimeout = 24 * time.Hour
+)
+
+func serveMCP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		postMCP(w, r)
+	case http.MethodGet:
+		streamMCP(w, r)
+	case http.MethodDelete:
+		sess := lookupSession(w, r)
+		if sess == nil {
+			return
+		}
+		sess.mu.Lock()
+		sess.send = nil
+		sess.mu.Unlock()
+		removeSession(sess.id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		writeHTTPError(w, http.StatusMethodNotAllowed, toolError("method %s not allowed", r.Method))
+	}
+}
+
+func postMCP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxMCPBody))
+	if err != nil {
+		writeHTTPError(w, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+
+	var sess *session
+	if isInitialize(body) {
+		pruneSessions()
+		sess = &session{id: newSessionID(), lastSeen: time.Now()}
+		addSession(sess)
+		w.Header().Set(sessionHeader, sess.id)
+	} else if sess = lookupSession(w, r); sess == nil {
+		return
+	}
+
+	resp := handleMessage(sess, body)
+	if resp == nil {
+		// Only notifications or responses
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
+
+// streamMCP holds a GET open as an event stream for the session's
+// server-initiated messages.
+func streamMCP(w http.ResponseWriter, r *http.Request) {
+	if !strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		writeHTTPError(w, http.StatusNotAcceptable, toolError("GET /mcp needs Accept: text/event-stream"))
+		return
+	}
+	sess := lookupSession(w, r)
+	if sess == nil {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeHTTPError(w, http.StatusInternalServerError, errors.New("streaming not supported"))
+		return
+	}
+
+	messages := make(chan []byte, 64)
+	send := func(msg []byte) bool {
+		select {
+		case messages <- msg:
+			return true
+		default:
+			return false // the client isn't keeping up
+		}
+	}
+	sess.mu.Lock()
+	if sess.send != nil {
+		sess.mu.Unlock()
+		writeHTTPError(w, http.StatusConflict, toolError("session %s already has an open stream", sess.id))
+		return
+	}
+	sess.send = send
+	sess.mu.Unlock()
+	defer func() {
+		sess.mu.Lock()
+		sess.send = nil
+		sess.mu.Unlock()
+		sessions.Lock()
+		sess.lastSeen = time.Now() // idle from when the stream closed
+		sessions.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+			flusher.Flush()
+		case msg := <-messages:
+			fmt.Fprintf(w, "data: %s\n\n", msg)
+			flusher.Flush()
+		}
+	}
+}
+
+// lookupSession finds the request's session, writing the error response if
+// there is none.
+func lookupSession(w http.ResponseWriter, r *http.Request) *session {
+	id := r.Header.Get(sessionHeader)
+	if id == "" {
+		writeHTTPError(w, http.StatusBadRequest, &ToolError{
+			Message: "missing " + sessionHeader + " header",
+			Hint:    "send initialize first and pass the session ID it returns",
+		})
+		return nil
+	}
+	sessions.Lock()
+	sess := sessions.byID[id]
+	if sess != nil {
+		sess.lastSeen = time.Now()
+	}
+	sessions.Unlock()
+	if sess == nil {
+		writeHTTPError(w, http.StatusNotFound, &ToolError{
+			Message: fmt.Sprintf("session %s not found", id),
+			Hint:    "the session ended or the server restarted; send initialize to start a new one",
+		})
+	}
+	return sess
+}
+
+func isInitialize(body []byte) bool {
+	var req Request
+	return json.Unmarshal(body, &req) == nil && req.Method == "initialize"
+}
+
+func newSessionID() string {
+	buf := make([]byte, 16)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// pruneSessions forgets HTTP sessions that have been idle for a long time.
+// A session with an open event stream isn't idle, however long ago its
+// last request was.
+func pruneSessions() {
+	sessions.Lock()
+	defer sessions.Unlock()
+	for id, s := range sessions.byID {
+		s.mu.Lock()
+		streaming := s.send != nil
+		s.mu.Unlock()
+		if !streaming && !s.lastSeen.IsZero() && time.Since(s.lastSeen) > sessionIdleTimeout {
+			delete(sessions.byID, id)
+		}
+	}
+}
+
+// checkOrigin guards against DNS rebinding: without a token, browsers may
+// only call the server from a page served by a loopback host.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	host := u.Hostname()
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
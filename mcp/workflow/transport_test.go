@@ -0,0 +1,39 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPruneSessions(t *testing.T) {
+	sessions.Lock()
+	saved := sessions.byID
+	sessions.byID = map[string]*session{}
+	sessions.Unlock()
+	t.Cleanup(func() {
+		sessions.Lock()
+		sessions.byID = saved
+		sessions.Unlock()
+	})
+
+	idle := time.Now().Add(-sessionIdleTimeout - time.Minute)
+	addSession(&session{id: "idle", lastSeen: idle})
+	addSession(&session{id: "streaming", lastSeen: idle, send: func([]byte) bool { return true }})
+	addSession(&session{id: "recent", lastSeen: time.Now()})
+	addSession(&session{id: "stdio"}) // no lastSeen: not an HTTP session
+
+	pruneSessions()
+
+	sessions.Lock()
+	var kept []string
+	for id := range sessions.byID {
+		kept = append(kept, id)
+	}
+	sessions.Unlock()
+	sort.Strings(kept)
+	if got := strings.Join(kept, " "); got != "recent stdio streaming" {
+		t.Errorf("sessions kept = %s, want recent stdio streaming", got)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// WebhookConfig is a webhooks entry in workflow.yaml. Every committed
+// WorkflowEvent whose type matches Events (or every event, if Events is
+// empty) is POSTed to URL as JSON. approval_code events only go to webhooks
+// that list them by name.
+type WebhookConfig struct {
+	URL    string   `yaml:"url" json:"url"`
+	Events []string `yaml:"events" json:"events,omitempty"`
+	// Secret is the HMAC-SHA256 key for the X-Workflow-Signature-256 header.
+	// $VAR references are expanded from the environment.
+	Secret string `yaml:"secret" json:"-"`
+}
+
+func (h WebhookConfig) wants(eventType string) bool {
+	if eventType == "approval_code" {
+		// Never queued; see deliverApprovalCode
+		return false
+	}
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, t := range h.Events {
+		if t == eventType || t == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	webhookTimeout     = 10 * time.Second
+	webhookPoll        = 5 * time.Second
+	webhookBaseBackoff = 5 * time.Second
+	webhookMaxBackoff  = time.Hour
+	webhookMaxAttempts = 12
+)
+
+// outboxItem is a pending webhook delivery, persisted as one file in the
+// outbox directory until it succeeds or runs out of attempts. The body is
+// signed when enqueued so the secret itself is never written to disk.
+type outboxItem struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	EventType   string `json:"event_type"`
+	Body        string `json:"body"` // exact signed bytes, kept as a string so re-encoding can't alter them
+	Signature   string `json:"signature,omitempty"`
+	Attempts    int    `json:"attempts"`
+	NextAttempt string `json:"next_attempt"`
+	LastError   string `json:"last_error,omitempty"`
+	CreatedAt   string `json:"created_at"`
+}
+
+// Outbox delivers webhook events with retries. Enqueue only writes a file
+// and never blocks on the network; Run does the delivery in the background.
+// Any process may enqueue (e.g. the CLI), but only the process holding the
+// outbox lock delivers, so events are not sent twice.
+type Outbox struct {
+	dir    string
+	client *http.Client
+	wake   chan struct{}
+}
+
+var outbox *Outbox
+
+func newOutbox(dir string) *Outbox {
+	return &Outbox{
+		dir:    dir,
+		client: &http.Client{Timeout: webhookTimeout},
+		wake:   make(chan struct{}, 1),
+	}
+}
+
+// Enqueue persists a delivery for every webhook that subscribes to ev.
+func (o *Outbox) Enqueue(ev WorkflowEvent) {
+	if config == nil || len(config.Webhooks) == 0 {
+		return
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	now := time.Now().UTC()
+	queued := false
+	for i, hook := range config.Webhooks {
+		if hook.URL == "" || !hook.wants(ev.Type) {
+			continue
+		}
+		item := outboxItem{
+			ID:          fmt.Sprintf("%d-%s-%d-%d", now.UnixNano(), ev.WorkflowID, ev.Seq, i),
+			URL:         hook.URL,
+			EventType:   ev.Type,
+			Body:        string(body),
+			NextAttempt: now.Format(time.RFC3339Nano),
+			CreatedAt:   now.Format(time.RFC3339),
+		}
+		if secret := os.ExpandEnv(hook.Secret); secret != "" {
+			item.Signature = signPayload(secret, body)
+		}
+		if err := o.save(o.dir, item); err != nil {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: webhook %s: enqueue %s: %v\n", hook.URL, ev.Type, err)
+			continue
+		}
+		queued = true
+	}
+	if queued {
+		select {
+		case o.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// signPayload returns the X-Workflow-Signature-256 header value for body.
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (o *Outbox) save(dir string, item outboxItem) error {
+	data, err := json.MarshalIndent(item, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, item.ID+".json"), data, 0600)
+}
+
+// Run delivers due items until the process exits.
+func (o *Outbox) Run() {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+	for {
+		o.deliverDue()
+		select {
+		case <-o.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (o *Outbox) deliverDue() {
+	if err := os.MkdirAll(filepath.Join(o.dir, "dead"), 0755); err != nil {
+		return
+	}
+	unlock, ok, err := tryLockFile(filepath.Join(o.dir, ".lock"))
+	if err != nil || !ok {
+		return // another process is delivering
+	}
+	defer unlock()
+
+	entries, err := os.ReadDir(o.dir)
+	if err != nil {
+		return
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names) // IDs start with the enqueue time, so this is FIFO
+
+	now := time.Now().UTC()
+	for _, name := range names {
+		path := filepath.Join(o.dir, name)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var item outboxItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: dropping corrupt outbox item %s: %v\n", path, err)
+			os.Rename(path, filepath.Join(o.dir, "dead", name))
+			continue
+		}
+		if next, err := time.Parse(time.RFC3339Nano, item.NextAttempt); err == nil && next.After(now) {
+			continue
+		}
+
+		err = o.post(item)
+		if err == nil {
+			os.Remove(path)
+			continue
+		}
+
+		item.Attempts++
+		item.LastError = err.Error()
+		if item.Attempts >= webhookMaxAttempts {
+			fmt.Fprintf(os.Stderr, "workflow-mcp: webhook %s: giving up on %s after %d attempts: %v\n", item.URL, item.ID, item.Attempts, err)
+			if o.save(filepath.Join(o.dir, "dead"), item) == nil {
+				os.Remove(path)
+			}
+			continue
+		}
+		backoff := min(webhookBaseBackoff<<(item.Attempts-1), webhookMaxBackoff)
+		item.NextAttempt = now.Add(backoff).Format(time.RFC3339Nano)
+		o.save(o.dir, item)
+	}
+}
+
+func (o *Outbox) post(item outboxItem) error {
+	req, err := http.NewRequest(http.MethodPost, item.URL, strings.NewReader(item.Body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "workflow-mcp")
+	req.Header.Set("X-Workflow-Event", item.EventType)
+	req.Header.Set("X-Workflow-Delivery", item.ID)
+	if item.Signature != "" {
+		req.Header.Set("X-Workflow-Signature-256", item.Signature)
+	}
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
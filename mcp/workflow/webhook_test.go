@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// receiver is an httptest webhook endpoint that records what it gets and
+// answers with status.
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	requests []receivedRequest
+}
+
+type receivedRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newReceiver(t *testing.T, status int) *receiver {
+	r := &receiver{status: status}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		r.mu.Lock()
+		r.requests = append(r.requests, receivedRequest{req.Header.Clone(), body})
+		status := r.status
+		r.mu.Unlock()
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+func (r *receiver) received() []receivedRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]receivedRequest{}, r.requests...)
+}
+
+// testOutbox returns an outbox in a temporary directory, with config set to
+// hooks for the duration of the test.
+func testOutbox(t *testing.T, hooks ...WebhookConfig) *Outbox {
+	saved := config
+	config = &WorkflowConfig{Name: "test", Webhooks: hooks}
+	t.Cleanup(func() { config = saved })
+
+	return newOutbox(t.TempDir())
+}
+
+// queued returns the items waiting in dir.
+func queued(t *testing.T, dir string) []outboxItem {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []outboxItem
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var item outboxItem
+		if err := json.Unmarshal(data, &item); err != nil {
+			t.Fatal(err)
+		}
+		items = append(items, item)
+	}
+	return items
+}
+
+func TestWebhookWants(t *testing.T) {
+	tests := []struct {
+		name      string
+		events    []string
+		eventType string
+		want      bool
+	}{
+		{"no events means all", nil, "step_completed", true},
+		{"listed", []string{"step_completed", "approved"}, "approved", true},
+		{"not listed", []string{"step_completed"}, "approved", false},
+		{"wildcard", []string{"*"}, "workflow_stale", true},
+		{"approval_code never queued", []string{"approval_code"}, "approval_code", false},
+		{"approval_code not matched by all", nil, "approval_code", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := (WebhookConfig{URL: "http://example.test", Events: tt.events}).wants(tt.eventType); got != tt.want {
+				t.Errorf("wants(%q) = %v, want %v", tt.eventType, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxDeliversSigned(t *testing.T) {
+	signed := newReceiver(t, http.StatusOK)
+	unsigned := newReceiver(t, http.StatusNoContent)
+	filtered := newReceiver(t, http.StatusOK)
+	o := testOutbox(t,
+		WebhookConfig{URL: signed.URL, Secret: "s3cret"},
+		WebhookConfig{URL: unsigned.URL},
+		WebhookConfig{URL: filtered.URL, Events: []string{"approved"}},
+	)
+
+	ev := WorkflowEvent{Event: "workflow", Type: "step_completed", WorkflowID: "wf_1", Seq: 3, Step: "plan"}
+	o.Enqueue(ev)
+	if n := len(queued(t, o.dir)); n != 2 {
+		t.Fatalf("enqueued %d items, want 2", n)
+	}
+	o.deliverDue()
+
+	want, _ := json.Marshal(ev)
+	for _, tt := range []struct {
+		name    string
+		r       *receiver
+		secret  string
+		wantHit bool
+	}{
+		{"signed", signed, "s3cret", true},
+		{"unsigned", unsigned, "", true},
+		{"filtered", filtered, "", false},
+	} {
+		got := tt.r.received()
+		if !tt.wantHit {
+			if len(got) != 0 {
+				t.Errorf("%s: got %d requests, want none", tt.name, len(got))
+			}
+			continue
+		}
+		if len(got) != 1 {
+			t.Fatalf("%s: got %d requests, want 1", tt.name, len(got))
+		}
+		req := got[0]
+		if string(req.body) != string(want) {
+			t.Errorf("%s: body = %s, want %s", tt.name, req.body, want)
+		}
+		if h := req.header.Get("X-Workflow-Event"); h != "step_completed" {
+			t.Errorf("%s: X-Workflow-Event = %q", tt.name, h)
+		}
+		sig := req.header.Get("X-Workflow-Signature-256")
+		if tt.secret == "" {
+			if sig != "" {
+				t.Errorf("%s: unexpected signature %q", tt.name, sig)
+			}
+			continue
+		}
+		mac := hmac.New(sha256.New, []byte(tt.secret))
+		mac.Write(req.body)
+		if wantSig := "sha256=" + hex.EncodeToString(mac.Sum(nil)); sig != wantSig {
+			t.Errorf("%s: signature = %q, want %q", tt.name, sig, wantSig)
+		}
+	}
+	if n := len(queued(t, o.dir)); n != 0 {
+		t.Errorf("%d items left in the outbox after delivery", n)
+	}
+}
+
+func TestOutboxSecretFromEnv(t *testing.T) {
+	t.Setenv("WORKFLOW_TEST_SECRET", "from-env")
+	r := newReceiver(t, http.StatusOK)
+	o := testOutbox(t, WebhookConfig{URL: r.URL, Secret: "$WORKFLOW_TEST_SECRET"})
+
+	o.Enqueue(WorkflowEvent{Event: "workflow", Type: "init", WorkflowID: "wf_1"})
+	items := queued(t, o.dir)
+	if len(items) != 1 {
+		t.Fatalf("enqueued %d items, want 1", len(items))
+	}
+	if want := signPayload("from-env", []byte(items[0].Body)); items[0].Signature != want {
+		t.Errorf("signature = %q, want %q", items[0].Signature, want)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int // failed attempts before this one
+		want     time.Duration
+	}{
+		{0, webhookBaseBackoff},
+		{1, 2 * webhookBaseBackoff},
+		{4, 16 * webhookBaseBackoff},
+		{webhookMaxAttempts - 2, webhookMaxBackoff},
+	}
+	for _, tt := range tests {
+		r := newReceiver(t, http.StatusInternalServerError)
+		o := testOutbox(t, WebhookConfig{URL: r.URL})
+		o.Enqueue(WorkflowEvent{Event: "workflow", Type: "init", WorkflowID: "wf_1"})
+		item := queued(t, o.dir)[0]
+		item.Attempts = tt.attempts
+		if err := o.save(o.dir, item); err != nil {
+			t.Fatal(err)
+		}
+
+		before := time.Now()
+		o.deliverDue()
+		after := time.Now()
+
+		items := queued(t, o.dir)
+		if len(items) != 1 {
+			t.Fatalf("after attempt %d: %d items queued, want 1", tt.attempts+1, len(items))
+		}
+		got := items[0]
+		if got.Attempts != tt.attempts+1 {
+			t.Errorf("after attempt %d: attempts = %d", tt.attempts+1, got.Attempts)
+		}
+		if got.LastError == "" {
+			t.Errorf("after attempt %d: no last_error", tt.attempts+1)
+		}
+		next, err := time.Parse(time.RFC3339Nano, got.NextAttempt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next.Before(before.Add(tt.want)) || next.After(after.Add(tt.want)) {
+			t.Errorf("after attempt %d: next attempt in %s, want %s", tt.attempts+1, next.Sub(before).Round(time.Second), tt.want)
+		}
+
+		// Not due yet, so the next pass leaves it alone
+		o.deliverDue()
+		if n := len(r.received()); n != 1 {
+			t.Errorf("after attempt %d: %d requests, want 1", tt.attempts+1, n)
+		}
+	}
+}
+
+func TestOutboxRetrySucceeds(t *testing.T) {
+	r := newReceiver(t, http.StatusBadGateway)
+	o := testOutbox(t, WebhookConfig{URL: r.URL})
+	o.Enqueue(WorkflowEvent{Event: "workflow", Type: "init", WorkflowID: "wf_1"})
+	o.deliverDue()
+
+	item := queued(t, o.dir)[0]
+	item.NextAttempt = time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+	if err := o.save(o.dir, item); err != nil {
+		t.Fatal(err)
+	}
+	r.mu.Lock()
+	r.status = http.StatusOK
+	r.mu.Unlock()
+	o.deliverDue()
+
+	got := r.received()
+	if len(got) != 2 {
+		t.Fatalf("got %d requests, want 2", len(got))
+	}
+	if string(got[0].body) != string(got[1].body) {
+		t.Errorf("retry body = %s, want %s", got[1].body, got[0].body)
+	}
+	if n := len(queued(t, o.dir)); n != 0 {
+		t.Errorf("%d items left in the outbox after the retry succeeded", n)
+	}
+}
+
+func TestOutboxDeadLetters(t *testing.T) {
+	r := newReceiver(t, http.StatusInternalServerError)
+	o := testOutbox(t, WebhookConfig{URL: r.URL})
+	o.Enqueue(WorkflowEvent{Event: "workflow", Type: "init", WorkflowID: "wf_1"})
+	item := queued(t, o.dir)[0]
+	item.Attempts = webhookMaxAttempts - 1
+	if err := o.save(o.dir, item); err != nil {
+		t.Fatal(err)
+	}
+	// A corrupt item goes straight to dead/
+	if err := os.WriteFile(filepath.Join(o.dir, "0-corrupt.json"), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	o.deliverDue()
+
+	if n := len(queued(t, o.dir)); n != 0 {
+		t.Errorf("%d items left in the outbox, want 0", n)
+	}
+	data, err := os.ReadFile(filepath.Join(o.dir, "dead", item.ID+".json"))
+	if err != nil {
+		t.Fatalf("item not moved to dead/: %v", err)
+	}
+	var dead outboxItem
+	if err := json.Unmarshal(data, &dead); err != nil {
+		t.Fatal(err)
+	}
+	if dead.Attempts != webhookMaxAttempts || dead.LastError == "" || dead.Body != item.Body {
+		t.Errorf("dead letter = %+v", dead)
+	}
+	if _, err := os.Stat(filepath.Join(o.dir, "dead", "0-corrupt.json")); err != nil {
+		t.Errorf("corrupt item not moved to dead/: %v", err)
+	}
+}